@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// backoff is the schedule of pauses between the attempts at an upstream
+// query: base after the first failure, growing by multiplier after each one
+// after that, up to max. Each pause is jittered, so that clients that failed
+// together do not all retry together.
+type backoff struct {
+	base       time.Duration
+	multiplier float64
+	max        time.Duration
+	// jitter returns a random number in [0, 1).
+	jitter func() float64
+}
+
+// delay returns the pause after the failure of attempt, counted from zero.
+// Half of it is fixed and half random, which spreads retries out while
+// still backing off.
+func (b backoff) delay(attempt int) time.Duration {
+	d := float64(b.base) * math.Pow(b.multiplier, float64(attempt))
+	if b.max > 0 && d > float64(b.max) {
+		d = float64(b.max)
+	}
+	return time.Duration(d/2 + d/2*b.jitter())
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
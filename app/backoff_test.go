@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := backoff{base: 100 * time.Millisecond, multiplier: 2, max: 500 * time.Millisecond}
+	for _, tt := range []struct {
+		jitter float64
+		want   []time.Duration
+	}{
+		{0, []time.Duration{50, 100, 200, 250, 250}},
+		{0.5, []time.Duration{75, 150, 300, 375, 375}},
+		{0.999, []time.Duration{99, 199, 399, 499, 499}},
+	} {
+		b.jitter = func() float64 { return tt.jitter }
+		for attempt, want := range tt.want {
+			if got := b.delay(attempt).Truncate(time.Millisecond); got != want*time.Millisecond {
+				t.Errorf("jitter %v: delay(%d) = %v, want %v", tt.jitter, attempt, got, want*time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestRetriesBackOff(t *testing.T) {
+	attempts := 0
+	cfg := &Config{
+		Upstreams: []Upstream{upstreamFunc(func(ctx context.Context, req *Message) (*Message, error) {
+			attempts++
+			return nil, errors.New("flapping")
+		})},
+		Timeout:         time.Second,
+		Retries:         4,
+		RetryDelay:      100 * time.Millisecond,
+		RetryMultiplier: 3,
+		MaxRetryDelay:   time.Second,
+	}
+	s := newServer(cfg)
+	s.backoff.jitter = func() float64 { return 0.5 }
+	// The fake clock only records the pauses, so the test takes no time.
+	var slept []time.Duration
+	s.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 1, "example.com", TypeA)))
+	if err != nil || resp.Header.ResponseCode != RCodeServFail {
+		t.Fatalf("response %+v, %v; want SERVFAIL", resp, err)
+	}
+	if attempts != 5 {
+		t.Errorf("upstream was tried %d times, want 5", attempts)
+	}
+	// 100ms, 300ms, 900ms and then the 1s cap, each three quarters taken
+	// with a jitter of one half.
+	want := []time.Duration{75 * time.Millisecond, 225 * time.Millisecond, 675 * time.Millisecond, 750 * time.Millisecond}
+	if len(slept) != len(want) {
+		t.Fatalf("paused %v, want %v", slept, want)
+	}
+	for i := range want {
+		if slept[i] != want[i] {
+			t.Errorf("pause %d was %v, want %v", i, slept[i], want[i])
+		}
+	}
+}
+
+func TestRetryPauseEndsWithContext(t *testing.T) {
+	attempts := 0
+	cfg := &Config{
+		Upstreams: []Upstream{upstreamFunc(func(ctx context.Context, req *Message) (*Message, error) {
+			attempts++
+			return nil, errors.New("flapping")
+		})},
+		Timeout:    time.Second,
+		Retries:    3,
+		RetryDelay: time.Hour,
+	}
+	s := newServer(cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := s.forward(ctx, newQueryMessage(1)); err == nil {
+		t.Fatal("forward succeeded")
+	}
+	if attempts != 1 || time.Since(start) > time.Second {
+		t.Errorf("gave up after %d attempts and %v, want 1 attempt as soon as the context ended", attempts, time.Since(start))
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Blocklist is a set of domains answered with NXDOMAIN instead of being
+// forwarded. Blocking a domain also blocks every name below it.
+type Blocklist struct {
+	domains map[string]struct{}
+}
+
+// loadBlocklist reads a blocklist from a file, see parseBlocklist.
+func loadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseBlocklist(f)
+}
+
+// parseBlocklist reads one domain name per line. Blank lines and everything
+// after a # are ignored.
+func parseBlocklist(r io.Reader) (*Blocklist, error) {
+	b := &Blocklist{domains: make(map[string]struct{})}
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 1 {
+			return nil, fmt.Errorf("line %d: expected a single name", lineno)
+		}
+		name := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		if err := validateName(name); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		b.domains[name] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Blocked reports whether name or any of its parent domains is on the
+// blocklist.
+func (b *Blocklist) Blocked(name string) bool {
+	if b == nil {
+		return false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for {
+		if _, ok := b.domains[name]; ok {
+			return true
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return false
+		}
+		name = parent
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const testBlocklist = `
+# trackers
+example.com
+Tracker.Example.
+`
+
+func TestBlocklistBlocked(t *testing.T) {
+	b, err := parseBlocklist(strings.NewReader(testBlocklist))
+	if err != nil {
+		t.Fatalf("parseBlocklist: %v", err)
+	}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.com.", true},
+		{"ads.example.com", true},
+		{"a.b.tracker.example", true},
+		{"notexample.com", false},
+		{"com", false},
+		{"example.org", false},
+	}
+	for _, tt := range tests {
+		if got := b.Blocked(tt.name); got != tt.want {
+			t.Errorf("Blocked(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseBlocklistErrors(t *testing.T) {
+	if _, err := parseBlocklist(strings.NewReader("two names\n")); err == nil {
+		t.Fatal("parseBlocklist accepted two names on one line")
+	}
+}
+
+func TestServerBlocksNames(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	cfg := testConfig(upstream)
+	blocklist, err := parseBlocklist(strings.NewReader("ads.example\n"))
+	if err != nil {
+		t.Fatalf("parseBlocklist: %v", err)
+	}
+	cfg.Blocklist = blocklist
+	s := newServer(cfg)
+
+	for i, name := range []string{"ads.example", "pixel.ads.example"} {
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, uint16(i+1), name, TypeA)))
+		if err != nil {
+			t.Fatalf("parseRequest: %v", err)
+		}
+		if resp.Header.ResponseCode != RCodeNXDomain || len(resp.Answer) != 0 {
+			t.Fatalf("%s: rcode %s with %d answers, want NXDOMAIN and none", name, resp.Header.ResponseCode, len(resp.Answer))
+		}
+	}
+	if n := len(upstream.seen()); n != 0 {
+		t.Fatalf("blocked names were forwarded %d times", n)
+	}
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 3, "example.com", TypeA)))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 1 {
+		t.Fatalf("allowed name: rcode %s with %d answers", resp.Header.ResponseCode, len(resp.Answer))
+	}
+	if n := len(upstream.seen()); n != 1 {
+		t.Fatalf("upstream saw %d queries, want 1", n)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "sync"
+
+// bufferPool holds receive buffers big enough for any UDP message we accept,
+// and a byte more, so that each packet read does not allocate one. It stores
+// pointers to slices to keep Put itself from allocating.
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, ednsUDPSize+1)
+		return &buf
+	},
+}
+
+// getBuffer returns an ednsUDPSize+1 byte buffer from the pool. Hand it back
+// with putBuffer once nothing refers to its contents any more; the parser
+// copies everything it keeps, so that is as soon as parsing is done.
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+// putBuffer hands buf back to the pool, at its full size again if it was
+// cut to the length of a packet.
+func putBuffer(buf *[]byte) {
+	*buf = (*buf)[:cap(*buf)]
+	bufferPool.Put(buf)
+}
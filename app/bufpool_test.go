@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// BenchmarkExchange measures a full round trip to an upstream. The reply is
+// read into a pooled buffer, so B/op should stay well below ednsUDPSize.
+func BenchmarkExchange(b *testing.B) {
+	upstream := newMockUpstream(b, answerA)
+	u := upstream.upstream().(*udpUpstream)
+	req := &Message{
+		Header:   &Header{ID: 1, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := u.Exchange(context.Background(), req); err != nil {
+			b.Fatalf("Exchange: %v", err)
+		}
+	}
+}
+
+// BenchmarkQueryDNS measures queryDNS alone: the query is serialized once,
+// into a buffer sized for it, and the reply is read into the buffer the
+// caller passes in, so B/op tracks the size of the query rather than that
+// of the largest possible reply.
+func BenchmarkQueryDNS(b *testing.B) {
+	upstream := newMockUpstream(b, answerA)
+	conn, err := net.DialUDP("udp", nil, upstream.addr())
+	if err != nil {
+		b.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	req := &Message{
+		Header:   &Header{ID: 1, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	buf := make([]byte, ednsUDPSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := queryDNS(context.Background(), req, conn, buf); err != nil {
+			b.Fatalf("queryDNS: %v", err)
+		}
+	}
+}
+
+// benchQuery is the query BenchmarkToBytes and BenchmarkToBytesFixedBuffer
+// serialize.
+var benchQuery = &Message{
+	Header:   &Header{ID: 1, RecursionDesired: 1},
+	Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+}
+
+// BenchmarkToBytes serializes a query into a buffer sized from WireLen, with
+// no compression map.
+func BenchmarkToBytes(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := benchQuery.ToBytes(); err != nil {
+			b.Fatalf("ToBytes: %v", err)
+		}
+	}
+}
+
+// BenchmarkToBytesFixedBuffer serializes the same query the way pack used to:
+// into a 512-byte buffer, with a compression map made even though nothing is
+// compressed. It is kept for comparison with BenchmarkToBytes.
+func BenchmarkToBytesFixedBuffer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		header := *benchQuery.Header
+		header.QuestionCount = uint16(len(benchQuery.Question))
+		w := &nameWriter{buf: make([]byte, 0, 512), offsets: make(map[string]int)}
+		w.buf = append(w.buf, header.ToBytes()...)
+		for _, q := range benchQuery.Question {
+			if err := w.writeQuestion(q); err != nil {
+				b.Fatalf("writeQuestion: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheKey identifies a cached response. Names are compared
+// case-insensitively, as DNS requires. Answers fetched with DO set carry
+// DNSSEC records the others do not, so they are kept apart.
+type cacheKey struct {
+	Name     string
+	Type     Type
+	Class    uint16
+	DNSSECOK bool
+}
+
+func newCacheKey(q *Question, dnssecOK bool) cacheKey {
+	return cacheKey{Name: strings.ToLower(q.Name), Type: q.Type, Class: q.Class, DNSSECOK: dnssecOK}
+}
+
+// staleTTL is the TTL of the records in a stale answer, as RFC 8767
+// recommends.
+const staleTTL = 30
+
+// prefetchWindow is the fraction of an entry's TTL, as a divisor, left when
+// it becomes due for prefetching.
+const prefetchWindow = 10
+
+type cacheEntry struct {
+	key   cacheKey
+	rcode RCode
+	// authenticated records the AD bit the upstream answered with.
+	authenticated bool
+	answers       []*Answer
+	authority     []*Answer
+	stored        time.Time
+	expires       time.Time
+	// hits counts the Gets served from the entry, including those of the
+	// entries it replaced, and prefetched is set once Prefetch reports it.
+	hits       int
+	prefetched bool
+}
+
+// Cache stores upstream responses until the smallest TTL among their answers
+// runs out. NXDOMAIN responses are cached as well, for as long as the SOA in
+// their authority section allows (RFC 2308). Once it holds maxEntries
+// responses, storing another evicts the least recently used one. Expired
+// responses are kept for staleFor longer, for GetStale. It is safe for
+// concurrent use.
+//
+// Entries hit at least prefetchHits times are reported by Prefetch as they
+// near expiry, so that they can be refreshed before anyone has to wait for
+// them. Zero disables prefetching.
+//
+// With a ttlJitter percentage, each cached copy has its TTLs scaled by a
+// random factor up to that much above or below one, so that responses
+// cached together do not all expire together. The scaled TTLs are then
+// clamped to minTTL and maxTTL, the bounds the server puts on every TTL.
+type Cache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	// lru holds the *cacheEntry values, most recently used first.
+	lru          *list.List
+	maxEntries   int
+	staleFor     time.Duration
+	prefetchHits int
+	ttlJitter    float64
+	minTTL       uint32
+	maxTTL       uint32
+	// now is the clock used for expiry, and jitter the source of random
+	// numbers in [0, 1) for ttlJitter, both replaceable in tests.
+	now    func() time.Time
+	jitter func() float64
+}
+
+// newCache returns a cache holding at most maxEntries responses, or any
+// number of them if maxEntries is zero.
+func newCache(maxEntries int) *Cache {
+	return &Cache{
+		entries:    make(map[cacheKey]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		now:        time.Now,
+		jitter:     rand.Float64,
+	}
+}
+
+// Len returns the number of responses in the cache, expired ones included
+// until they are next looked up or evicted.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// copyRecords returns copies of records with elapsed seconds taken off
+// every TTL. TTLs stop at zero: an entry lives as long as its shortest
+// answer, but an authority record can run out before the entry does.
+func copyRecords(records []*Answer, elapsed uint32) []*Answer {
+	copies := make([]*Answer, len(records))
+	for i, r := range records {
+		record := *r
+		record.TTL -= min(elapsed, record.TTL)
+		copies[i] = &record
+	}
+	return copies
+}
+
+// Get returns a response for q built from the cache, with TTLs reduced by the
+// time spent in the cache. dnssecOK picks the answer fetched with DO set or
+// the one fetched without.
+func (c *Cache) Get(q *Question, dnssecOK bool) (*Message, bool) {
+	key := newCacheKey(q, dnssecOK)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := c.now()
+	if !now.Before(entry.expires) {
+		if !now.Before(entry.expires.Add(c.staleFor)) {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		}
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	entry.hits++
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	return entry.response(q, copyRecords(entry.answers, elapsed), copyRecords(entry.authority, elapsed)), true
+}
+
+// Snapshot returns the responses in the cache that have not expired, with
+// TTLs reduced by the time spent in it, least recently used first, so that
+// putting them back in order keeps the order of the LRU list. Responses
+// fetched with DO set carry an OPT record with DO set, for loadCache to tell
+// them apart.
+func (c *Cache) Snapshot() []*Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	var resps []*Message
+	for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*cacheEntry)
+		if !now.Before(entry.expires) {
+			continue
+		}
+		elapsed := uint32(now.Sub(entry.stored) / time.Second)
+		q := &Question{Name: entry.key.Name, Type: entry.key.Type, Class: entry.key.Class}
+		resp := entry.response(q, copyRecords(entry.answers, elapsed), copyRecords(entry.authority, elapsed))
+		if entry.key.DNSSECOK {
+			resp.Additional = append(resp.Additional, (&OPT{UDPSize: ednsUDPSize, DNSSECOK: true}).toAnswer())
+		}
+		resps = append(resps, resp)
+	}
+	return resps
+}
+
+// GetStale returns the response for q if it has expired, but no more than
+// staleFor ago, with every TTL set to staleTTL.
+func (c *Cache) GetStale(q *Question, dnssecOK bool) (*Message, bool) {
+	key := newCacheKey(q, dnssecOK)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := c.now()
+	if now.Before(entry.expires) || !now.Before(entry.expires.Add(c.staleFor)) {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	answers, authority := copyRecords(entry.answers, 0), copyRecords(entry.authority, 0)
+	for _, section := range [][]*Answer{answers, authority} {
+		for _, a := range section {
+			a.TTL = staleTTL
+		}
+	}
+	return entry.response(q, answers, authority), true
+}
+
+// Prefetch reports whether the response for q is due to be refreshed ahead
+// of time: it has been hit at least prefetchHits times and less than
+// 1/prefetchWindow of its TTL is left. Each entry is reported once.
+func (c *Cache) Prefetch(q *Question, dnssecOK bool) bool {
+	if c.prefetchHits == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[newCacheKey(q, dnssecOK)]
+	if !ok {
+		return false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.prefetched || entry.hits < c.prefetchHits {
+		return false
+	}
+	window := entry.expires.Sub(entry.stored) / prefetchWindow
+	if entry.expires.Sub(c.now()) >= window {
+		return false
+	}
+	entry.prefetched = true
+	return true
+}
+
+// scaleTTL returns ttl multiplied by factor, rounded, but no less than one
+// second unless ttl is zero.
+func scaleTTL(ttl uint32, factor float64) uint32 {
+	if ttl == 0 {
+		return 0
+	}
+	return max(1, uint32(math.Round(float64(ttl)*factor)))
+}
+
+// response builds the message for q that entry stands for.
+func (entry *cacheEntry) response(q *Question, answers, authority []*Answer) *Message {
+	return &Message{
+		Header:     &Header{QR: 1, ResponseCode: entry.rcode, AuthenticData: bit(entry.authenticated)},
+		Question:   []*Question{q},
+		Answer:     answers,
+		Authority:  authority,
+		Additional: []*Answer{},
+	}
+}
+
+// cacheTTL returns how long resp may be cached, or 0 if it must not be.
+func cacheTTL(resp *Message) uint32 {
+	if resp.Header.Truncation != 0 {
+		return 0
+	}
+	switch resp.Header.ResponseCode {
+	case RCodeNoError:
+		if len(resp.Answer) == 0 {
+			return 0
+		}
+		ttl := resp.Answer[0].TTL
+		for _, a := range resp.Answer {
+			ttl = min(ttl, a.TTL)
+		}
+		return ttl
+	case RCodeNXDomain:
+		ttl, _ := negativeTTL(resp)
+		return ttl
+	}
+	return 0
+}
+
+// negativeTTL returns how long the negative answer resp holds, or false if
+// it has no SOA to say. A negative answer is only cacheable with the zone's
+// SOA, and for no longer than both the SOA's TTL and its MINIMUM field.
+func negativeTTL(resp *Message) (uint32, bool) {
+	for _, a := range resp.Authority {
+		if a.Type != TypeSOA {
+			continue
+		}
+		// Relayed records have their names expanded, so the SOA can be
+		// decoded from its RData alone.
+		local := *a
+		local.RDataOffset = 0
+		soa, err := parseSOA(a.RData, &local)
+		if err != nil {
+			return 0, true
+		}
+		return min(a.TTL, soa.Minimum), true
+	}
+	return 0, false
+}
+
+// Put caches resp as the response for q, if it is cacheable. dnssecOK tells
+// whether it was fetched with DO set.
+func (c *Cache) Put(q *Question, resp *Message, dnssecOK bool) {
+	ttl := cacheTTL(resp)
+	if ttl == 0 {
+		return
+	}
+	entry := &cacheEntry{
+		key:           newCacheKey(q, dnssecOK),
+		rcode:         resp.Header.ResponseCode,
+		authenticated: resp.Header.ADBit(),
+		answers:       copyRecords(resp.Answer, 0),
+	}
+	if entry.rcode == RCodeNXDomain {
+		entry.authority = copyRecords(resp.Authority, 0)
+	}
+	if c.ttlJitter > 0 {
+		factor := 1 + c.ttlJitter/100*(2*c.jitter()-1)
+		ttl = clampTTL(scaleTTL(ttl, factor), c.minTTL, c.maxTTL)
+		for _, section := range [][]*Answer{entry.answers, entry.authority} {
+			for _, a := range section {
+				a.TTL = clampTTL(scaleTTL(a.TTL, factor), c.minTTL, c.maxTTL)
+			}
+		}
+	}
+
+	now := c.now()
+	entry.stored = now
+	entry.expires = now.Add(time.Duration(ttl) * time.Second)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		entry.hits = elem.Value.(*cacheEntry).hits
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
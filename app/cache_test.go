@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func cacheableResponse(ttls ...uint32) *Message {
+	msg := &Message{
+		Header:   &Header{QR: 1},
+		Question: []*Question{{Name: "example.com", Type: 1, Class: 1}},
+	}
+	for i, ttl := range ttls {
+		msg.Answer = append(msg.Answer, &Answer{
+			Name: "example.com", Type: 1, Class: 1, TTL: ttl, RDLength: 4, RData: []byte{192, 0, 2, byte(i + 1)},
+		})
+	}
+	return msg
+}
+
+func TestCacheHitDecrementsTTL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newCache(0)
+	c.now = func() time.Time { return now }
+
+	resp := cacheableResponse(300, 60)
+	c.Put(resp.Question[0], resp, false)
+
+	now = now.Add(20 * time.Second)
+	cached, ok := c.Get(&Question{Name: "EXAMPLE.com", Type: 1, Class: 1}, false)
+	if !ok {
+		t.Fatalf("expected a cache hit")
+	}
+	answers := cached.Answer
+	if answers[0].TTL != 280 || answers[1].TTL != 40 {
+		t.Fatalf("TTLs = %d, %d; want 280, 40", answers[0].TTL, answers[1].TTL)
+	}
+	// The cached copy is not affected by changes to what Get returned.
+	answers[0].TTL = 0
+	if again, _ := c.Get(resp.Question[0], false); again.Answer[0].TTL != 280 {
+		t.Fatalf("cached TTL changed to %d", again.Answer[0].TTL)
+	}
+
+	// The entry expires with the smallest TTL.
+	now = now.Add(40 * time.Second)
+	if _, ok := c.Get(resp.Question[0], false); ok {
+		t.Fatalf("expected the entry to have expired")
+	}
+}
+
+func TestCacheGetStale(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newCache(0)
+	c.staleFor = time.Hour
+	c.now = func() time.Time { return now }
+	resp := cacheableResponse(300, 60)
+	q := resp.Question[0]
+	c.Put(q, resp, false)
+
+	if _, ok := c.GetStale(q, false); ok {
+		t.Fatalf("fresh entry returned as stale")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.Get(q, false); ok {
+		t.Fatalf("expired entry returned as fresh")
+	}
+	stale, ok := c.GetStale(q, false)
+	if !ok {
+		t.Fatalf("expected a stale entry")
+	}
+	if len(stale.Answer) != 2 || stale.Answer[0].TTL != staleTTL || stale.Answer[1].TTL != staleTTL {
+		t.Fatalf("stale answers %v, want TTLs of %d", stale.Answer, staleTTL)
+	}
+
+	// Past the stale window the entry is gone for good.
+	now = now.Add(time.Hour)
+	if _, ok := c.GetStale(q, false); ok {
+		t.Fatalf("entry served after the stale window")
+	}
+	c.Get(q, false)
+	if n := c.Len(); n != 0 {
+		t.Fatalf("cache holds %d entries, want 0", n)
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newCache(0)
+	c.prefetchHits = 2
+	c.now = func() time.Time { return now }
+	resp := cacheableResponse(100)
+	q := resp.Question[0]
+	c.Put(q, resp, false)
+
+	c.Get(q, false)
+	now = now.Add(95 * time.Second)
+	if c.Prefetch(q, false) {
+		t.Fatalf("entry hit once is due for prefetching")
+	}
+	c.Get(q, false)
+	if !c.Prefetch(q, false) {
+		t.Fatalf("entry hit twice with 5%% of its TTL left is not due for prefetching")
+	}
+	if c.Prefetch(q, false) {
+		t.Fatalf("entry reported for prefetching twice")
+	}
+
+	// The fresh entry keeps the hit count but is only due again near its
+	// own expiry.
+	c.Put(q, resp, false)
+	if c.Prefetch(q, false) {
+		t.Fatalf("fresh entry is due for prefetching")
+	}
+	now = now.Add(91 * time.Second)
+	if !c.Prefetch(q, false) {
+		t.Fatalf("refreshed entry is not due for prefetching")
+	}
+}
+
+func TestCacheTTLJitter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newCache(0)
+	c.ttlJitter = 10
+	c.now = func() time.Time { return now }
+
+	// The extremes of the random numbers give the edges of the band.
+	for _, tt := range []struct {
+		random float64
+		want   uint32
+	}{{0, 900}, {0.5, 1000}, {0.99999, 1100}} {
+		c.jitter = func() float64 { return tt.random }
+		resp := cacheableResponse(1000)
+		c.Put(resp.Question[0], resp, false)
+		cached, _ := c.Get(resp.Question[0], false)
+		if got := cached.Answer[0].TTL; got != tt.want {
+			t.Errorf("jitter %v: cached TTL %d, want %d", tt.random, got, tt.want)
+		}
+		if resp.Answer[0].TTL != 1000 {
+			t.Errorf("jitter %v: the response put in the cache changed to TTL %d", tt.random, resp.Answer[0].TTL)
+		}
+	}
+
+	// With real random numbers, every TTL falls in the band, the entry
+	// expires with it, and they are not all the same.
+	c.jitter = newCache(0).jitter
+	seen := make(map[uint32]bool)
+	for i := 0; i < 200; i++ {
+		resp := cacheableResponse(1000, 2000)
+		c.Put(resp.Question[0], resp, false)
+		cached, _ := c.Get(resp.Question[0], false)
+		ttl := cached.Answer[0].TTL
+		if ttl < 900 || ttl > 1100 || cached.Answer[1].TTL < 1800 || cached.Answer[1].TTL > 2200 {
+			t.Fatalf("cached TTLs %d and %d, want within 10%% of 1000 and 2000", ttl, cached.Answer[1].TTL)
+		}
+		entry := c.entries[newCacheKey(resp.Question[0], false)].Value.(*cacheEntry)
+		if got := entry.expires.Sub(now); got != time.Duration(ttl)*time.Second {
+			t.Fatalf("entry with TTL %d expires in %v", ttl, got)
+		}
+		seen[ttl] = true
+	}
+	if len(seen) < 10 {
+		t.Errorf("only %d distinct TTLs in 200 puts", len(seen))
+	}
+}
+
+func TestCacheTTLJitterClamped(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newCache(0)
+	c.ttlJitter = 10
+	c.minTTL, c.maxTTL = 1000, 1050
+	c.now = func() time.Time { return now }
+
+	// Answers already at the bounds, as the server clamps them, are not
+	// jittered past them.
+	for _, random := range []float64{0, 0.99999} {
+		c.jitter = func() float64 { return random }
+		resp := cacheableResponse(1000, 1050)
+		c.Put(resp.Question[0], resp, false)
+		cached, _ := c.Get(resp.Question[0], false)
+		for _, a := range cached.Answer {
+			if a.TTL < 1000 || a.TTL > 1050 {
+				t.Errorf("jitter %v: cached TTL %d, want within 1000-1050", random, a.TTL)
+			}
+		}
+		entry := c.entries[newCacheKey(resp.Question[0], false)].Value.(*cacheEntry)
+		if got := entry.expires.Sub(now); got < 1000*time.Second {
+			t.Errorf("jitter %v: entry expires in %v, before the minimum TTL", random, got)
+		}
+	}
+}
+
+func TestCacheSkipsUncacheable(t *testing.T) {
+	c := newCache(0)
+	q := &Question{Name: "example.com", Type: 1, Class: 1}
+
+	servfail := cacheableResponse(300)
+	servfail.Header.ResponseCode = 2
+	truncated := cacheableResponse(300)
+	truncated.Header.Truncation = 1
+	for _, resp := range []*Message{servfail, truncated, cacheableResponse(), cacheableResponse(0)} {
+		c.Put(q, resp, false)
+		if _, ok := c.Get(q, false); ok {
+			t.Fatalf("cached uncacheable response %+v", resp.Header)
+		}
+	}
+
+	c.Put(q, cacheableResponse(300), false)
+	if _, ok := c.Get(&Question{Name: "example.com", Type: 28, Class: 1}, false); ok {
+		t.Fatalf("cache hit for a different type")
+	}
+}
+
+func TestCacheNXDOMAIN(t *testing.T) {
+	// nxdomainResponse with the SOA MINIMUM lowered to 300 seconds.
+	buf := append([]byte(nil), nxdomainResponse...)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], 300)
+	resp, err := parseResponse(buf)
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	c := newCache(0)
+	c.now = func() time.Time { return now }
+	q := resp.Question[0]
+	c.Put(q, resp, false)
+
+	now = now.Add(299 * time.Second)
+	cached, ok := c.Get(q, false)
+	if !ok {
+		t.Fatalf("expected a negative cache hit")
+	}
+	if cached.Header.ResponseCode != 3 || len(cached.Answer) != 0 {
+		t.Fatalf("cached response = rcode %d with %d answers, want NXDOMAIN", cached.Header.ResponseCode, len(cached.Answer))
+	}
+	if len(cached.Authority) != 1 || cached.Authority[0].Type != 6 || cached.Authority[0].TTL != 3600-299 {
+		t.Fatalf("unexpected authority section %+v", cached.Authority)
+	}
+
+	now = now.Add(time.Second)
+	if _, ok := c.Get(q, false); ok {
+		t.Fatalf("negative entry outlived the SOA minimum")
+	}
+
+	// Without an SOA there is nothing to bound the negative TTL by.
+	resp.Authority = nil
+	c.Put(q, resp, false)
+	if _, ok := c.Get(q, false); ok {
+		t.Fatalf("cached NXDOMAIN without an SOA")
+	}
+}
+
+// Authority records that expire before the SOA minimum are served with a
+// TTL of zero rather than wrapping around.
+func TestCacheTTLFloorsAtZero(t *testing.T) {
+	buf := append([]byte(nil), nxdomainResponse...)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], 300)
+	resp, err := parseResponse(buf)
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	short := *resp.Authority[0]
+	short.TTL = 10
+	resp.Authority = append(resp.Authority, &short)
+
+	now := time.Unix(1700000000, 0)
+	c := newCache(0)
+	c.now = func() time.Time { return now }
+	q := resp.Question[0]
+	c.Put(q, resp, false)
+	now = now.Add(20 * time.Second)
+	cached, ok := c.Get(q, false)
+	if !ok {
+		t.Fatalf("expected a negative cache hit")
+	}
+	if ttl := cached.Authority[1].TTL; ttl != 0 {
+		t.Fatalf("expired authority record has TTL %d, want 0", ttl)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newCache(3)
+	question := func(name string) *Question {
+		return &Question{Name: name, Type: 1, Class: 1}
+	}
+	for _, name := range []string{"a.example", "b.example", "c.example"} {
+		c.Put(question(name), cacheableResponse(300), false)
+	}
+	// Using a.example makes b.example the least recently used entry.
+	if _, ok := c.Get(question("a.example"), false); !ok {
+		t.Fatalf("expected a cache hit for a.example")
+	}
+	c.Put(question("d.example"), cacheableResponse(300), false)
+	c.Put(question("e.example"), cacheableResponse(300), false)
+
+	if n := c.Len(); n != 3 {
+		t.Fatalf("cache holds %d entries, want 3", n)
+	}
+	for _, name := range []string{"b.example", "c.example"} {
+		if _, ok := c.Get(question(name), false); ok {
+			t.Errorf("%s survived eviction", name)
+		}
+	}
+	for _, name := range []string{"a.example", "d.example", "e.example"} {
+		if _, ok := c.Get(question(name), false); !ok {
+			t.Errorf("%s was evicted", name)
+		}
+	}
+
+	// Replacing an entry does not count against the limit.
+	c.Put(question("a.example"), cacheableResponse(60), false)
+	if n := c.Len(); n != 3 {
+		t.Fatalf("cache holds %d entries after a replacement, want 3", n)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// saveCache writes the responses in c to the file at path, each framed as
+// over TCP, so that loadCache can put them back after a restart. The file
+// is replaced whole, so a crash while writing leaves the old one in place.
+func saveCache(path string, c *Cache) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeCache(tmp, c); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeCache(w io.Writer, c *Cache) error {
+	for _, resp := range c.Snapshot() {
+		msg, err := resp.ToBytes()
+		if err != nil {
+			return err
+		}
+		if err := writeTCPMessage(w, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCache puts the responses saved at path by saveCache into c and
+// returns how many there were. A missing file is an empty cache, as on the
+// first start.
+func loadCache(path string, c *Cache) (int, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	n := 0
+	for {
+		msg, err := readTCPMessage(file)
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		resp, err := parseResponse(msg)
+		if err != nil {
+			return n, fmt.Errorf("response %d: %w", n+1, err)
+		}
+		if len(resp.Question) != 1 {
+			return n, fmt.Errorf("response %d has %d questions", n+1, len(resp.Question))
+		}
+		opt, err := resp.OPT()
+		if err != nil {
+			return n, fmt.Errorf("response %d: %w", n+1, err)
+		}
+		c.Put(resp.Question[0], resp, opt != nil && opt.DNSSECOK)
+		n++
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheFileRoundTrip(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newCache(0)
+	c.now = func() time.Time { return now }
+	fresh := cacheableResponse(300)
+	c.Put(fresh.Question[0], fresh, false)
+	expiring := cacheableResponse(10)
+	expiring.Question[0].Name = "expiring.example"
+	expiring.Answer[0].Name = "expiring.example"
+	c.Put(expiring.Question[0], expiring, false)
+	now = now.Add(100 * time.Second)
+
+	path := filepath.Join(t.TempDir(), "cache")
+	if err := saveCache(path, c); err != nil {
+		t.Fatalf("saveCache: %v", err)
+	}
+	loaded := newCache(0)
+	n, err := loadCache(path, loaded)
+	if err != nil || n != 1 {
+		t.Fatalf("loadCache loaded %d responses, %v; want only the unexpired one", n, err)
+	}
+	resp, ok := loaded.Get(fresh.Question[0], false)
+	if !ok || len(resp.Answer) != 1 || resp.Answer[0].TTL != 200 {
+		t.Fatalf("loaded cache has %+v, %v; want the answer with 200s left", resp, ok)
+	}
+	if _, ok := loaded.Get(expiring.Question[0], false); ok {
+		t.Fatalf("expired response was saved")
+	}
+}
+
+func TestCacheFileKeepsDNSSECOK(t *testing.T) {
+	c := newCache(0)
+	resp := cacheableResponse(300)
+	c.Put(resp.Question[0], resp, true)
+	path := filepath.Join(t.TempDir(), "cache")
+	if err := saveCache(path, c); err != nil {
+		t.Fatalf("saveCache: %v", err)
+	}
+	loaded := newCache(0)
+	if _, err := loadCache(path, loaded); err != nil {
+		t.Fatalf("loadCache: %v", err)
+	}
+	if _, ok := loaded.Get(resp.Question[0], false); ok {
+		t.Errorf("answer fetched with DO loaded as one fetched without")
+	}
+	if _, ok := loaded.Get(resp.Question[0], true); !ok {
+		t.Errorf("answer fetched with DO not loaded")
+	}
+}
+
+func TestCacheFileMissing(t *testing.T) {
+	n, err := loadCache(filepath.Join(t.TempDir(), "cache"), newCache(0))
+	if n != 0 || err != nil {
+		t.Fatalf("loadCache of a missing file got %d, %v; want an empty cache", n, err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// errCaseMismatch is returned when an upstream reply does not repeat the
+// question name with exactly the case it was sent with. It wraps
+// errReplyMismatch.
+var errCaseMismatch = fmt.Errorf("%w: question name differs", errReplyMismatch)
+
+// randomizeCase flips the case of each ASCII letter in name at random. Name
+// servers echo the question back byte for byte, so an off-path attacker who
+// has to guess the pattern along with the ID has a much harder time forging
+// a reply. This is the "0x20 encoding" of draft-vixie-dnsext-dns0x20.
+func randomizeCase(name string) string {
+	bits := make([]byte, len(name))
+	if _, err := rand.Read(bits); err != nil {
+		panic(err)
+	}
+	b := []byte(name)
+	for i, c := range b {
+		if bits[i]&1 == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// checkCase verifies that resp answers the question in req with the name
+// spelled exactly as it was sent.
+func checkCase(req, resp *Message) error {
+	if len(resp.Question) != 1 || resp.Question[0].Name != req.Question[0].Name {
+		got := "<none>"
+		if len(resp.Question) > 0 {
+			got = resp.Question[0].Name
+		}
+		return fmt.Errorf("%w: sent %q, got %q", errCaseMismatch, req.Question[0].Name, got)
+	}
+	return nil
+}
+
+// restoreCase gives the question back the client's spelling of the name
+// once a randomized-case reply has been accepted, and so every record owned
+// by the question name and every name in RData, such as a CNAME target, that
+// is the question name.
+func restoreCase(resp *Message, question *Question) {
+	for _, section := range [][]*Answer{resp.Answer, resp.Authority, resp.Additional} {
+		for _, a := range section {
+			if strings.EqualFold(a.Name, question.Name) {
+				a.Name = question.Name
+			}
+			restoreRDataCase(a, question.Name)
+		}
+	}
+	resp.Question = []*Question{question}
+}
+
+// restoreRDataCase spells the names in the RData of a that are name as name
+// is. The RData is replaced rather than changed, since cached records share
+// it. Names are expected to be expanded, as in any relayed record, and RData
+// that does not parse is left alone.
+func restoreRDataCase(a *Answer, name string) {
+	prefix, names := rdataNames(a.Type)
+	if names == 0 || len(a.RData) < prefix {
+		return
+	}
+	local := *a
+	local.RDataOffset = 0
+	w := newNameWriter(false, len(a.RData))
+	w.buf = append(w.buf, a.RData[:prefix]...)
+	off, changed := prefix, false
+	for i := 0; i < names; i++ {
+		target, next, err := rdataName(a.RData, &local, off)
+		if err != nil {
+			return
+		}
+		if target != name && strings.EqualFold(target, name) {
+			target, changed = name, true
+		}
+		if err := w.writeName(target); err != nil {
+			return
+		}
+		off = next
+	}
+	if changed {
+		a.RData = append(w.buf, a.RData[off:]...)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	const name = "www-1.Example.COM"
+	changed := false
+	for i := 0; i < 20; i++ {
+		got := randomizeCase(name)
+		if !strings.EqualFold(got, name) || len(got) != len(name) {
+			t.Fatalf("randomizeCase(%q) = %q", name, got)
+		}
+		if got != name {
+			changed = true
+		}
+	}
+	if !changed {
+		t.Fatalf("randomizeCase never changed %q", name)
+	}
+	if got := randomizeCase("123.-_"); got != "123.-_" {
+		t.Fatalf("randomizeCase changed non-letters: %q", got)
+	}
+}
+
+func TestCheckCase(t *testing.T) {
+	req := &Message{Header: &Header{}, Question: []*Question{{Name: "eXaMpLe.CoM", Type: TypeA, Class: 1}}}
+	same := &Message{Header: &Header{}, Question: []*Question{{Name: "eXaMpLe.CoM", Type: TypeA, Class: 1}}}
+	if err := checkCase(req, same); err != nil {
+		t.Fatalf("checkCase rejected an exact echo: %v", err)
+	}
+	for _, resp := range []*Message{
+		{Header: &Header{}, Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}}},
+		{Header: &Header{}},
+	} {
+		if err := checkCase(req, resp); !errors.Is(err, errCaseMismatch) {
+			t.Errorf("got err %v, want %v", err, errCaseMismatch)
+		}
+	}
+}
+
+func TestMismatchedCaseIsRejected(t *testing.T) {
+	// An upstream (or forger) that does not echo the exact spelling.
+	swapCase := func(r rune) rune {
+		if lower := unicode.ToLower(r); lower != r {
+			return lower
+		}
+		return unicode.ToUpper(r)
+	}
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		resp.Question = []*Question{{Name: strings.Map(swapCase, req.Question[0].Name), Type: TypeA, Class: 1}}
+		return resp
+	})
+	s := newServer(testConfig(upstream))
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 1, "mixed.example.com", TypeA)))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Header.ResponseCode != RCodeServFail || len(resp.Answer) != 0 {
+		t.Fatalf("got rcode %s with %d answers, want SERVFAIL", resp.Header.ResponseCode, len(resp.Answer))
+	}
+}
+
+func TestRandomizedCaseIsRestored(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 1, "mixed.example.com", TypeA)))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Question[0].Name != "mixed.example.com" || resp.Answer[0].Name != "mixed.example.com" {
+		t.Fatalf("client saw %q / %q, want its own spelling", resp.Question[0].Name, resp.Answer[0].Name)
+	}
+	sent := upstream.seen()[0].Question[0].Name
+	if !strings.EqualFold(sent, "mixed.example.com") {
+		t.Fatalf("upstream was asked about %q", sent)
+	}
+}
+
+func TestRandomizedCaseIsRestoredInRData(t *testing.T) {
+	// Mail for the domain goes to the domain itself, and the upstream
+	// spells the exchange as the question was sent to it.
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		rdata := append([]byte{0, 10}, nameRData(t, req.Question[0].Name)...)
+		resp.Answer = []*Answer{{Name: req.Question[0].Name, Type: TypeMX, Class: 1, TTL: 60, RDLength: uint16(len(rdata)), RData: rdata}}
+		return resp
+	})
+	s := newServer(testConfig(upstream))
+
+	for i := uint16(1); i <= 2; i++ {
+		resp, err := parseResponse(s.answerRequest(context.Background(), clientAddr, newQuery(t, i, "mixed.example.com", TypeMX)))
+		if err != nil {
+			t.Fatalf("parseResponse: %v", err)
+		}
+		local := *resp.Answer[0]
+		local.RDataOffset = 0
+		mx, err := parseMX(local.RData, &local)
+		if err != nil {
+			t.Fatalf("parseMX: %v", err)
+		}
+		if mx.Exchange != "mixed.example.com" {
+			t.Fatalf("query %d: client saw exchange %q, want its own spelling", i, mx.Exchange)
+		}
+	}
+}
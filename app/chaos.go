@@ -0,0 +1,51 @@
+package main
+
+import "strings"
+
+// version is reported to CHAOS version.bind queries unless configured
+// otherwise. Release builds set it with -ldflags "-X main.version=...".
+var version = "dev"
+
+// classCH is the CHAOS class, which servers use to answer questions about
+// themselves.
+const classCH = 3
+
+// chaosAnswer answers a CHAOS class question locally. version.bind reports
+// the server version and id.server (or its older name hostname.bind) the
+// server identity, both as TXT, the latter only if one is configured. Any
+// other CHAOS question is refused: it is about this server, so forwarding it
+// would only describe the upstream.
+func (s *Server) chaosAnswer(header *Header, question *Question) *Message {
+	resp := &Message{
+		Header:   &Header{ID: header.ID, QR: 1, AuthorativeAnswer: 1},
+		Question: []*Question{question},
+	}
+	var text string
+	switch strings.ToLower(strings.TrimSuffix(question.Name, ".")) {
+	case "version.bind":
+		text = s.config.ChaosVersion
+	case "id.server", "hostname.bind":
+		if s.config.ChaosID == "" {
+			resp.Header.AuthorativeAnswer = 0
+			resp.Header.ResponseCode = RCodeRefused
+			return resp
+		}
+		text = s.config.ChaosID
+	default:
+		resp.Header.AuthorativeAnswer = 0
+		resp.Header.ResponseCode = RCodeRefused
+		return resp
+	}
+	if question.Type == TypeTXT || question.Type == TypeANY {
+		rdata := txtRData(text)
+		resp.Answer = []*Answer{{
+			Name:     question.Name,
+			Type:     TypeTXT,
+			Class:    classCH,
+			TTL:      s.config.LocalTTL,
+			RDLength: uint16(len(rdata)),
+			RData:    rdata,
+		}}
+	}
+	return resp
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func newChaosQuery(t *testing.T, id uint16, name string) []byte {
+	msg := &Message{
+		Header:   &Header{ID: id},
+		Question: []*Question{{Name: name, Type: TypeTXT, Class: classCH}},
+	}
+	return mustBytes(t, msg)
+}
+
+func TestChaosQueries(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	cfg := testConfig(upstream)
+	cfg.ChaosVersion = "1.2.3"
+	cfg.ChaosID = "ns1"
+	s := newServer(cfg)
+
+	tests := []struct {
+		name  string
+		rcode RCode
+		want  []string
+	}{
+		{"version.bind", RCodeNoError, []string{"1.2.3"}},
+		{"VERSION.BIND", RCodeNoError, []string{"1.2.3"}},
+		{"id.server", RCodeNoError, []string{"ns1"}},
+		{"hostname.bind", RCodeNoError, []string{"ns1"}},
+		{"authors.bind", RCodeRefused, nil},
+	}
+	for i, tt := range tests {
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newChaosQuery(t, uint16(i), tt.name)))
+		if err != nil {
+			t.Fatalf("%s: parseRequest: %v", tt.name, err)
+		}
+		if resp.Header.ResponseCode != tt.rcode {
+			t.Errorf("%s: rcode %v, want %v", tt.name, resp.Header.ResponseCode, tt.rcode)
+		}
+		var got []string
+		for _, a := range resp.Answer {
+			if a.Type != TypeTXT || a.Class != classCH {
+				t.Fatalf("%s: answer is %v %v, want CH TXT", tt.name, classString(a.Class), a.Type)
+			}
+			strs, err := parseTXT(a)
+			if err != nil {
+				t.Fatalf("%s: parseTXT: %v", tt.name, err)
+			}
+			got = append(got, strs...)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: answered %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if n := len(upstream.seen()); n != 0 {
+		t.Fatalf("CHAOS queries were forwarded %d times", n)
+	}
+}
+
+func TestChaosIDNotConfigured(t *testing.T) {
+	cfg, err := newConfig([]string{"8.8.8.8:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if cfg.ChaosID != "" {
+		t.Fatalf("default id.server answer is %q, want none", cfg.ChaosID)
+	}
+	s := newServer(testConfig(newMockUpstream(t, answerA)))
+	for _, name := range []string{"id.server", "hostname.bind"} {
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newChaosQuery(t, 1, name)))
+		if err != nil {
+			t.Fatalf("%s: parseRequest: %v", name, err)
+		}
+		if resp.Header.ResponseCode != RCodeRefused || len(resp.Answer) != 0 {
+			t.Errorf("%s: got %s with %d answers, want REFUSED", name, resp.Header.ResponseCode, len(resp.Answer))
+		}
+	}
+}
+
+func TestTXTRDataSplitsLongStrings(t *testing.T) {
+	long := string(make([]byte, 300))
+	rdata := txtRData(long)
+	strs, err := parseTXT(&Answer{Type: TypeTXT, RData: rdata})
+	if err != nil {
+		t.Fatalf("parseTXT: %v", err)
+	}
+	if len(strs) != 2 || len(strs[0]) != 255 || len(strs[1]) != 45 {
+		t.Fatalf("split into %d strings", len(strs))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// defaultQueryServer is the resolver asked by the query subcommand when no
+// @server argument is given.
+const defaultQueryServer = "8.8.8.8:53"
+
+const queryUsage = "usage: dns-server query <name> [type] [@server[:port]]\n       dns-server query -x <address> [@server[:port]]"
+
+// runQuery implements the query subcommand: it sends a single question to a
+// resolver and prints the reply the way dig would. args are the arguments
+// after "query".
+func runQuery(args []string, out io.Writer) error {
+	var name, server string
+	qtype := TypeA
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			server = arg[1:]
+		case arg == "-x":
+			// Reverse lookup, as with dig -x.
+			if i+1 == len(args) {
+				return errors.New(queryUsage)
+			}
+			i++
+			addr, err := netip.ParseAddr(args[i])
+			if err != nil {
+				return err
+			}
+			name, qtype = reverseName(addr), TypePTR
+		case name == "":
+			name = arg
+		default:
+			t, err := parseType(arg)
+			if err != nil {
+				return err
+			}
+			qtype = t
+		}
+	}
+	if name == "" {
+		return errors.New(queryUsage)
+	}
+	question, err := NewQuestion(name, qtype, 1)
+	if err != nil {
+		return err
+	}
+	if server == "" {
+		server = defaultQueryServer
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return fmt.Errorf("invalid server %q: %w", server, err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	req := &Message{
+		Header:   &Header{ID: randomID(), RecursionDesired: 1},
+		Question: []*Question{question},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	resp, err := exchange(ctx, req, conn)
+	if err != nil {
+		return err
+	}
+	if err := checkReply(req, resp); err != nil {
+		return err
+	}
+	fmt.Fprint(out, resp)
+	fmt.Fprintf(out, "\n;; SERVER: %s\n", addr)
+	return nil
+}
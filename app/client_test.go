@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestRunQuery(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	var out strings.Builder
+	if err := runQuery([]string{"example.com.", "a", "@" + upstream.addr().String()}, &out); err != nil {
+		t.Fatalf("runQuery: %v", err)
+	}
+	if !strings.Contains(out.String(), "example.com.\t60\tIN\tA\t192.0.2.1\n") {
+		t.Fatalf("answer missing from output:\n%s", out.String())
+	}
+	seen := upstream.seen()
+	if len(seen) != 1 || seen[0].Question[0].Type != TypeA || seen[0].Header.RecursionDesired != 1 {
+		t.Fatalf("unexpected query sent: %+v", seen)
+	}
+}
+
+func TestRunQueryRejectsMismatchedReply(t *testing.T) {
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		resp.Question[0].Type = TypeMX
+		return resp
+	})
+	err := runQuery([]string{"example.com", "a", "@" + upstream.addr().String()}, &strings.Builder{})
+	if !errors.Is(err, errReplyMismatch) {
+		t.Fatalf("runQuery got %v, want %v", err, errReplyMismatch)
+	}
+}
+
+func TestRunQueryBadArgs(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"example.com", "BOGUS"},
+		{"-x"},
+		{"-x", "not-an-address"},
+		{"example..com"},
+	} {
+		if err := runQuery(args, &strings.Builder{}); err == nil {
+			t.Errorf("runQuery(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestRunQueryReverse(t *testing.T) {
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		return &Message{Header: &Header{ID: req.Header.ID, QR: 1}, Question: req.Question}
+	})
+	if err := runQuery([]string{"-x", "192.0.2.1", "@" + upstream.addr().String()}, &strings.Builder{}); err != nil {
+		t.Fatalf("runQuery: %v", err)
+	}
+	seen := upstream.seen()
+	if len(seen) != 1 || seen[0].Question[0].Name != "1.2.0.192.in-addr.arpa" || seen[0].Question[0].Type != TypePTR {
+		t.Fatalf("unexpected query sent: %+v", seen[0].Question[0])
+	}
+}
+
+func TestRunQueryANY(t *testing.T) {
+	name := func(s string) []byte { return nameRData(t, s) }
+	soa := append(append(name("ns.example.com"), name("admin.example.com")...),
+		0, 0, 0, 1, 0, 0, 0x0e, 0x10, 0, 0, 0x03, 0x84, 0, 0x09, 0x3a, 0x80, 0, 0, 0x01, 0x2c)
+	records := []struct {
+		typ   Type
+		rdata []byte
+		want  string
+	}{
+		{TypeA, []byte{192, 0, 2, 1}, "A\t192.0.2.1"},
+		{TypeAAAA, netip.MustParseAddr("2001:db8::1").AsSlice(), "AAAA\t2001:db8::1"},
+		{TypeNS, name("ns.example.com"), "NS\tns.example.com."},
+		{TypeSOA, soa, "SOA\tns.example.com. admin.example.com. 1 3600 900 604800 300"},
+		{TypeMX, append([]byte{0, 10}, name("mail.example.com")...), "MX\t10 mail.example.com."},
+		{TypeTXT, txtRData("v=spf1 -all"), "TXT\t\"v=spf1 -all\""},
+		{TypeCNAME, name("example.net"), "CNAME\texample.net."},
+		{99, []byte{0xde, 0xad}, "TYPE99\t\\# 2 dead"},
+	}
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := &Message{Header: &Header{ID: req.Header.ID, QR: 1}, Question: req.Question}
+		for _, r := range records {
+			resp.Answer = append(resp.Answer, &Answer{
+				Name: "example.com", Type: r.typ, Class: 1, TTL: 300, RDLength: uint16(len(r.rdata)), RData: r.rdata,
+			})
+		}
+		return resp
+	})
+
+	var out strings.Builder
+	if err := runQuery([]string{"example.com", "ANY", "@" + upstream.addr().String()}, &out); err != nil {
+		t.Fatalf("runQuery: %v", err)
+	}
+	if seen := upstream.seen(); len(seen) != 1 || seen[0].Question[0].Type != TypeANY {
+		t.Fatalf("unexpected query sent: %+v", seen)
+	}
+	for _, r := range records {
+		if want := "example.com.\t300\tIN\t" + r.want + "\n"; !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RCode is the 4-bit response code carried in the header.
+type RCode byte
+
+const (
+	RCodeNoError  RCode = 0
+	RCodeFormErr  RCode = 1
+	RCodeServFail RCode = 2
+	RCodeNXDomain RCode = 3
+	RCodeNotImp   RCode = 4
+	RCodeRefused  RCode = 5
+)
+
+var rcodeNames = map[RCode]string{
+	RCodeNoError:  "NOERROR",
+	RCodeFormErr:  "FORMERR",
+	RCodeServFail: "SERVFAIL",
+	RCodeNXDomain: "NXDOMAIN",
+	RCodeNotImp:   "NOTIMP",
+	RCodeRefused:  "REFUSED",
+}
+
+func (r RCode) String() string {
+	if name, ok := rcodeNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", byte(r))
+}
+
+// OpCode is the 4-bit kind of query carried in the header.
+type OpCode byte
+
+const (
+	OpCodeQuery  OpCode = 0
+	OpCodeIQuery OpCode = 1
+	OpCodeStatus OpCode = 2
+	OpCodeNotify OpCode = 4
+	OpCodeUpdate OpCode = 5
+)
+
+var opcodeNames = map[OpCode]string{
+	OpCodeQuery:  "QUERY",
+	OpCodeIQuery: "IQUERY",
+	OpCodeStatus: "STATUS",
+	OpCodeNotify: "NOTIFY",
+	OpCodeUpdate: "UPDATE",
+}
+
+func (o OpCode) String() string {
+	if name, ok := opcodeNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("OPCODE%d", byte(o))
+}
+
+// Type is a resource record type, as used in both questions and records.
+type Type uint16
+
+const (
+	TypeA     Type = 1
+	TypeNS    Type = 2
+	TypeCNAME Type = 5
+	TypeSOA   Type = 6
+	TypePTR   Type = 12
+	TypeHINFO Type = 13
+	TypeMX    Type = 15
+	TypeTXT   Type = 16
+	TypeAAAA  Type = 28
+	TypeSRV   Type = 33
+	TypeNAPTR Type = 35
+	TypeDNAME Type = 39
+	TypeOPT   Type = 41
+	TypeANY   Type = 255
+	TypeCAA   Type = 257
+)
+
+var typeNames = map[Type]string{
+	TypeA:     "A",
+	TypeNS:    "NS",
+	TypeCNAME: "CNAME",
+	TypeSOA:   "SOA",
+	TypePTR:   "PTR",
+	TypeHINFO: "HINFO",
+	TypeMX:    "MX",
+	TypeTXT:   "TXT",
+	TypeAAAA:  "AAAA",
+	TypeSRV:   "SRV",
+	TypeNAPTR: "NAPTR",
+	TypeDNAME: "DNAME",
+	TypeOPT:   "OPT",
+	TypeANY:   "ANY",
+	TypeCAA:   "CAA",
+}
+
+// String returns the mnemonic for t, or the RFC 3597 form TYPE<n> for types
+// without one.
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
+// parseType is the inverse of Type.String. It accepts mnemonics in any case
+// as well as the TYPE<n> form.
+func parseType(s string) (Type, error) {
+	upper := strings.ToUpper(s)
+	for t, name := range typeNames {
+		if name == upper {
+			return t, nil
+		}
+	}
+	if n, ok := strings.CutPrefix(upper, "TYPE"); ok {
+		if v, err := strconv.ParseUint(n, 10, 16); err == nil {
+			return Type(v), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record type %q", s)
+}
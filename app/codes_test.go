@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestCodeStrings(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{RCodeNoError.String(), "NOERROR"},
+		{RCodeServFail.String(), "SERVFAIL"},
+		{RCodeNXDomain.String(), "NXDOMAIN"},
+		{RCode(11).String(), "RCODE11"},
+		{OpCodeQuery.String(), "QUERY"},
+		{OpCodeUpdate.String(), "UPDATE"},
+		{OpCode(3).String(), "OPCODE3"},
+		{TypeA.String(), "A"},
+		{TypeAAAA.String(), "AAAA"},
+		{TypeSRV.String(), "SRV"},
+		{Type(65).String(), "TYPE65"},
+		{Type(65280).String(), "TYPE65280"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Type
+	}{
+		{"A", TypeA},
+		{"mx", TypeMX},
+		{"Aaaa", TypeAAAA},
+		{"TYPE65", 65},
+	}
+	for _, tt := range tests {
+		got, err := parseType(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("parseType(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "BOGUS", "TYPE", "TYPE70000"} {
+		if _, err := parseType(in); err == nil {
+			t.Errorf("parseType(%q) succeeded, want error", in)
+		}
+	}
+}
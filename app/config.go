@@ -0,0 +1,577 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// UpstreamStrategy decides how a query is spread over the configured
+// upstreams.
+type UpstreamStrategy int
+
+const (
+	// Failover tries each upstream in turn until one answers.
+	Failover UpstreamStrategy = iota
+	// FanOut queries every upstream at once and takes the first answer.
+	FanOut
+)
+
+// ClientSubnetMode decides what happens to the EDNS Client Subnet option
+// (RFC 7871) clients send, which reveals their address to the upstreams.
+type ClientSubnetMode int
+
+const (
+	// StripClientSubnet keeps the client's subnet from the upstreams.
+	StripClientSubnet ClientSubnetMode = iota
+	// PassClientSubnet forwards the client's subnet so that upstreams such
+	// as CDNs can pick answers close to it. The answers may be meant for
+	// that subnet alone, so those queries bypass the cache. A malformed
+	// subnet gets FORMERR, and the upstream's reply to it, with its scope,
+	// is returned to the client.
+	PassClientSubnet
+)
+
+// Config holds everything the server needs to know at startup. It is built
+// once in main and shared read-only by every handler.
+type Config struct {
+	// ListenAddrs are where the server answers queries, each over both UDP
+	// and TCP. Serving IPv4 and IPv6 clients takes an address of each
+	// family, or the [::] wildcard on systems where it covers both.
+	ListenAddrs []*net.UDPAddr
+	// Upstreams are the resolvers queries are forwarded to. With iterative
+	// resolution it is a single iterativeUpstream.
+	Upstreams []Upstream
+	// CacheOnly answers from the cache and the local zone alone, and never
+	// contacts an upstream. Anything else gets SERVFAIL. The cache is
+	// filled from CacheFile, saved by an earlier run that had upstreams.
+	CacheOnly bool
+	// Strategy picks how the upstreams are used.
+	Strategy UpstreamStrategy
+	// ClientSubnet picks what happens to the subnets clients send, and
+	// AddSubnet, if not nil, is sent upstream in queries that do not pass
+	// on a subnet of the client's.
+	ClientSubnet ClientSubnetMode
+	AddSubnet    *net.IPNet
+	// Timeout is how long to wait for each upstream reply.
+	Timeout time.Duration
+	// ForceRD sets RD on every query sent upstream, for upstreams that only
+	// recurse when asked to, so that a client that left it clear does not
+	// get a referral. The client still sees its own RD in the response.
+	ForceRD bool
+	// Retries is how many more times a query is sent after the first
+	// attempt times out, before the client is answered with SERVFAIL.
+	Retries int
+	// RetryDelay is about how long to pause before the first retry. Each
+	// later pause is RetryMultiplier times longer, up to MaxRetryDelay, and
+	// each is jittered by up to half its length. A zero RetryDelay retries
+	// at once.
+	RetryDelay      time.Duration
+	RetryMultiplier float64
+	MaxRetryDelay   time.Duration
+	// Zone holds local records answered without forwarding. It may be nil.
+	Zone *Zone
+	// Blocklist holds domains answered with NXDOMAIN. It may be nil.
+	Blocklist *Blocklist
+	// NoAAAA answers AAAA queries with NODATA instead of forwarding them,
+	// for hosts without IPv6 that would only wait on the lookups. AAAA
+	// records in Zone are still answered.
+	NoAAAA bool
+	// DNS64Prefix, if not nil, is the NAT64 prefix AAAA records are
+	// synthesized under for names that only have A records (RFC 6147).
+	DNS64Prefix *net.IPNet
+	// QueryLog is the file a line per query answered is appended to, in
+	// QueryLogFormat. It is empty when queries are not logged.
+	QueryLog       string
+	QueryLogFormat QueryLogFormat
+	// PacketDump is the pcap file every UDP request and response is
+	// written to, for debugging. It is empty when nothing is dumped.
+	PacketDump string
+	// CacheFile is where the cache is saved on shutdown and loaded from
+	// on startup, which is how a cache-only server gets anything to
+	// answer with. It is empty when the cache starts empty.
+	CacheFile string
+	// LogLevel is the least severe level that is logged.
+	LogLevel slog.Level
+	// AllowedClients are the networks clients may query from. Every client
+	// is allowed when it is empty.
+	AllowedClients []*net.IPNet
+	// RateLimit is how many queries per second each client IP may send.
+	// Zero disables rate limiting.
+	RateLimit float64
+	// MaxUDPSize is the largest UDP response sent to a client, and the size
+	// advertised to clients in our OPT record. Clients that advertise less
+	// get no more than that, and those without EDNS 512 bytes. Zero means
+	// ednsUDPSize.
+	MaxUDPSize int
+	// CacheSize is how many responses the cache holds before evicting the
+	// least recently used. Zero leaves the cache unbounded.
+	CacheSize int
+	// ServeStale is how long after they expire cached answers are still
+	// given out, with a short TTL, when the upstreams fail (RFC 8767).
+	// Zero disables serving stale answers.
+	ServeStale time.Duration
+	// Prefetch is how many times a cached answer must have been used
+	// before it is refreshed ahead of expiry, once less than a tenth of
+	// its TTL is left. Zero disables prefetching.
+	Prefetch int
+	// TTLJitter is how far, as a percentage, the TTLs of each cached answer
+	// are randomly moved up or down, so that answers cached at the same
+	// time expire at different times. Clients given an answer straight
+	// from an upstream get its TTLs unchanged. Zero leaves TTLs exact.
+	TTLJitter float64
+	// RoundRobin rotates the order of the addresses of a name from one
+	// response to the next. It is off by default since some clients rely
+	// on the order the upstream gave.
+	RoundRobin bool
+	// RequireCookies answers UDP queries that lack a valid DNS cookie
+	// (RFC 7873) with BADCOOKIE or a truncated response instead of an
+	// answer, so that spoofed sources cannot use the server to reflect
+	// traffic. Clients that send a cookie always get one back.
+	RequireCookies bool
+	// MinTTL and MaxTTL bound the TTLs of relayed records, in seconds.
+	// A MaxTTL of zero leaves TTLs unbounded above.
+	MinTTL uint32
+	MaxTTL uint32
+	// LocalTTL is the TTL of the answers the server makes up itself: those
+	// from the zone that do not set their own, and those to CHAOS queries.
+	LocalTTL uint32
+	// ChaosVersion and ChaosID are the TXT answers to CHAOS class
+	// version.bind and id.server queries. An empty ChaosID has id.server
+	// refused, so the host name is only given out when configured.
+	ChaosVersion string
+	ChaosID      string
+	// MetricsAddr is where metrics are served over HTTP, at /metrics. The
+	// endpoint is disabled when it is empty.
+	MetricsAddr string
+	// HealthAddr is where the health check is served over HTTP, at
+	// /healthz, and HealthName the name it resolves through the upstreams.
+	// The endpoint is disabled when HealthAddr is empty. It may share an
+	// address with the metrics.
+	HealthAddr string
+	HealthName string
+}
+
+const (
+	defaultListenAddr    = "127.0.0.1:2053"
+	defaultTimeout       = 2 * time.Second
+	defaultRetries       = 2
+	defaultRetryDelay    = 100 * time.Millisecond
+	defaultMaxRetryDelay = 2 * time.Second
+	defaultCacheSize     = 10000
+)
+
+const usage = "usage: dns-server [flags] <upstream>...\n       dns-server -iterative [flags]\n       dns-server -cache-only [flags]\n       dns-server -config file [flags] [<upstream>...]\n       dns-server query <name> [type] [@server[:port]]\n       dns-server query -x <address> [@server[:port]]\n\nUpstreams are ip:port pairs reached over -transport, or URLs that name their\nown: udp://ip[:port], tcp://ip[:port], tls://ip[:port] or https://host/path.\nThey are left out with -iterative. Flags:"
+
+// allows reports whether the client at addr may query the server.
+func (c *Config) allows(addr net.Addr) bool {
+	if len(c.AllowedClients) == 0 {
+		return true
+	}
+	ip := clientIP(addr)
+	for _, network := range c.AllowedClients {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of a UDP or TCP client.
+func clientIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// settings are the configuration options in their raw, unvalidated form, as
+// read from a config file and the command line.
+type settings struct {
+	Listen            addrList `json:"listen"`
+	Upstreams         []string `json:"upstreams"`
+	Transport         string   `json:"transport"`
+	TLSName           string   `json:"tls_name"`
+	DoHGET            bool     `json:"doh_get"`
+	Iterative         bool     `json:"iterative"`
+	CacheOnly         bool     `json:"cache_only"`
+	QNAMEMinimization bool     `json:"qname_minimization"`
+	FanOut            bool     `json:"fanout"`
+	ECS               string   `json:"ecs"`
+	ECSSubnet         string   `json:"ecs_subnet"`
+	Timeout           duration `json:"timeout"`
+	ForceRD           bool     `json:"force_rd"`
+	Retries           int      `json:"retries"`
+	RetryDelay        duration `json:"retry_delay"`
+	RetryMultiplier   float64  `json:"retry_multiplier"`
+	MaxRetryDelay     duration `json:"max_retry_delay"`
+	Zone              string   `json:"zone"`
+	Blocklist         string   `json:"blocklist"`
+	NoAAAA            bool     `json:"no_aaaa"`
+	DNS64             string   `json:"dns64"`
+	Allow             []string `json:"allow"`
+	RateLimit         float64  `json:"rate_limit"`
+	MaxUDPSize        int      `json:"max_udp_size"`
+	CacheSize         int      `json:"cache_size"`
+	ServeStale        duration `json:"serve_stale"`
+	Prefetch          int      `json:"prefetch"`
+	TTLJitter         float64  `json:"ttl_jitter"`
+	RoundRobin        bool     `json:"round_robin"`
+	RequireCookies    bool     `json:"require_cookies"`
+	MinTTL            uint     `json:"min_ttl"`
+	LocalTTL          uint     `json:"local_ttl"`
+	MaxTTL            uint     `json:"max_ttl"`
+	Metrics           string   `json:"metrics"`
+	Health            string   `json:"health"`
+	HealthName        string   `json:"health_name"`
+	QueryLog          string   `json:"query_log"`
+	QueryLogFormat    string   `json:"query_log_format"`
+	PacketDump        string   `json:"packet_dump"`
+	CacheFile         string   `json:"cache_file"`
+	LogLevel          string   `json:"log_level"`
+	ChaosVersion      string   `json:"chaos_version"`
+	ChaosID           string   `json:"chaos_id"`
+
+	// configFile is only ever set from the command line.
+	configFile string
+}
+
+// duration is a time.Duration written in JSON as a string such as "1.5s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+// addrList is a list of addresses that can also be given in JSON as a single
+// string, as "listen" was before it took several.
+type addrList []string
+
+func (l *addrList) UnmarshalJSON(b []byte) error {
+	var addr string
+	if err := json.Unmarshal(b, &addr); err == nil {
+		*l = addrList{addr}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+func defaultSettings() *settings {
+	return &settings{
+		Listen:          addrList{defaultListenAddr},
+		Transport:       "udp",
+		ECS:             "strip",
+		Timeout:         duration(defaultTimeout),
+		Retries:         defaultRetries,
+		RetryDelay:      duration(defaultRetryDelay),
+		RetryMultiplier: 2,
+		MaxRetryDelay:   duration(defaultMaxRetryDelay),
+		MaxUDPSize:      ednsUDPSize,
+		CacheSize:       defaultCacheSize,
+		LocalTTL:        defaultLocalTTL,
+		HealthName:      defaultHealthName,
+		LogLevel:        "info",
+		QueryLogFormat:  "text",
+		ChaosVersion:    version,
+	}
+}
+
+// loadFile reads settings from the JSON file at path, on top of those already
+// in s. Unknown keys are rejected so that typos do not go unnoticed.
+func (s *settings) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		return fmt.Errorf("reading config %s: %w", path, err)
+	}
+	return nil
+}
+
+// flagSet returns the command line flags, each writing to its field of s.
+func (s *settings) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("dns-server", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&s.configFile, "config", "", "JSON file to read settings from; flags override it")
+	// The first -listen replaces the default or configured addresses and
+	// any more are added to it.
+	listenGiven := false
+	fs.Func("listen", "ip:port to answer queries on, over UDP and TCP; may be repeated (default: "+defaultListenAddr+")", func(addr string) error {
+		if !listenGiven {
+			s.Listen, listenGiven = nil, true
+		}
+		s.Listen = append(s.Listen, addr)
+		return nil
+	})
+	fs.BoolVar(&s.FanOut, "fanout", s.FanOut, "query every upstream at once and use the first answer")
+	fs.StringVar(&s.ECS, "ecs", s.ECS, "what to do with the EDNS client subnet clients send: strip, or pass it upstream")
+	fs.StringVar(&s.ECSSubnet, "ecs-subnet", s.ECSSubnet, "client subnet, as a CIDR, to send upstream with queries that carry none (default: none)")
+	fs.DurationVar((*time.Duration)(&s.Timeout), "timeout", time.Duration(s.Timeout), "how long to wait for each upstream reply")
+	fs.BoolVar(&s.ForceRD, "force-rd", s.ForceRD, "ask upstreams to recurse even when the client did not")
+	fs.IntVar(&s.Retries, "retries", s.Retries, "how many times to resend a query that timed out")
+	fs.DurationVar((*time.Duration)(&s.RetryDelay), "retry-delay", time.Duration(s.RetryDelay), "pause before the first retry, jittered")
+	fs.Float64Var(&s.RetryMultiplier, "retry-multiplier", s.RetryMultiplier, "how much longer each pause between retries is than the last")
+	fs.DurationVar((*time.Duration)(&s.MaxRetryDelay), "max-retry-delay", time.Duration(s.MaxRetryDelay), "longest pause between retries")
+	fs.StringVar(&s.Zone, "zone", s.Zone, "hosts-style file of names to answer locally")
+	fs.StringVar(&s.Blocklist, "blocklist", s.Blocklist, "file of domains to answer with NXDOMAIN")
+	fs.BoolVar(&s.NoAAAA, "no-aaaa", s.NoAAAA, "answer AAAA queries with no records instead of forwarding them, for IPv4-only hosts")
+	fs.StringVar(&s.DNS64, "dns64", s.DNS64, "NAT64 prefix, such as 64:ff9b::/96, to synthesize AAAA records from A records under (default: disabled)")
+	// Likewise, the first -allow replaces the configured networks.
+	allowGiven := false
+	fs.Func("allow", "network allowed to query, as a CIDR; may be repeated (default: any client)", func(cidr string) error {
+		if !allowGiven {
+			s.Allow, allowGiven = nil, true
+		}
+		s.Allow = append(s.Allow, cidr)
+		return nil
+	})
+	fs.IntVar(&s.MaxUDPSize, "max-udp-size", s.MaxUDPSize, "largest UDP response to send, and the size advertised to EDNS clients")
+	fs.IntVar(&s.CacheSize, "cache-size", s.CacheSize, "most responses to cache, 0 for no limit")
+	fs.DurationVar((*time.Duration)(&s.ServeStale), "serve-stale", time.Duration(s.ServeStale), "how long past expiry cached answers are served when the upstreams fail (default: never)")
+	fs.IntVar(&s.Prefetch, "prefetch", s.Prefetch, "refresh cached answers used this many times shortly before they expire (default: never)")
+	fs.Float64Var(&s.TTLJitter, "ttl-jitter", s.TTLJitter, "percentage by which to randomly raise or lower the TTLs of cached answers (default: none)")
+	fs.BoolVar(&s.RoundRobin, "round-robin", s.RoundRobin, "rotate the order of a name's addresses from one response to the next")
+	fs.BoolVar(&s.RequireCookies, "require-cookies", s.RequireCookies, "answer UDP queries without a valid DNS cookie with BADCOOKIE or truncation")
+	fs.Float64Var(&s.RateLimit, "rate-limit", s.RateLimit, "queries per second allowed from each client ip (default: unlimited)")
+	fs.UintVar(&s.LocalTTL, "local-ttl", s.LocalTTL, "TTL in seconds of zone records that set none, and of CHAOS answers")
+	fs.UintVar(&s.MinTTL, "min-ttl", s.MinTTL, "raise relayed TTLs below this many seconds to it")
+	fs.UintVar(&s.MaxTTL, "max-ttl", s.MaxTTL, "lower relayed TTLs above this many seconds to it (default: no limit)")
+	fs.StringVar(&s.Metrics, "metrics", s.Metrics, "address to serve Prometheus metrics on (default: disabled)")
+	fs.StringVar(&s.Health, "health", s.Health, "address to serve the /healthz upstream check on (default: disabled)")
+	fs.StringVar(&s.HealthName, "health-name", s.HealthName, "name the health check resolves through the upstreams")
+	fs.StringVar(&s.QueryLog, "query-log", s.QueryLog, "file to append a line per query to (default: none)")
+	fs.StringVar(&s.QueryLogFormat, "query-log-format", s.QueryLogFormat, "format of query log lines: text or json")
+	fs.StringVar(&s.PacketDump, "packet-dump", s.PacketDump, "pcap file to write every UDP request and response to (default: none)")
+	fs.StringVar(&s.CacheFile, "cache-file", s.CacheFile, "file the cache is saved to on shutdown and loaded from on startup (default: none)")
+	fs.StringVar(&s.LogLevel, "log-level", s.LogLevel, "least severe level to log: debug, info, warn or error")
+	fs.StringVar(&s.Transport, "transport", s.Transport, "how upstreams without a scheme are reached: udp, tcp, tls for DNS-over-TLS or https for DNS-over-HTTPS")
+	fs.BoolVar(&s.DoHGET, "doh-get", s.DoHGET, "send DNS-over-HTTPS queries as GET requests instead of POST")
+	fs.StringVar(&s.ChaosVersion, "chaos-version", s.ChaosVersion, "answer to CHAOS TXT version.bind queries")
+	fs.StringVar(&s.ChaosID, "chaos-id", s.ChaosID, "answer to CHAOS TXT id.server queries (default: refused)")
+	fs.BoolVar(&s.Iterative, "iterative", s.Iterative, "resolve queries from the root servers down instead of forwarding them to upstreams")
+	fs.BoolVar(&s.CacheOnly, "cache-only", s.CacheOnly, "answer only from the cache and the zone, never asking an upstream")
+	fs.BoolVar(&s.QNAMEMinimization, "qname-minimization", s.QNAMEMinimization, "with -iterative, tell each nameserver no more of the name than it needs")
+	fs.StringVar(&s.TLSName, "tls-name", s.TLSName, "name the upstream TLS certificates must be valid for (default: the upstream ip)")
+	return fs
+}
+
+// newConfig builds a Config from the command line arguments, not including
+// the program name. When a -config file is given its settings are read first
+// and the flags override them; upstreams given as arguments replace the
+// file's list.
+func newConfig(args []string) (*Config, error) {
+	s := defaultSettings()
+	fs := s.flagSet()
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if s.configFile != "" {
+		path := s.configFile
+		s = defaultSettings()
+		if err := s.loadFile(path); err != nil {
+			return nil, err
+		}
+		fs = s.flagSet()
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+	}
+	if fs.NArg() > 0 {
+		s.Upstreams = fs.Args()
+	}
+	return s.config()
+}
+
+// config validates s and builds the Config it describes.
+func (s *settings) config() (*Config, error) {
+	if s.CacheOnly && (len(s.Upstreams) > 0 || s.Iterative) {
+		return nil, errors.New("cache-only mode does not use upstream resolvers")
+	}
+	if len(s.Upstreams) < 1 && !s.Iterative && !s.CacheOnly {
+		return nil, errors.New("missing upstream resolver address")
+	}
+	if len(s.Upstreams) > 0 && s.Iterative {
+		return nil, errors.New("upstream resolvers cannot be used with iterative resolution")
+	}
+	if s.QNAMEMinimization && !s.Iterative {
+		return nil, errors.New("QNAME minimization needs iterative resolution")
+	}
+	if s.NoAAAA && s.DNS64 != "" {
+		return nil, errors.New("DNS64 cannot be used when AAAA queries are not answered")
+	}
+	cfg := &Config{
+		Strategy:        Failover,
+		CacheOnly:       s.CacheOnly,
+		Timeout:         time.Duration(s.Timeout),
+		ForceRD:         s.ForceRD,
+		Retries:         s.Retries,
+		RetryDelay:      time.Duration(s.RetryDelay),
+		RetryMultiplier: s.RetryMultiplier,
+		MaxRetryDelay:   time.Duration(s.MaxRetryDelay),
+		MetricsAddr:     s.Metrics,
+		HealthAddr:      s.Health,
+		HealthName:      strings.TrimSuffix(s.HealthName, "."),
+		RateLimit:       s.RateLimit,
+		MaxUDPSize:      s.MaxUDPSize,
+		CacheSize:       s.CacheSize,
+		ServeStale:      time.Duration(s.ServeStale),
+		Prefetch:        s.Prefetch,
+		TTLJitter:       s.TTLJitter,
+		RoundRobin:      s.RoundRobin,
+		NoAAAA:          s.NoAAAA,
+		RequireCookies:  s.RequireCookies,
+		ChaosVersion:    s.ChaosVersion,
+		ChaosID:         s.ChaosID,
+	}
+	if len(s.Listen) == 0 {
+		return nil, errors.New("no listen address")
+	}
+	for _, addr := range s.Listen {
+		listenAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		cfg.ListenAddrs = append(cfg.ListenAddrs, listenAddr)
+	}
+	if cfg.Timeout <= 0 {
+		return nil, errors.New("timeout must be positive")
+	}
+	if cfg.Retries < 0 {
+		return nil, errors.New("retries must not be negative")
+	}
+	if cfg.RetryDelay < 0 || cfg.MaxRetryDelay < 0 {
+		return nil, errors.New("retry delays must not be negative")
+	}
+	if cfg.RetryMultiplier < 1 {
+		return nil, errors.New("retry multiplier must be at least 1")
+	}
+	if cfg.RateLimit < 0 {
+		return nil, errors.New("rate limit must not be negative")
+	}
+	if err := validateName(cfg.HealthName); err != nil || cfg.HealthName == "" {
+		return nil, fmt.Errorf("invalid health check name %q", s.HealthName)
+	}
+	if cfg.MaxUDPSize < minUDPSize || cfg.MaxUDPSize > ednsUDPSize {
+		return nil, fmt.Errorf("maximum UDP response size must be between %d and %d bytes", minUDPSize, ednsUDPSize)
+	}
+	if cfg.CacheSize < 0 {
+		return nil, errors.New("cache size must not be negative")
+	}
+	if cfg.ServeStale < 0 {
+		return nil, errors.New("serve-stale duration must not be negative")
+	}
+	if cfg.TTLJitter < 0 || cfg.TTLJitter >= 100 {
+		return nil, errors.New("TTL jitter must be at least 0 and below 100 percent")
+	}
+	if cfg.Prefetch < 0 {
+		return nil, errors.New("prefetch hit count must not be negative")
+	}
+	if s.MinTTL > math.MaxUint32 || s.MaxTTL > math.MaxUint32 {
+		return nil, errors.New("TTL bounds must fit in 32 bits")
+	}
+	if s.MaxTTL != 0 && s.MinTTL > s.MaxTTL {
+		return nil, fmt.Errorf("minimum TTL %d is above maximum TTL %d", s.MinTTL, s.MaxTTL)
+	}
+	cfg.MinTTL, cfg.MaxTTL = uint32(s.MinTTL), uint32(s.MaxTTL)
+	if s.LocalTTL > math.MaxUint32 {
+		return nil, errors.New("local TTL must fit in 32 bits")
+	}
+	cfg.LocalTTL = uint32(s.LocalTTL)
+	if err := cfg.LogLevel.UnmarshalText([]byte(s.LogLevel)); err != nil {
+		return nil, err
+	}
+	for _, cidr := range s.Allow {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.AllowedClients = append(cfg.AllowedClients, network)
+	}
+	switch s.Transport {
+	case "udp", "tcp", "tls", "https":
+	default:
+		return nil, fmt.Errorf("unknown upstream transport %q", s.Transport)
+	}
+	if s.FanOut {
+		cfg.Strategy = FanOut
+	}
+	switch s.ECS {
+	case "strip":
+		cfg.ClientSubnet = StripClientSubnet
+	case "pass":
+		cfg.ClientSubnet = PassClientSubnet
+	default:
+		return nil, fmt.Errorf("unknown client subnet mode %q", s.ECS)
+	}
+	switch s.QueryLogFormat {
+	case "text":
+		cfg.QueryLogFormat = TextQueryLog
+	case "json":
+		cfg.QueryLogFormat = JSONQueryLog
+	default:
+		return nil, fmt.Errorf("unknown query log format %q", s.QueryLogFormat)
+	}
+	cfg.QueryLog = s.QueryLog
+	cfg.PacketDump = s.PacketDump
+	cfg.CacheFile = s.CacheFile
+	if s.ECSSubnet != "" {
+		_, network, err := net.ParseCIDR(s.ECSSubnet)
+		if err != nil {
+			return nil, err
+		}
+		cfg.AddSubnet = network
+	}
+	if s.DNS64 != "" {
+		prefix, err := parseDNS64Prefix(s.DNS64)
+		if err != nil {
+			return nil, err
+		}
+		cfg.DNS64Prefix = prefix
+	}
+	if s.Zone != "" {
+		zone, err := loadZone(s.Zone, cfg.LocalTTL)
+		if err != nil {
+			return nil, fmt.Errorf("loading zone %s: %w", s.Zone, err)
+		}
+		cfg.Zone = zone
+	}
+	if s.Blocklist != "" {
+		blocklist, err := loadBlocklist(s.Blocklist)
+		if err != nil {
+			return nil, fmt.Errorf("loading blocklist %s: %w", s.Blocklist, err)
+		}
+		cfg.Blocklist = blocklist
+	}
+	if s.Iterative {
+		cfg.Upstreams = []Upstream{newIterativeUpstream(s.QNAMEMinimization)}
+	}
+	for _, arg := range s.Upstreams {
+		spec, err := parseUpstreamSpec(arg, s.Transport)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Upstreams = append(cfg.Upstreams, spec.upstream(s.TLSName, s.DoHGET))
+	}
+	return cfg, nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewConfig(t *testing.T) {
+	cfg, err := newConfig([]string{"8.8.8.8:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if len(cfg.Upstreams) != 1 || cfg.Upstreams[0].String() != "8.8.8.8:53" {
+		t.Fatalf("upstreams = %v, want [8.8.8.8:53]", cfg.Upstreams)
+	}
+	if cfg.Strategy != Failover {
+		t.Fatalf("strategy = %v, want failover", cfg.Strategy)
+	}
+
+	cfg, err = newConfig([]string{"-fanout", "1.1.1.1:53", "[2001:4860:4860::8888]:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if cfg.Strategy != FanOut {
+		t.Fatalf("strategy = %v, want fan-out", cfg.Strategy)
+	}
+	if len(cfg.Upstreams) != 2 || cfg.Upstreams[1].String() != "[2001:4860:4860::8888]:53" {
+		t.Fatalf("upstreams = %v", cfg.Upstreams)
+	}
+}
+
+func TestNewConfigInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"8.8.8.8"},
+		{"8.8.8.8:notaport"},
+		{":53"},
+		{"-nosuchflag", "8.8.8.8:53"},
+		{"-log-level", "loud", "8.8.8.8:53"},
+		{"-transport", "carrier-pigeon", "8.8.8.8:53"},
+		{"-transport", "https", "http://dns.example/dns-query"},
+		{"-transport", "https", "8.8.8.8:53"},
+		{"-allow", "10.0.0.0", "8.8.8.8:53"},
+		{"-listen", "nonsense", "8.8.8.8:53"},
+		{"-min-ttl", "600", "-max-ttl", "60", "8.8.8.8:53"},
+		{"-max-ttl", "5000000000", "8.8.8.8:53"},
+		{"-serve-stale", "-1h", "8.8.8.8:53"},
+		{"-prefetch", "-1", "8.8.8.8:53"},
+		{"-ttl-jitter", "-5", "8.8.8.8:53"},
+		{"-ttl-jitter", "100", "8.8.8.8:53"},
+		{"-ecs", "forward", "8.8.8.8:53"},
+		{"-query-log-format", "csv", "8.8.8.8:53"},
+		{"-max-udp-size", "511", "8.8.8.8:53"},
+		{"-retry-delay", "-1s", "8.8.8.8:53"},
+		{"-retry-multiplier", "0.5", "8.8.8.8:53"},
+		{"-max-udp-size", "65535", "8.8.8.8:53"},
+		{"-ecs-subnet", "192.0.2.1", "8.8.8.8:53"},
+		{"-dns64", "64:ff9b::/80", "8.8.8.8:53"},
+		{"-no-aaaa", "-dns64", "64:ff9b::/96", "8.8.8.8:53"},
+	} {
+		if _, err := newConfig(args); err == nil {
+			t.Errorf("newConfig(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestNewConfigDNS64(t *testing.T) {
+	cfg, err := newConfig([]string{"-dns64", "64:ff9b::/96", "8.8.8.8:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if cfg.DNS64Prefix == nil || cfg.DNS64Prefix.String() != "64:ff9b::/96" {
+		t.Fatalf("DNS64 prefix %v", cfg.DNS64Prefix)
+	}
+}
+
+func TestNewConfigLogLevel(t *testing.T) {
+	cfg, err := newConfig([]string{"8.8.8.8:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if cfg.LogLevel != slog.LevelInfo {
+		t.Fatalf("default log level = %v, want INFO", cfg.LogLevel)
+	}
+	cfg, err = newConfig([]string{"-log-level", "debug", "8.8.8.8:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if cfg.LogLevel != slog.LevelDebug {
+		t.Fatalf("log level = %v, want DEBUG", cfg.LogLevel)
+	}
+}
+
+func TestNewConfigTransports(t *testing.T) {
+	cfg, err := newConfig([]string{"-transport", "tls", "1.1.1.1:853"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if dot, ok := cfg.Upstreams[0].(*tlsUpstream); !ok || dot.config.ServerName != "1.1.1.1" {
+		t.Fatalf("upstream = %#v, want DoT verified against 1.1.1.1", cfg.Upstreams[0])
+	}
+
+	cfg, err = newConfig([]string{"-transport", "https", "-doh-get", "https://dns.example/dns-query"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if doh, ok := cfg.Upstreams[0].(*httpsUpstream); !ok || !doh.useGET || doh.endpoint != "https://dns.example/dns-query" {
+		t.Fatalf("upstream = %#v, want DoH over GET", cfg.Upstreams[0])
+	}
+
+	// Each upstream can name its own transport, for failover between them.
+	cfg, err = newConfig([]string{"-transport", "tls", "1.1.1.1:853", "udp://8.8.8.8", "tcp://9.9.9.9", "https://dns.example/dns-query"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	var got []string
+	for _, u := range cfg.Upstreams {
+		got = append(got, u.String())
+	}
+	if want := []string{"tls://1.1.1.1:853", "8.8.8.8:53", "tcp://9.9.9.9:53", "https://dns.example/dns-query"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("upstreams = %q, want %q", got, want)
+	}
+
+	cfg, err = newConfig([]string{"-iterative"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if _, ok := cfg.Upstreams[0].(*iterativeUpstream); !ok || len(cfg.Upstreams) != 1 {
+		t.Fatalf("upstreams = %v, want iterative resolution", cfg.Upstreams)
+	}
+	if _, err := newConfig([]string{"-iterative", "8.8.8.8:53"}); err == nil {
+		t.Fatal("accepted upstreams alongside -iterative")
+	}
+
+	cfg, err = newConfig([]string{"-iterative", "-qname-minimization"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if u, ok := cfg.Upstreams[0].(*iterativeUpstream); !ok || !u.minimize {
+		t.Fatalf("upstreams = %v, want minimizing iterative resolution", cfg.Upstreams)
+	}
+	if _, err := newConfig([]string{"-qname-minimization", "8.8.8.8:53"}); err == nil {
+		t.Fatal("accepted -qname-minimization without -iterative")
+	}
+
+	cfg, err = newConfig([]string{"-cache-only"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if !cfg.CacheOnly || len(cfg.Upstreams) != 0 {
+		t.Fatalf("cache-only %v with upstreams %v", cfg.CacheOnly, cfg.Upstreams)
+	}
+	for _, args := range [][]string{{"-cache-only", "8.8.8.8:53"}, {"-cache-only", "-iterative"}} {
+		if _, err := newConfig(args); err == nil {
+			t.Fatalf("newConfig(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestConfigAllows(t *testing.T) {
+	cfg, err := newConfig([]string{"8.8.8.8:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if !cfg.allows(&net.UDPAddr{IP: net.ParseIP("203.0.113.9")}) {
+		t.Fatal("default config refused a client")
+	}
+
+	cfg, err = newConfig([]string{"-allow", "10.0.0.0/8", "-allow", "2001:db8::/32", "8.8.8.8:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5353}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}, true},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db9::1"), Port: 5353}, false},
+	}
+	for _, tt := range tests {
+		if got := cfg.allows(tt.addr); got != tt.want {
+			t.Errorf("allows(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	// -allow replaces the networks of a config file.
+	path := writeConfig(t, `{"upstreams": ["8.8.8.8:53"], "allow": ["192.0.2.0/24"]}`)
+	cfg, err = newConfig([]string{"-config", path, "-allow", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if len(cfg.AllowedClients) != 1 || cfg.AllowedClients[0].String() != "10.0.0.0/8" {
+		t.Fatalf("allowed clients = %v, want -allow to override the file", cfg.AllowedClients)
+	}
+}
+
+const sampleConfig = `{
+	"upstreams": ["1.1.1.1:853", "8.8.8.8:853"],
+	"transport": "tls",
+	"tls_name": "dns.example",
+	"fanout": true,
+	"timeout": "1500ms",
+	"retries": 4,
+	"force_rd": true,
+	"no_aaaa": true,
+	"retry_delay": "50ms",
+	"retry_multiplier": 1.5,
+	"max_retry_delay": "1s",
+	"allow": ["192.0.2.0/24"],
+	"rate_limit": 20,
+	"cache_size": 500,
+	"max_udp_size": 1232,
+	"serve_stale": "24h",
+	"prefetch": 3,
+	"ttl_jitter": 10,
+	"round_robin": true,
+	"require_cookies": true,
+	"ecs": "pass",
+	"ecs_subnet": "192.0.2.0/24",
+	"min_ttl": 30,
+	"max_ttl": 86400,
+	"metrics": "127.0.0.1:9153",
+	"query_log": "/var/log/dns-queries.log",
+	"query_log_format": "json",
+	"packet_dump": "/tmp/dns.pcap",
+	"cache_file": "/var/cache/dns-server.cache",
+	"log_level": "warn"
+}`
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	return path
+}
+
+func TestNewConfigFromFile(t *testing.T) {
+	cfg, err := newConfig([]string{"-config", writeConfig(t, sampleConfig)})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if len(cfg.Upstreams) != 2 {
+		t.Fatalf("got %d upstreams, want 2", len(cfg.Upstreams))
+	}
+	if dot, ok := cfg.Upstreams[1].(*tlsUpstream); !ok || dot.addr != "8.8.8.8:853" || dot.config.ServerName != "dns.example" {
+		t.Fatalf("upstream = %#v, want DoT to 8.8.8.8:853 as dns.example", cfg.Upstreams[1])
+	}
+	if cfg.Strategy != FanOut || cfg.Timeout != 1500*time.Millisecond || cfg.Retries != 4 {
+		t.Fatalf("strategy %v timeout %v retries %d", cfg.Strategy, cfg.Timeout, cfg.Retries)
+	}
+	if len(cfg.AllowedClients) != 1 || cfg.AllowedClients[0].String() != "192.0.2.0/24" {
+		t.Fatalf("allowed clients = %v", cfg.AllowedClients)
+	}
+	if cfg.RateLimit != 20 || cfg.CacheSize != 500 || cfg.MinTTL != 30 || cfg.MaxTTL != 86400 {
+		t.Fatalf("rate limit %v, cache size %d, TTL bounds %d-%d", cfg.RateLimit, cfg.CacheSize, cfg.MinTTL, cfg.MaxTTL)
+	}
+	if cfg.TTLJitter != 10 {
+		t.Fatalf("TTL jitter %v, want 10", cfg.TTLJitter)
+	}
+	if !cfg.ForceRD {
+		t.Fatal("force_rd was not set")
+	}
+	if !cfg.NoAAAA {
+		t.Fatal("no_aaaa was not set")
+	}
+	if cfg.RetryDelay != 50*time.Millisecond || cfg.RetryMultiplier != 1.5 || cfg.MaxRetryDelay != time.Second {
+		t.Fatalf("retry delay %v, multiplier %v, max %v", cfg.RetryDelay, cfg.RetryMultiplier, cfg.MaxRetryDelay)
+	}
+	if cfg.MaxUDPSize != 1232 {
+		t.Fatalf("max UDP size %d, want 1232", cfg.MaxUDPSize)
+	}
+	if cfg.QueryLog != "/var/log/dns-queries.log" || cfg.QueryLogFormat != JSONQueryLog {
+		t.Fatalf("query log %q in format %d", cfg.QueryLog, cfg.QueryLogFormat)
+	}
+	if cfg.PacketDump != "/tmp/dns.pcap" || cfg.CacheFile != "/var/cache/dns-server.cache" {
+		t.Fatalf("packet dump %q, cache file %q", cfg.PacketDump, cfg.CacheFile)
+	}
+	if cfg.ClientSubnet != PassClientSubnet || cfg.AddSubnet.String() != "192.0.2.0/24" {
+		t.Fatalf("client subnet mode %v, added subnet %v", cfg.ClientSubnet, cfg.AddSubnet)
+	}
+	if cfg.ServeStale != 24*time.Hour || cfg.Prefetch != 3 || !cfg.RoundRobin || !cfg.RequireCookies {
+		t.Fatalf("serve-stale %v, prefetch %d, round robin %v, require cookies %v", cfg.ServeStale, cfg.Prefetch, cfg.RoundRobin, cfg.RequireCookies)
+	}
+	if cfg.MetricsAddr != "127.0.0.1:9153" || cfg.LogLevel != slog.LevelWarn {
+		t.Fatalf("metrics %q, log level %v", cfg.MetricsAddr, cfg.LogLevel)
+	}
+}
+
+func TestFlagsOverrideConfigFile(t *testing.T) {
+	path := writeConfig(t, sampleConfig)
+	cfg, err := newConfig([]string{"-retries", "0", "-config", path, "-transport", "udp", "9.9.9.9:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if cfg.Retries != 0 || cfg.Timeout != 1500*time.Millisecond {
+		t.Fatalf("retries %d timeout %v, want the flag's 0 and the file's 1.5s", cfg.Retries, cfg.Timeout)
+	}
+	if len(cfg.Upstreams) != 1 || cfg.Upstreams[0].String() != "9.9.9.9:53" {
+		t.Fatalf("upstreams = %v, want only 9.9.9.9:53 over UDP", cfg.Upstreams)
+	}
+}
+
+func TestNewConfigBadFile(t *testing.T) {
+	for _, contents := range []string{
+		`{"upstreams": ["8.8.8.8:53"], "upstream": "typo"}`,
+		`{"upstreams": ["8.8.8.8:53"], "timeout": "soon"}`,
+		`{"upstreams": ["8.8.8.8:53"], "timeout": "-1s"}`,
+		`{"upstreams": []}`,
+		`not json`,
+	} {
+		if _, err := newConfig([]string{"-config", writeConfig(t, contents)}); err == nil {
+			t.Errorf("config %s accepted, want error", contents)
+		}
+	}
+	if _, err := newConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("missing config file accepted")
+	}
+}
+
+func TestNewConfigListen(t *testing.T) {
+	cfg, err := newConfig([]string{"8.8.8.8:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if len(cfg.ListenAddrs) != 1 || cfg.ListenAddrs[0].String() != defaultListenAddr {
+		t.Fatalf("listen addresses = %v, want %s", cfg.ListenAddrs, defaultListenAddr)
+	}
+	cfg, err = newConfig([]string{"-listen", "0.0.0.0:53", "-listen", "[::]:53", "8.8.8.8:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	if len(cfg.ListenAddrs) != 2 || cfg.ListenAddrs[0].String() != "0.0.0.0:53" || cfg.ListenAddrs[1].String() != "[::]:53" {
+		t.Fatalf("listen addresses = %v, want 0.0.0.0:53 and [::]:53", cfg.ListenAddrs)
+	}
+
+	// A config file may give a single address or a list of them, and
+	// -listen replaces either.
+	for _, listen := range []string{`"127.0.0.2:5353"`, `["127.0.0.2:5353", "[::1]:5353"]`} {
+		path := writeConfig(t, `{"upstreams": ["8.8.8.8:53"], "listen": `+listen+`}`)
+		cfg, err = newConfig([]string{"-config", path})
+		if err != nil {
+			t.Fatalf("newConfig with listen %s: %v", listen, err)
+		}
+		if cfg.ListenAddrs[0].String() != "127.0.0.2:5353" {
+			t.Fatalf("listen addresses = %v from %s", cfg.ListenAddrs, listen)
+		}
+		cfg, err = newConfig([]string{"-config", path, "-listen", "0.0.0.0:53"})
+		if err != nil {
+			t.Fatalf("newConfig: %v", err)
+		}
+		if len(cfg.ListenAddrs) != 1 || cfg.ListenAddrs[0].String() != "0.0.0.0:53" {
+			t.Fatalf("listen addresses = %v, want -listen to override %s", cfg.ListenAddrs, listen)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"sync"
+)
+
+// optionCookie is the EDNS option code of DNS Cookies (RFC 7873). The option
+// holds an 8 byte client cookie, followed once the server has given one by a
+// server cookie of 8 to 32 bytes.
+const optionCookie = 10
+
+const (
+	clientCookieLen    = 8
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+)
+
+// rcodeBadCookie is the extended rcode a server answers with when it wants a
+// query retried with the server cookie it sends.
+const rcodeBadCookie = 23
+
+var (
+	errBadCookie      = errors.New("reply does not echo our client cookie")
+	errCookieNotTaken = errors.New("upstream answered BADCOOKIE to its own server cookie")
+)
+
+// splitCookie returns the client and server cookies in a cookie option. ok
+// is false if the option is malformed; server is empty if it has no server
+// cookie.
+func splitCookie(option *EDNSOption) (client, server []byte, ok bool) {
+	data := option.Data
+	if len(data) != clientCookieLen && (len(data) < clientCookieLen+minServerCookieLen || len(data) > clientCookieLen+maxServerCookieLen) {
+		return nil, nil, false
+	}
+	return data[:clientCookieLen], data[clientCookieLen:], true
+}
+
+// upstreamCookies is the cookie state kept for one upstream: the client
+// cookie we present to it, chosen at random, and the server cookie it last
+// gave us. A spoofed reply cannot echo a client cookie it never saw. The
+// zero value is ready to use.
+type upstreamCookies struct {
+	once   sync.Once
+	client [clientCookieLen]byte
+
+	mu     sync.Mutex
+	server []byte
+}
+
+// attach returns a copy of req with our cookie added to its OPT record, or
+// req itself if it does not use EDNS.
+func (c *upstreamCookies) attach(req *Message) *Message {
+	opt, err := req.OPT()
+	if opt == nil || err != nil {
+		return req
+	}
+	c.once.Do(func() {
+		if _, err := rand.Read(c.client[:]); err != nil {
+			panic(err)
+		}
+	})
+	c.mu.Lock()
+	cookie := append(append([]byte(nil), c.client[:]...), c.server...)
+	c.mu.Unlock()
+	opt.Options = append(opt.Options, EDNSOption{Code: optionCookie, Data: cookie})
+
+	withCookie := *req
+	withCookie.Additional = append(withoutOPT(req.Additional), opt.toAnswer())
+	return &withCookie
+}
+
+// check rejects a reply that carries a cookie other than ours, and remembers
+// the server cookie of one that carries ours. Replies without a cookie are
+// accepted, since most servers do not support cookies yet.
+func (c *upstreamCookies) check(resp *Message) error {
+	opt, err := resp.OPT()
+	if err != nil {
+		return err
+	}
+	option := opt.option(optionCookie)
+	if option == nil {
+		return nil
+	}
+	client, server, ok := splitCookie(option)
+	if !ok || !bytes.Equal(client, c.client[:]) {
+		return errBadCookie
+	}
+	if len(server) > 0 {
+		c.mu.Lock()
+		c.server = append([]byte(nil), server...)
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// badCookie reports whether resp is a BADCOOKIE reply, which needs the
+// extended rcode in its OPT record to tell apart from YXDOMAIN.
+func badCookie(resp *Message) bool {
+	opt, err := resp.OPT()
+	if opt == nil || err != nil {
+		return false
+	}
+	return int(opt.ExtendedRCode)<<4|int(resp.Header.ResponseCode) == rcodeBadCookie
+}
+
+// malformedCookie reports whether the OPT record opt carries a cookie option
+// of a length no cookie can have, which is answered with FORMERR (RFC 7873
+// section 5.2.2).
+func malformedCookie(opt *OPT) bool {
+	sent := opt.option(optionCookie)
+	if sent == nil {
+		return false
+	}
+	_, _, ok := splitCookie(sent)
+	return !ok
+}
+
+// newCookieSecret returns the random key server cookies are made with.
+func newCookieSecret() []byte {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// serverCookie returns the server cookie for a client at ip presenting client
+// as its client cookie: a keyed hash of the two, so that it can be checked
+// without remembering it, and a client can only have it if it has seen our
+// responses at that address.
+func (s *Server) serverCookie(client []byte, ip net.IP) []byte {
+	mac := hmac.New(sha256.New, s.cookieSecret)
+	mac.Write(client)
+	mac.Write(ip.To16())
+	return mac.Sum(nil)[:16]
+}
+
+// cookieOption returns the cookie option to send back to a client whose OPT
+// record is opt, or nil if it sent no well-formed cookie. valid reports
+// whether the server cookie it sent is one we gave it.
+func (s *Server) cookieOption(opt *OPT, source net.Addr) (option *EDNSOption, valid bool) {
+	sent := opt.option(optionCookie)
+	if sent == nil {
+		return nil, false
+	}
+	client, server, ok := splitCookie(sent)
+	if !ok {
+		return nil, false
+	}
+	ours := s.serverCookie(client, clientIP(source))
+	data := append(append([]byte(nil), client...), ours...)
+	return &EDNSOption{Code: optionCookie, Data: data}, hmac.Equal(server, ours)
+}
+
+// cookieRequired answers a UDP query that came without a valid server cookie
+// when RequireCookies is set. A client that sent a client cookie gets
+// BADCOOKIE along with the server cookie to retry with; one that sent none
+// gets a truncated response, so that it retries over TCP, where a spoofed
+// source address cannot complete the handshake.
+func (s *Server) cookieRequired(msg *Message, opt *OPT, cookie *EDNSOption) []byte {
+	header := *msg.Header
+	header.SetQR(true)
+	header.SetRA(true)
+	resp := &Message{Header: &header, Question: msg.Question}
+	if opt == nil {
+		header.SetTC(true)
+		response, _ := resp.ToBytes()
+		return response
+	}
+	reply := &OPT{UDPSize: uint16(s.maxUDPSize())}
+	if cookie == nil {
+		header.SetTC(true)
+	} else {
+		header.ResponseCode = RCode(rcodeBadCookie & 0xf)
+		reply.ExtendedRCode = rcodeBadCookie >> 4
+		reply.Options = []EDNSOption{*cookie}
+	}
+	resp.Additional = []*Answer{reply.toAnswer()}
+	response, _ := resp.ToBytes()
+	return response
+}
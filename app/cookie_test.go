@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// answerWithCookie answers like answerA, echoing the client cookie of the
+// query along with serverCookie, and replacing the client cookie with
+// spoofed if that is set.
+func answerWithCookie(serverCookie, spoofed []byte) func(req *Message) *Message {
+	return func(req *Message) *Message {
+		resp := answerA(req)
+		opt, _ := req.OPT()
+		if sent := opt.option(optionCookie); sent != nil {
+			client := sent.Data[:clientCookieLen]
+			if spoofed != nil {
+				client = spoofed
+			}
+			cookie := append(append([]byte(nil), client...), serverCookie...)
+			reply := &OPT{UDPSize: 1232, Options: []EDNSOption{{Code: optionCookie, Data: cookie}}}
+			resp.Additional = []*Answer{reply.toAnswer()}
+		}
+		return resp
+	}
+}
+
+func cookieQuery(id uint16, options ...EDNSOption) *Message {
+	return &Message{
+		Header:     &Header{ID: id, RecursionDesired: 1},
+		Question:   []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		Additional: []*Answer{(&OPT{UDPSize: 1232, Options: options}).toAnswer()},
+	}
+}
+
+func TestUpstreamCookieRoundTrip(t *testing.T) {
+	serverCookie := []byte("0123456789abcdef")
+	mock := newMockUpstream(t, answerWithCookie(serverCookie, nil))
+	upstream := &udpUpstream{addr: mock.addr()}
+
+	for id := uint16(1); id <= 2; id++ {
+		if _, err := upstream.Exchange(withTimeout(t, time.Second), cookieQuery(id)); err != nil {
+			t.Fatalf("Exchange %d: %v", id, err)
+		}
+	}
+	seen := mock.seen()
+	var clients [][]byte
+	for i, want := range [][]byte{nil, serverCookie} {
+		opt, _ := seen[i].OPT()
+		sent := opt.option(optionCookie)
+		if sent == nil {
+			t.Fatalf("query %d carried no cookie", i+1)
+		}
+		client, server, ok := splitCookie(sent)
+		if !ok || !bytes.Equal(server, want) {
+			t.Errorf("query %d sent server cookie %q, want %q", i+1, server, want)
+		}
+		clients = append(clients, client)
+	}
+	if !bytes.Equal(clients[0], clients[1]) {
+		t.Errorf("client cookie changed from %x to %x", clients[0], clients[1])
+	}
+
+	// Queries without EDNS go out as they are.
+	plain := &Message{Header: &Header{ID: 3}, Question: cookieQuery(3).Question}
+	if _, err := upstream.Exchange(withTimeout(t, time.Second), plain); err != nil {
+		t.Fatalf("Exchange without EDNS: %v", err)
+	}
+	if got := mock.seen()[2].Additional; len(got) != 0 {
+		t.Errorf("query without EDNS was sent %v", got)
+	}
+}
+
+func TestUpstreamCookieMismatch(t *testing.T) {
+	mock := newMockUpstream(t, answerWithCookie(nil, []byte("spoofed!")))
+	upstream := &udpUpstream{addr: mock.addr()}
+	if _, err := upstream.Exchange(withTimeout(t, time.Second), cookieQuery(1)); !errors.Is(err, errBadCookie) {
+		t.Fatalf("got err %v, want %v", err, errBadCookie)
+	}
+}
+
+// badCookieUntil answers like answerWithCookie, but with BADCOOKIE until a
+// query presents serverCookie, or always if persistent is set.
+func badCookieUntil(serverCookie []byte, persistent bool) func(req *Message) *Message {
+	return func(req *Message) *Message {
+		resp := answerWithCookie(serverCookie, nil)(req)
+		opt, _ := req.OPT()
+		if _, server, _ := splitCookie(opt.option(optionCookie)); persistent || !bytes.Equal(server, serverCookie) {
+			resp.Answer = nil
+			resp.Header.ResponseCode = RCode(rcodeBadCookie & 0xf)
+			reply, _ := resp.OPT()
+			reply.ExtendedRCode = rcodeBadCookie >> 4
+			resp.Additional = []*Answer{reply.toAnswer()}
+		}
+		return resp
+	}
+}
+
+func TestUpstreamBadCookieRetried(t *testing.T) {
+	serverCookie := []byte("0123456789abcdef")
+	mock := newMockUpstream(t, badCookieUntil(serverCookie, false))
+	upstream := &udpUpstream{addr: mock.addr()}
+
+	resp, err := upstream.Exchange(withTimeout(t, time.Second), cookieQuery(1))
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if badCookie(resp) || len(resp.Answer) != 1 {
+		t.Fatalf("got %s, want the answer to the retried query", resp)
+	}
+	if n := len(mock.seen()); n != 2 {
+		t.Errorf("upstream saw %d queries, want 2", n)
+	}
+}
+
+func TestUpstreamPersistentBadCookie(t *testing.T) {
+	mock := newMockUpstream(t, badCookieUntil([]byte("0123456789abcdef"), true))
+	upstream := &udpUpstream{addr: mock.addr()}
+	if _, err := upstream.Exchange(withTimeout(t, time.Second), cookieQuery(1)); !errors.Is(err, errCookieNotTaken) {
+		t.Fatalf("got err %v, want %v", err, errCookieNotTaken)
+	}
+	if n := len(mock.seen()); n != 2 {
+		t.Errorf("upstream saw %d queries, want 2", n)
+	}
+}
+
+func TestMalformedClientCookie(t *testing.T) {
+	s := newServer(testConfig(newMockUpstream(t, answerA)))
+	for _, size := range []int{0, 7, 9, 15, 41} {
+		query := cookieQuery(1, EDNSOption{Code: optionCookie, Data: make([]byte, size)})
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, mustBytes(t, query)))
+		if err != nil {
+			t.Fatalf("parsing response: %v", err)
+		}
+		if resp.Header.ResponseCode != RCodeFormErr {
+			t.Errorf("%d byte cookie got %s, want FORMERR", size, resp.Header.ResponseCode)
+		}
+	}
+}
+
+func TestRequireCookies(t *testing.T) {
+	cfg := testConfig(newMockUpstream(t, answerA))
+	cfg.RequireCookies = true
+	s := newServer(cfg)
+	clientCookie := EDNSOption{Code: optionCookie, Data: []byte("clientck")}
+	answer := func(source net.Addr, query *Message) *Message {
+		t.Helper()
+		resp, err := parseRequest(s.answerRequest(context.Background(), source, mustBytes(t, query)))
+		if err != nil {
+			t.Fatalf("parsing response: %v", err)
+		}
+		return resp
+	}
+
+	// Without any cookie, the client is sent to TCP.
+	if resp := answer(clientAddr, newQueryMessage(1)); resp.Header.Truncation != 1 || len(resp.Answer) != 0 {
+		t.Errorf("query without EDNS got %s", resp)
+	}
+	if resp := answer(clientAddr, cookieQuery(2)); resp.Header.Truncation != 1 || len(resp.Answer) != 0 {
+		t.Errorf("query without a cookie got %s", resp)
+	}
+
+	// With only a client cookie, it is told the server cookie to use.
+	resp := answer(clientAddr, cookieQuery(3, clientCookie))
+	opt, _ := resp.OPT()
+	if rcode := int(opt.ExtendedRCode)<<4 | int(resp.Header.ResponseCode); rcode != rcodeBadCookie || len(resp.Answer) != 0 {
+		t.Fatalf("query with a client cookie got rcode %d and %d answers, want BADCOOKIE", rcode, len(resp.Answer))
+	}
+	cookie := opt.option(optionCookie)
+	if cookie == nil || !bytes.Equal(cookie.Data[:clientCookieLen], clientCookie.Data) {
+		t.Fatalf("BADCOOKIE response carried cookie %v", cookie)
+	}
+
+	// Retried with it, the query is answered and the cookie echoed.
+	resp = answer(clientAddr, cookieQuery(4, *cookie))
+	if resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 1 {
+		t.Fatalf("query with the server cookie got %s", resp)
+	}
+	opt, _ = resp.OPT()
+	if echoed := opt.option(optionCookie); echoed == nil || !bytes.Equal(echoed.Data, cookie.Data) {
+		t.Errorf("answer echoed cookie %v, want %v", echoed, cookie)
+	}
+
+	// The server cookie is only good from the address it was given to.
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40000}
+	if resp := answer(other, cookieQuery(5, *cookie)); len(resp.Answer) != 0 {
+		t.Errorf("server cookie was accepted from another address: %s", resp)
+	}
+
+	// TCP needs no cookie.
+	tcp := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	if resp := answer(tcp, newQueryMessage(6)); len(resp.Answer) != 1 {
+		t.Errorf("TCP query got %s", resp)
+	}
+}
+
+func newQueryMessage(id uint16) *Message {
+	return &Message{Header: &Header{ID: id, RecursionDesired: 1}, Question: cookieQuery(id).Question}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// parseDNS64Prefix parses a NAT64 prefix in CIDR notation. RFC 6052 only
+// defines where the IPv4 address goes under prefixes of 32, 40, 48, 56, 64
+// and 96 bits, and needs bits 64 to 71 clear.
+func parseDNS64Prefix(cidr string) (*net.IPNet, error) {
+	ip, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("DNS64 prefix %s is not IPv6", cidr)
+	}
+	switch ones, _ := prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("DNS64 prefix %s must be a /32, /40, /48, /56, /64 or /96", cidr)
+	}
+	if prefix.IP[8] != 0 {
+		return nil, fmt.Errorf("DNS64 prefix %s has bits 64 to 71 set", cidr)
+	}
+	return prefix, nil
+}
+
+// dns64 turns resp, the response to the AAAA question, into one with AAAA
+// records synthesized from the name's A records under DNS64Prefix (RFC
+// 6147), when the name has no AAAA records of its own. Any other response,
+// including a negative one for a name that does not exist, is returned as
+// it is. The second result reports whether the A response, if one was
+// needed, came from the cache.
+//
+// Addresses in ::ffff:0:0/96 are IPv4-mapped, and stand for no IPv6 host, so
+// AAAA records with them count as none, and A records whose address would
+// be synthesized into that range are left out (RFC 6147 5.1.4). If the A
+// query fails, the client still gets the AAAA response it was owed.
+//
+// Clients that set CD validate for themselves and would reject the made-up
+// records, so they get resp unchanged (RFC 6147 5.5).
+func (s *Server) dns64(ctx context.Context, source net.Addr, header *Header, question *Question, subnet *EDNSOption, dnssecOK bool, resp *Message) (*Message, bool, error) {
+	if s.config.DNS64Prefix == nil || question.Type != TypeAAAA || header.CDBit() ||
+		resp.Header.ResponseCode != RCodeNoError || resp.Header.Truncation != 0 {
+		return resp, true, nil
+	}
+	for _, a := range resp.Answer {
+		if a.Type == TypeAAAA && !ipv4Mapped(a.RData) {
+			return resp, true, nil
+		}
+	}
+	aQuestion := *question
+	aQuestion.Type = TypeA
+	aResp, hit, err := s.resolve(ctx, source, header, &aQuestion, subnet, dnssecOK)
+	if err != nil {
+		slog.Debug("DNS64 A query failed", "name", question.Name, "err", err)
+		return resp, true, nil
+	}
+	if aResp.Header.ResponseCode != RCodeNoError {
+		return resp, true, nil
+	}
+	// The synthesized records live no longer than the AAAA response said
+	// the name has none (RFC 6147 5.1.7).
+	limit, capped := negativeTTL(resp)
+	answers := make([]*Answer, 0, len(aResp.Answer))
+	synthesized := false
+	for _, a := range aResp.Answer {
+		if a.Type != TypeA || a.Class != question.Class || len(a.RData) != net.IPv4len {
+			// CNAMEs leading to the A records are kept as they are.
+			answers = append(answers, a)
+			continue
+		}
+		ttl := a.TTL
+		if capped {
+			ttl = min(ttl, limit)
+		}
+		rdata := embedIPv4(s.config.DNS64Prefix, net.IP(a.RData))
+		if ipv4Mapped(rdata) {
+			continue
+		}
+		answers = append(answers, &Answer{
+			Name:     a.Name,
+			Type:     TypeAAAA,
+			Class:    a.Class,
+			TTL:      ttl,
+			RDLength: uint16(len(rdata)),
+			RData:    rdata,
+		})
+		synthesized = true
+	}
+	if !synthesized {
+		return resp, true, nil
+	}
+	// Made-up records cannot carry the upstream's authentication.
+	synthHeader := *aResp.Header
+	synthHeader.SetAD(false)
+	return &Message{
+		Header:     &synthHeader,
+		Question:   []*Question{question},
+		Answer:     answers,
+		Authority:  []*Answer{},
+		Additional: []*Answer{},
+	}, hit, nil
+}
+
+// ipv4Mapped reports whether rdata is an IPv6 address in ::ffff:0:0/96.
+func ipv4Mapped(rdata []byte) bool {
+	return len(rdata) == net.IPv6len && net.IP(rdata).To4() != nil
+}
+
+// embedIPv4 returns the IPv6 address that stands for v4 under prefix, laid
+// out as RFC 6052 2.2 has it for the prefix's length. Bits 64 to 71 are
+// skipped, which is why a prefix longer than /64 must be a /96.
+func embedIPv4(prefix *net.IPNet, v4 net.IP) net.IP {
+	addr := make(net.IP, net.IPv6len)
+	copy(addr, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	i := ones / 8
+	for _, b := range v4.To4() {
+		if i == 8 {
+			i++
+		}
+		addr[i] = b
+		i++
+	}
+	return addr
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmbedIPv4(t *testing.T) {
+	// The examples of RFC 6052 2.4.
+	v4 := net.IPv4(192, 0, 2, 33)
+	for _, tt := range []struct {
+		prefix, want string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+		{"64:ff9b::/96", "64:ff9b::192.0.2.33"},
+	} {
+		prefix, err := parseDNS64Prefix(tt.prefix)
+		if err != nil {
+			t.Fatalf("parseDNS64Prefix(%q): %v", tt.prefix, err)
+		}
+		if got := embedIPv4(prefix, v4); !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("192.0.2.33 under %s = %v, want %s", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestParseDNS64PrefixRejects(t *testing.T) {
+	for _, cidr := range []string{
+		"64:ff9b::",
+		"192.0.2.0/24",
+		"64:ff9b::/80",
+		"64:ff9b:0:0:ff00::/96",
+	} {
+		if _, err := parseDNS64Prefix(cidr); err == nil {
+			t.Errorf("parseDNS64Prefix(%q) succeeded", cidr)
+		}
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	soa, err := soaRData(&SOARecord{MName: "ns.example", RName: "admin.example", Minimum: 20})
+	if err != nil {
+		t.Fatalf("soaRData: %v", err)
+	}
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		q := req.Question[0]
+		switch {
+		case strings.EqualFold(q.Name, "missing.example"):
+			resp := answerA(req)
+			resp.Header.ResponseCode = RCodeNXDomain
+			resp.Answer = nil
+			return resp
+		case q.Type == TypeA:
+			return answerA(req)
+		case strings.EqualFold(q.Name, "dual.example"):
+			resp := answerA(req)
+			resp.Answer[0].Type, resp.Answer[0].RDLength = TypeAAAA, 16
+			resp.Answer[0].RData = net.ParseIP("2001:db8::1")
+			return resp
+		default:
+			// NODATA, with the SOA saying so for 20 seconds.
+			resp := answerA(req)
+			resp.Answer = nil
+			resp.Authority = []*Answer{{Name: "example", Type: TypeSOA, Class: 1, TTL: 30, RDLength: uint16(len(soa)), RData: soa}}
+			return resp
+		}
+	})
+	cfg := testConfig(upstream)
+	cfg.DNS64Prefix, _ = parseDNS64Prefix("64:ff9b::/96")
+	s := newServer(cfg)
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 1, "v4only.example", TypeAAAA)))
+	if err != nil || resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 1 {
+		t.Fatalf("AAAA for an IPv4-only name got %+v, %v", resp, err)
+	}
+	a := resp.Answer[0]
+	if a.Type != TypeAAAA || !net.IP(a.RData).Equal(net.ParseIP("64:ff9b::192.0.2.1")) {
+		t.Errorf("synthesized %v %v, want AAAA 64:ff9b::192.0.2.1", a.Type, net.IP(a.RData))
+	}
+	if a.TTL != 20 {
+		t.Errorf("synthesized TTL %d, want the 20 seconds of the negative answer", a.TTL)
+	}
+
+	resp, err = parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 2, "dual.example", TypeAAAA)))
+	if err != nil || len(resp.Answer) != 1 || !net.IP(resp.Answer[0].RData).Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("AAAA for a name with AAAA records got %+v, %v; want its own record", resp, err)
+	}
+
+	resp, err = parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 3, "missing.example", TypeAAAA)))
+	if err != nil || resp.Header.ResponseCode != RCodeNXDomain || len(resp.Answer) != 0 {
+		t.Fatalf("AAAA for a missing name got %+v, %v; want NXDOMAIN", resp, err)
+	}
+
+	var aQueries int
+	for _, q := range upstream.seen() {
+		if q.Question[0].Type == TypeA {
+			aQueries++
+		}
+	}
+	if aQueries != 1 {
+		t.Errorf("upstream saw %d A queries, want only the one for v4only.example", aQueries)
+	}
+}
+
+func TestDNS64Exclusions(t *testing.T) {
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		q := req.Question[0]
+		resp := answerA(req)
+		switch {
+		case strings.EqualFold(q.Name, "down.example") && q.Type == TypeA:
+			return nil
+		case strings.EqualFold(q.Name, "mapped.example") && q.Type == TypeAAAA:
+			resp.Answer[0].Type, resp.Answer[0].RDLength = TypeAAAA, 16
+			resp.Answer[0].RData = net.ParseIP("::ffff:192.0.2.7")
+		case strings.EqualFold(q.Name, "edge.example") && q.Type == TypeA:
+			// Under ::/64, 0.255.255.1 would become ::ffff:1.0.0.0.
+			resp.Answer[0].RData = []byte{0, 255, 255, 1}
+		case q.Type == TypeAAAA:
+			resp.Answer = nil
+		}
+		return resp
+	})
+	cfg := testConfig(upstream)
+	cfg.DNS64Prefix, _ = parseDNS64Prefix("::/64")
+	cfg.Timeout = 50 * time.Millisecond
+	cfg.Retries = 0
+	s := newServer(cfg)
+
+	// A mapped AAAA record is no AAAA record, so one is synthesized.
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 1, "mapped.example", TypeAAAA)))
+	if err != nil || len(resp.Answer) != 1 || !net.IP(resp.Answer[0].RData).Equal(embedIPv4(cfg.DNS64Prefix, net.IPv4(192, 0, 2, 1))) {
+		t.Fatalf("AAAA for a name with a mapped AAAA got %+v, %v; want a synthesized record", resp, err)
+	}
+
+	// Nothing is synthesized into the mapped range.
+	resp, err = parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 2, "edge.example", TypeAAAA)))
+	if err != nil || resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 0 {
+		t.Fatalf("AAAA that would be mapped got %+v, %v; want NODATA", resp, err)
+	}
+
+	// A failed A query leaves the NODATA answer to the AAAA query.
+	resp, err = parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 3, "down.example", TypeAAAA)))
+	if err != nil || resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 0 {
+		t.Fatalf("AAAA with a failing A query got %+v, %v; want NODATA", resp, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+// dohMediaType is the content type of wire-format messages in DoH.
+const dohMediaType = "application/dns-message"
+
+// httpsUpstream reaches a resolver over DNS-over-HTTPS (RFC 8484), sending the
+// wire-format query either as a POST body or base64url-encoded in a GET.
+type httpsUpstream struct {
+	endpoint string
+	useGET   bool
+	client   *http.Client
+}
+
+func newHTTPSUpstream(endpoint string, useGET bool) *httpsUpstream {
+	return &httpsUpstream{endpoint: endpoint, useGET: useGET, client: http.DefaultClient}
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, req *Message) (*Message, error) {
+	query, err := req.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var httpReq *http.Request
+	if u.useGET {
+		// The endpoint may have a query of its own to keep.
+		endpoint, err := url.Parse(u.endpoint)
+		if err != nil {
+			return nil, err
+		}
+		params := endpoint.Query()
+		params.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		endpoint.RawQuery = params.Encode()
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint, bytes.NewReader(query))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", dohMediaType)
+
+	httpResp, err := u.client.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx)
+		}
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH upstream %s answered %s", u.endpoint, httpResp.Status)
+	}
+	// The type may carry parameters, and is case-insensitive.
+	ct := httpResp.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(ct); err != nil || mediaType != dohMediaType {
+		return nil, fmt.Errorf("DoH upstream %s answered with content type %q", u.endpoint, ct)
+	}
+	// A DNS message is at most 65535 bytes, whatever the transport. A byte
+	// more is read so that a longer body is refused rather than cut short.
+	resp, err := io.ReadAll(io.LimitReader(httpResp.Body, maxTCPMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) > maxTCPMessageSize {
+		return nil, fmt.Errorf("%w: DoH upstream %s sent more than %d bytes", errReplyTooLarge, u.endpoint, maxTCPMessageSize)
+	}
+	return parseResponse(resp)
+}
+
+func (u *httpsUpstream) String() string {
+	return u.endpoint
+}
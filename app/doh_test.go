@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newDoHResolver starts a DoH endpoint that answers every query with
+// sampleResponse and records the method it was asked with.
+func newDoHResolver(t *testing.T) (*httptest.Server, *string) {
+	t.Helper()
+	var method string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		var query []byte
+		var err error
+		switch r.Method {
+		case http.MethodPost:
+			if ct := r.Header.Get("Content-Type"); ct != dohMediaType {
+				http.Error(w, "bad content type "+ct, http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = io.ReadAll(r.Body)
+		case http.MethodGet:
+			query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		default:
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := parseRequest(query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(sampleResponse)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &method
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	for _, useGET := range []bool{false, true} {
+		srv, method := newDoHResolver(t)
+		upstream := newHTTPSUpstream(srv.URL+"/dns-query", useGET)
+		upstream.client = srv.Client()
+
+		req := &Message{
+			Header:   &Header{ID: 0x04d2, RecursionDesired: 1},
+			Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		}
+		resp, err := upstream.Exchange(withTimeout(t, time.Second), req)
+		if err != nil {
+			t.Fatalf("Exchange (GET %v): %v", useGET, err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Name != "example.com" {
+			t.Fatalf("unexpected reply %+v", resp)
+		}
+		want := http.MethodPost
+		if useGET {
+			want = http.MethodGet
+		}
+		if *method != want {
+			t.Fatalf("query sent with %s, want %s", *method, want)
+		}
+	}
+}
+
+func TestHTTPSUpstreamGETKeepsEndpointQuery(t *testing.T) {
+	var params url.Values
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params = r.URL.Query()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(sampleResponse)
+	}))
+	defer srv.Close()
+	upstream := newHTTPSUpstream(srv.URL+"/dns-query?key=abc", true)
+	upstream.client = srv.Client()
+
+	req := &Message{
+		Header:   &Header{ID: 0x04d2, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	if _, err := upstream.Exchange(withTimeout(t, time.Second), req); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if got := params.Get("key"); got != "abc" {
+		t.Errorf("endpoint parameter key=%q, want abc", got)
+	}
+	query, err := base64.RawURLEncoding.DecodeString(params.Get("dns"))
+	if err != nil {
+		t.Fatalf("dns parameter %q: %v", params.Get("dns"), err)
+	}
+	if _, err := parseRequest(query); err != nil {
+		t.Fatalf("dns parameter does not hold the query: %v", err)
+	}
+}
+
+func TestHTTPSUpstreamContentType(t *testing.T) {
+	for _, tt := range []struct {
+		contentType string
+		ok          bool
+	}{
+		{dohMediaType, true},
+		{"Application/DNS-Message", true},
+		{"application/dns-message; charset=binary", true},
+		{"text/html", false},
+		{"", false},
+	} {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query, _ := io.ReadAll(r.Body)
+			req, _ := parseRequest(query)
+			w.Header().Set("Content-Type", tt.contentType)
+			w.Write(mustBytes(t, answerA(req)))
+		}))
+		upstream := newHTTPSUpstream(srv.URL, false)
+		upstream.client = srv.Client()
+		req := &Message{
+			Header:   &Header{ID: 1},
+			Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		}
+		_, err := upstream.Exchange(withTimeout(t, time.Second), req)
+		if (err == nil) != tt.ok {
+			t.Errorf("content type %q: got err %v, want ok %v", tt.contentType, err, tt.ok)
+		}
+		srv.Close()
+	}
+}
+
+func TestHTTPSUpstreamErrorStatus(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	upstream := newHTTPSUpstream(srv.URL, false)
+	upstream.client = srv.Client()
+
+	req := &Message{
+		Header:   &Header{ID: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	if _, err := upstream.Exchange(withTimeout(t, time.Second), req); err == nil {
+		t.Fatal("Exchange succeeded against a failing endpoint")
+	}
+}
+
+func TestHTTPSUpstreamRejectsOversizedBody(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(make([]byte, maxTCPMessageSize+100))
+	}))
+	defer srv.Close()
+	upstream := newHTTPSUpstream(srv.URL, false)
+	upstream.client = srv.Client()
+
+	req := &Message{
+		Header:   &Header{ID: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	if _, err := upstream.Exchange(withTimeout(t, time.Second), req); !errors.Is(err, errReplyTooLarge) {
+		t.Fatalf("got err %v, want %v", err, errReplyTooLarge)
+	}
+}
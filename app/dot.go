@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+)
+
+// tlsUpstream reaches a resolver over DNS-over-TLS (RFC 7858): the same
+// length-prefixed framing as DNS over TCP, inside a TLS session.
+type tlsUpstream struct {
+	addr string
+	// config must carry the ServerName the resolver's certificate is
+	// verified against.
+	config *tls.Config
+}
+
+// newTLSUpstream returns a DoT upstream at addr whose certificate must be
+// valid for serverName.
+func newTLSUpstream(addr, serverName string) *tlsUpstream {
+	return &tlsUpstream{
+		addr:   addr,
+		config: &tls.Config{ServerName: serverName},
+	}
+}
+
+func (u *tlsUpstream) Exchange(ctx context.Context, req *Message) (*Message, error) {
+	dialer := &tls.Dialer{Config: u.config}
+	conn, err := dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx)
+		}
+		return nil, err
+	}
+	defer conn.Close()
+	defer bindConn(ctx, conn)()
+
+	query, err := req.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	resp, err := readTCPMessage(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx)
+		}
+		return nil, err
+	}
+	return parseResponse(resp)
+}
+
+func (u *tlsUpstream) String() string {
+	return "tls://" + u.addr
+}
@@ -0,0 +1,25 @@
+//go:build network
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTLSUpstreamPublicResolver talks to a real DoT resolver, so it only runs
+// with go test -tags network.
+func TestTLSUpstreamPublicResolver(t *testing.T) {
+	upstream := newTLSUpstream("1.1.1.1:853", "cloudflare-dns.com")
+	req := &Message{
+		Header:   &Header{ID: randomID(), RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	resp, err := upstream.Exchange(withTimeout(t, 5*time.Second), req)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) == 0 {
+		t.Fatalf("unexpected reply:\n%s", resp)
+	}
+}
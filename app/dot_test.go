@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTLSResolver starts a DoT resolver on a loopback port that answers every
+// query with answerA. Its certificate is valid for example.com and is trusted
+// by the returned pool.
+func newTLSResolver(t *testing.T) (string, *x509.CertPool) {
+	t.Helper()
+	// httptest carries a ready-made certificate; borrow it.
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				req, err := parseRequest(query)
+				if err != nil {
+					return
+				}
+				resp, err := answerA(req).ToBytes()
+				if err != nil {
+					return
+				}
+				writeTCPMessage(conn, resp)
+			}()
+		}
+	}()
+	return listener.Addr().String(), pool
+}
+
+func TestTLSUpstream(t *testing.T) {
+	addr, pool := newTLSResolver(t)
+	upstream := newTLSUpstream(addr, "example.com")
+	upstream.config.RootCAs = pool
+
+	req := &Message{
+		Header:   &Header{ID: 0x7777, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.org", Type: TypeA, Class: 1}},
+	}
+	resp, err := upstream.Exchange(withTimeout(t, time.Second), req)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if resp.Header.ID != 0x7777 || len(resp.Answer) != 1 || !bytes.Equal(resp.Answer[0].RData, []byte{192, 0, 2, 1}) {
+		t.Fatalf("unexpected reply %+v", resp)
+	}
+}
+
+func TestTLSUpstreamVerifiesName(t *testing.T) {
+	addr, pool := newTLSResolver(t)
+	upstream := newTLSUpstream(addr, "resolver.invalid")
+	upstream.config.RootCAs = pool
+
+	req := &Message{
+		Header:   &Header{ID: 1},
+		Question: []*Question{{Name: "example.org", Type: TypeA, Class: 1}},
+	}
+	if _, err := upstream.Exchange(withTimeout(t, time.Second), req); err == nil {
+		t.Fatal("Exchange accepted a certificate for the wrong name")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// answerFrom returns a mock upstream handler that serves the records in
+// zone, keyed by lowercase name: the records of the queried type, no records
+// if the name has none of that type, and NXDOMAIN for names zone lacks.
+func answerFrom(zone map[string][]*Answer) func(req *Message) *Message {
+	return func(req *Message) *Message {
+		header := *req.Header
+		header.QR = 1
+		resp := &Message{Header: &header, Question: req.Question}
+		q := req.Question[0]
+		records, ok := zone[strings.ToLower(q.Name)]
+		if !ok {
+			header.ResponseCode = RCodeNXDomain
+			return resp
+		}
+		for _, a := range records {
+			if a.Type == q.Type {
+				answer := *a
+				answer.Name = q.Name
+				resp.Answer = append(resp.Answer, &answer)
+			}
+		}
+		return resp
+	}
+}
+
+// startServer runs a server for cfg on an ephemeral loopback port, over UDP
+// and TCP, until the test ends, and returns its address.
+func startServer(t *testing.T, cfg *Config) *net.UDPAddr {
+	t.Helper()
+	udpConn, tcpListener, err := listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := newServer(cfg)
+	done := make(chan struct{})
+	go func() {
+		s.serve([]*net.UDPConn{udpConn}, []*net.TCPListener{tcpListener})
+		close(done)
+	}()
+	t.Cleanup(func() {
+		udpConn.Close()
+		tcpListener.Close()
+		<-done
+	})
+	return udpConn.LocalAddr().(*net.UDPAddr)
+}
+
+// query asks the server at addr about name over UDP, the way a stub resolver
+// would, and returns the reply.
+func query(t *testing.T, addr *net.UDPAddr, name string, qtype Type) *Message {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+	req := &Message{
+		Header:   &Header{ID: randomID(), RecursionDesired: 1},
+		Question: []*Question{{Name: name, Type: qtype, Class: 1}},
+	}
+	resp, err := exchange(withTimeout(t, time.Second), req, conn)
+	if err != nil {
+		t.Fatalf("query %s %s: %v", name, qtype, err)
+	}
+	if err := checkReply(req, resp); err != nil {
+		t.Fatalf("query %s %s: %v", name, qtype, err)
+	}
+	return resp
+}
+
+func TestEndToEnd(t *testing.T) {
+	upstream := newMockUpstream(t, answerFrom(map[string][]*Answer{
+		"example.com": {
+			{Type: TypeA, Class: 1, TTL: 300, RDLength: 4, RData: []byte{192, 0, 2, 10}},
+			{Type: TypeAAAA, Class: 1, TTL: 300, RDLength: 16, RData: net.ParseIP("2001:db8::10")},
+		},
+		"www.example.com": {
+			{Type: TypeA, Class: 1, TTL: 60, RDLength: 4, RData: []byte{192, 0, 2, 20}},
+		},
+	}))
+	addr := startServer(t, testConfig(upstream))
+
+	for _, tt := range []struct {
+		name  string
+		qtype Type
+		rcode RCode
+		rdata [][]byte
+	}{
+		{"example.com", TypeA, RCodeNoError, [][]byte{{192, 0, 2, 10}}},
+		{"Example.COM", TypeAAAA, RCodeNoError, [][]byte{net.ParseIP("2001:db8::10")}},
+		{"www.example.com", TypeA, RCodeNoError, [][]byte{{192, 0, 2, 20}}},
+		{"www.example.com", TypeAAAA, RCodeNoError, nil},
+		{"missing.example.com", TypeA, RCodeNXDomain, nil},
+	} {
+		resp := query(t, addr, tt.name, tt.qtype)
+		if resp.Header.ResponseCode != tt.rcode || !resp.Header.RABit() {
+			t.Errorf("%s %s: header %+v, want rcode %s", tt.name, tt.qtype, resp.Header, tt.rcode)
+			continue
+		}
+		if len(resp.Answer) != len(tt.rdata) {
+			t.Errorf("%s %s: got %d answers, want %d", tt.name, tt.qtype, len(resp.Answer), len(tt.rdata))
+			continue
+		}
+		for i, a := range resp.Answer {
+			if a.Name != tt.name || a.Type != tt.qtype || !bytes.Equal(a.RData, tt.rdata[i]) {
+				t.Errorf("%s %s: answer %s", tt.name, tt.qtype, a)
+			}
+		}
+	}
+	if n := len(upstream.seen()); n != 5 {
+		t.Fatalf("upstream saw %d queries, want 5", n)
+	}
+
+	// Asked again, the answer comes from the cache, and over TCP as well.
+	if resp := query(t, addr, "www.example.com", TypeA); len(resp.Answer) != 1 {
+		t.Fatalf("cached answer %+v", resp)
+	}
+	req := &Message{
+		Header:   &Header{ID: 7, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	raw, err := queryDNSTCP(context.Background(), req, addr.String())
+	if err != nil {
+		t.Fatalf("TCP query: %v", err)
+	}
+	if resp, err := parseRequest(raw); err != nil || len(resp.Answer) != 1 || !bytes.Equal(resp.Answer[0].RData, []byte{192, 0, 2, 10}) {
+		t.Fatalf("TCP reply %+v, %v", resp, err)
+	}
+	if n := len(upstream.seen()); n != 5 {
+		t.Fatalf("upstream saw %d queries after cache hits, want 5", n)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// optionClientSubnet is the EDNS option code of EDNS Client Subnet (RFC 7871),
+// which tells an upstream roughly where a query comes from.
+const optionClientSubnet = 8
+
+// errBadSubnet is returned for a client subnet option that RFC 7871 section
+// 6 says must be answered with FORMERR.
+var errBadSubnet = errors.New("malformed client subnet")
+
+// checkSubnet verifies the client subnet option a client sent: a known
+// address family, a source prefix no longer than its addresses, and exactly
+// as many address bytes as the prefix covers, with none of the bits past it
+// set.
+func checkSubnet(option *EDNSOption) error {
+	data := option.Data
+	if len(data) < 4 {
+		return errBadSubnet
+	}
+	bits := 0
+	switch binary.BigEndian.Uint16(data) {
+	case 1:
+		bits = 32
+	case 2:
+		bits = 128
+	default:
+		return errBadSubnet
+	}
+	prefix, addr := int(data[2]), data[4:]
+	if prefix > bits || len(addr) != (prefix+7)/8 {
+		return errBadSubnet
+	}
+	if prefix%8 != 0 && addr[len(addr)-1]<<(prefix%8) != 0 {
+		return errBadSubnet
+	}
+	return nil
+}
+
+// subnetOption encodes network as an EDNS Client Subnet option: the address
+// family, the source prefix length, a scope of zero and only as many bytes of
+// the address as the prefix covers.
+func subnetOption(network *net.IPNet) EDNSOption {
+	family, ip := uint16(1), network.IP.To4()
+	if ip == nil {
+		family, ip = 2, network.IP.To16()
+	}
+	ones, _ := network.Mask.Size()
+	addr := ip.Mask(network.Mask)[:(ones+7)/8]
+	data := binary.BigEndian.AppendUint16(nil, family)
+	data = append(data, byte(ones), 0)
+	return EDNSOption{Code: optionClientSubnet, Data: append(data, addr...)}
+}
+
+// option returns the first option in o with code, or nil if there is none.
+func (o *OPT) option(code uint16) *EDNSOption {
+	if o == nil {
+		return nil
+	}
+	for i := range o.Options {
+		if o.Options[i].Code == code {
+			return &o.Options[i]
+		}
+	}
+	return nil
+}
+
+// clientSubnet returns the client's own subnet option from its OPT record if
+// it is to be passed upstream, or nil otherwise.
+func (s *Server) clientSubnet(opt *OPT) *EDNSOption {
+	if s.config.ClientSubnet != PassClientSubnet {
+		return nil
+	}
+	return opt.option(optionClientSubnet)
+}
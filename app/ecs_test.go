@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+)
+
+func TestSubnetOption(t *testing.T) {
+	for _, tt := range []struct {
+		cidr string
+		want []byte
+	}{
+		{"192.0.2.0/24", []byte{0, 1, 24, 0, 192, 0, 2}},
+		{"198.51.100.77/20", []byte{0, 1, 20, 0, 198, 51, 96}},
+		{"2001:db8:aa::/48", []byte{0, 2, 48, 0, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0xaa}},
+		{"0.0.0.0/0", []byte{0, 1, 0, 0}},
+	} {
+		_, network, err := net.ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatalf("ParseCIDR(%s): %v", tt.cidr, err)
+		}
+		if got := subnetOption(network); got.Code != optionClientSubnet || !bytes.Equal(got.Data, tt.want) {
+			t.Errorf("subnetOption(%s) = %d %v, want %d %v", tt.cidr, got.Code, got.Data, optionClientSubnet, tt.want)
+		}
+	}
+}
+
+func TestClientSubnetModes(t *testing.T) {
+	_, added, _ := net.ParseCIDR("203.0.113.0/24")
+	clientSubnet := []byte{0, 1, 24, 0, 198, 51, 100}
+	addedSubnet := []byte{0, 1, 24, 0, 203, 0, 113}
+	for _, tt := range []struct {
+		name       string
+		mode       ClientSubnetMode
+		add        *net.IPNet
+		fromClient bool
+		want       []byte
+		upstreams  int
+	}{
+		{"strip", StripClientSubnet, nil, true, nil, 1},
+		{"strip without a subnet", StripClientSubnet, nil, false, nil, 1},
+		{"pass", PassClientSubnet, nil, true, clientSubnet, 2},
+		{"pass without a subnet", PassClientSubnet, nil, false, nil, 1},
+		{"inject", StripClientSubnet, added, true, addedSubnet, 1},
+		{"pass or inject", PassClientSubnet, added, true, clientSubnet, 2},
+		{"inject when none is passed", PassClientSubnet, added, false, addedSubnet, 1},
+	} {
+		upstream := newMockUpstream(t, answerA)
+		cfg := testConfig(upstream)
+		cfg.ClientSubnet, cfg.AddSubnet = tt.mode, tt.add
+		s := newServer(cfg)
+
+		opt := &OPT{UDPSize: 1232}
+		if tt.fromClient {
+			opt.Options = []EDNSOption{{Code: optionClientSubnet, Data: clientSubnet}}
+		}
+		query := mustBytes(t, &Message{
+			Header:     &Header{ID: 3, RecursionDesired: 1},
+			Question:   []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+			Additional: []*Answer{opt.toAnswer()},
+		})
+		// Asked twice, to see whether the answer was cached.
+		for i := 0; i < 2; i++ {
+			resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, query))
+			if err != nil || len(resp.Answer) != 1 {
+				t.Fatalf("%s: response %+v, %v", tt.name, resp, err)
+			}
+		}
+
+		seen := upstream.seen()
+		if len(seen) != tt.upstreams {
+			t.Errorf("%s: upstream saw %d queries, want %d", tt.name, len(seen), tt.upstreams)
+		}
+		sent, err := seen[0].OPT()
+		if err != nil || sent == nil {
+			t.Fatalf("%s: upstream query OPT %+v, %v", tt.name, sent, err)
+		}
+		got := sent.option(optionClientSubnet)
+		switch {
+		case tt.want == nil && got != nil:
+			t.Errorf("%s: upstream was sent subnet %v", tt.name, got.Data)
+		case tt.want != nil && (got == nil || !bytes.Equal(got.Data, tt.want)):
+			t.Errorf("%s: upstream was sent subnet %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// subnetQuery returns a query for example.com carrying the client subnet
+// option data.
+func subnetQuery(t *testing.T, data []byte) []byte {
+	opt := &OPT{UDPSize: 1232, Options: []EDNSOption{{Code: optionClientSubnet, Data: data}}}
+	return mustBytes(t, &Message{
+		Header:     &Header{ID: 3, RecursionDesired: 1},
+		Question:   []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		Additional: []*Answer{opt.toAnswer()},
+	})
+}
+
+func TestMalformedClientSubnet(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"short", []byte{0, 1, 24}},
+		{"unknown family", []byte{0, 3, 24, 0, 198, 51, 100}},
+		{"prefix too long", []byte{0, 1, 33, 0, 198, 51, 100, 7, 1}},
+		{"too many address bytes", []byte{0, 1, 16, 0, 198, 51, 100}},
+		{"too few address bytes", []byte{0, 2, 48, 0, 0x20, 0x01}},
+		{"bits past the prefix", []byte{0, 1, 20, 0, 198, 51, 100}},
+	} {
+		upstream := newMockUpstream(t, answerA)
+		cfg := testConfig(upstream)
+		cfg.ClientSubnet = PassClientSubnet
+		s := newServer(cfg)
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, subnetQuery(t, tt.data)))
+		if err != nil || resp.Header.ResponseCode != RCodeFormErr {
+			t.Errorf("%s: got %+v, %v; want FORMERR", tt.name, resp, err)
+		}
+		if n := len(upstream.seen()); n != 0 {
+			t.Errorf("%s: upstream saw %d queries", tt.name, n)
+		}
+	}
+
+	// Stripped subnets are not looked at.
+	s := newServer(testConfig(newMockUpstream(t, answerA)))
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, subnetQuery(t, []byte{0, 3})))
+	if err != nil || resp.Header.ResponseCode != RCodeNoError {
+		t.Errorf("stripped subnet: got %+v, %v; want an answer", resp, err)
+	}
+}
+
+func TestClientSubnetScopeReturned(t *testing.T) {
+	scoped := []byte{0, 1, 24, 16, 198, 51, 100}
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		opt := &OPT{UDPSize: 1232, Options: []EDNSOption{{Code: optionClientSubnet, Data: scoped}}}
+		resp.Additional = []*Answer{opt.toAnswer()}
+		return resp
+	})
+	cfg := testConfig(upstream)
+	cfg.ClientSubnet = PassClientSubnet
+	s := newServer(cfg)
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, subnetQuery(t, []byte{0, 1, 24, 0, 198, 51, 100})))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	opt, err := resp.OPT()
+	if err != nil || opt == nil {
+		t.Fatalf("response OPT %+v, %v", opt, err)
+	}
+	if got := opt.option(optionClientSubnet); got == nil || !bytes.Equal(got.Data, scoped) {
+		t.Fatalf("client got subnet %v, want the upstream's %v", got, scoped)
+	}
+}
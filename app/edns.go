@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ednsUDPSize is the UDP payload size this server advertises to upstreams in
+// its own OPT records, and so the most it accepts in a UDP reply. Buffers
+// datagrams are read into hold one byte more, to tell a reply that did not
+// fit from one that just did. It is also the most Config.MaxUDPSize can
+// advertise to clients.
+const ednsUDPSize = 4096
+
+// minUDPSize is the payload size every DNS implementation must accept, and
+// the limit that applies when no OPT record says otherwise.
+const minUDPSize = 512
+
+// EDNSOption is a single option in the RData of an OPT record.
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// OPT is the EDNS0 pseudo-record of RFC 6891. On the wire it is an ordinary
+// record in the additional section whose class and TTL fields are reused for
+// the fields below.
+type OPT struct {
+	UDPSize       uint16
+	ExtendedRCode byte
+	Version       byte
+	DNSSECOK      bool
+	Options       []EDNSOption
+}
+
+// parseOPT decodes an OPT record from the additional section.
+func parseOPT(a *Answer) (*OPT, error) {
+	if err := checkType(a, TypeOPT); err != nil {
+		return nil, err
+	}
+	opt := &OPT{
+		UDPSize:       a.Class,
+		ExtendedRCode: byte(a.TTL >> 24),
+		Version:       byte(a.TTL >> 16),
+		DNSSECOK:      a.TTL&0x8000 != 0,
+	}
+	for off := 0; off < len(a.RData); {
+		if off+4 > len(a.RData) {
+			return nil, fmt.Errorf("%w: truncated EDNS option header", errRDataLength)
+		}
+		code := binary.BigEndian.Uint16(a.RData[off : off+2])
+		length := int(binary.BigEndian.Uint16(a.RData[off+2 : off+4]))
+		if off+4+length > len(a.RData) {
+			return nil, fmt.Errorf("%w: EDNS option runs past rdata", errRDataLength)
+		}
+		data := make([]byte, length)
+		copy(data, a.RData[off+4:off+4+length])
+		opt.Options = append(opt.Options, EDNSOption{Code: code, Data: data})
+		off += 4 + length
+	}
+	return opt, nil
+}
+
+// toAnswer encodes o as the record that carries it on the wire.
+func (o *OPT) toAnswer() *Answer {
+	rdata := []byte{}
+	for _, option := range o.Options {
+		rdata = binary.BigEndian.AppendUint16(rdata, option.Code)
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(option.Data)))
+		rdata = append(rdata, option.Data...)
+	}
+	ttl := uint32(o.ExtendedRCode)<<24 | uint32(o.Version)<<16
+	if o.DNSSECOK {
+		ttl |= 0x8000
+	}
+	return &Answer{
+		Name:     "",
+		Type:     TypeOPT,
+		Class:    o.UDPSize,
+		TTL:      ttl,
+		RDLength: uint16(len(rdata)),
+		RData:    rdata,
+	}
+}
+
+// OPT returns the OPT record in the additional section of m, or nil if m does
+// not use EDNS.
+func (m *Message) OPT() (*OPT, error) {
+	for _, a := range m.Additional {
+		if a.Type == TypeOPT {
+			return parseOPT(a)
+		}
+	}
+	return nil, nil
+}
+
+// withoutOPT returns records minus any OPT records. OPT describes a single
+// hop, so the one an upstream sends us must not be relayed to the client.
+func withoutOPT(records []*Answer) []*Answer {
+	kept := make([]*Answer, 0, len(records))
+	for _, a := range records {
+		if a.Type != TypeOPT {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
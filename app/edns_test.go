@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// ednsQuery is a query for example.com A as dig sends it, with an EDNS0 OPT
+// record advertising a 4096 byte buffer and a cookie option.
+var ednsQuery = []byte{
+	0x5c, 0x3a, 0x01, 0x20, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+	0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+	0x00, 0x01, 0x00, 0x01,
+	0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c,
+	0x00, 0x0a, 0x00, 0x08, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+}
+
+func TestParseEDNSQuery(t *testing.T) {
+	msg, err := parseRequest(ednsQuery)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	opt, err := msg.OPT()
+	if err != nil {
+		t.Fatalf("OPT: %v", err)
+	}
+	if opt == nil {
+		t.Fatalf("no OPT record found")
+	}
+	want := &OPT{
+		UDPSize: 4096,
+		Options: []EDNSOption{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+	}
+	if !reflect.DeepEqual(opt, want) {
+		t.Fatalf("OPT = %+v, want %+v", opt, want)
+	}
+
+	// Encoding it again gives back the original record.
+	a := opt.toAnswer()
+	if a.Name != "" || a.Class != 4096 || !reflect.DeepEqual(a.RData, msg.Additional[0].RData) {
+		t.Fatalf("toAnswer = %+v, want %+v", a, msg.Additional[0])
+	}
+}
+
+func TestOPTFlags(t *testing.T) {
+	opt := &OPT{UDPSize: 1232, ExtendedRCode: 1, Version: 0, DNSSECOK: true}
+	got, err := parseOPT(opt.toAnswer())
+	if err != nil {
+		t.Fatalf("parseOPT: %v", err)
+	}
+	if !reflect.DeepEqual(got, opt) {
+		t.Fatalf("round trip = %+v, want %+v", got, opt)
+	}
+}
+
+func TestServerEchoesOPT(t *testing.T) {
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		// The upstream's own OPT must not reach the client.
+		resp.Additional = []*Answer{(&OPT{UDPSize: 1232}).toAnswer()}
+		return resp
+	})
+	s := newServer(testConfig(upstream))
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, ednsQuery))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if len(resp.Additional) != 1 {
+		t.Fatalf("got %d additional records, want our OPT only", len(resp.Additional))
+	}
+	opt, err := resp.OPT()
+	if err != nil || opt == nil || opt.UDPSize != ednsUDPSize {
+		t.Fatalf("response OPT = %+v, %v; want UDP size %d", opt, err, ednsUDPSize)
+	}
+
+	sent, err := upstream.seen()[0].OPT()
+	if err != nil || sent == nil || sent.UDPSize != ednsUDPSize {
+		t.Fatalf("upstream query OPT = %+v, %v; want UDP size %d", sent, err, ednsUDPSize)
+	}
+
+	// Without EDNS from the client there is no OPT in the response.
+	resp, err = parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 1, "example.org", TypeA)))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if len(resp.Additional) != 0 {
+		t.Fatalf("unexpected additional records %+v", resp.Additional)
+	}
+}
+
+func TestUDPResponseSize(t *testing.T) {
+	// About 1.6KB of answers once compressed, more than fits in 512 or
+	// 1232 bytes.
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		resp.Answer = manyAnswers(req.Question[0].Name, 100)
+		return resp
+	})
+	for _, tt := range []struct {
+		name          string
+		maxUDPSize    int
+		clientSize    uint16 // zero for a query without EDNS
+		limit         int
+		advertised    uint16
+		wantTruncated bool
+	}{
+		{"without EDNS", 0, 0, minUDPSize, 0, true},
+		{"client advertises 1232", 0, 1232, 1232, ednsUDPSize, true},
+		{"client advertises 4096", 0, 4096, ednsUDPSize, ednsUDPSize, false},
+		{"server capped at 1232", 1232, 4096, 1232, 1232, true},
+		{"client below the server cap", 1400, 1232, 1232, 1400, true},
+		{"client advertises less than 512", 1232, 256, minUDPSize, 1232, true},
+	} {
+		cfg := testConfig(upstream)
+		cfg.MaxUDPSize = tt.maxUDPSize
+		s := newServer(cfg)
+		query := &Message{
+			Header:   &Header{ID: 9, RecursionDesired: 1},
+			Question: []*Question{{Name: "big.example.com", Type: TypeA, Class: 1}},
+		}
+		if tt.clientSize != 0 {
+			query.Additional = []*Answer{(&OPT{UDPSize: tt.clientSize}).toAnswer()}
+		}
+		reply := s.answerRequest(context.Background(), clientAddr, mustBytes(t, query))
+		if len(reply) > tt.limit {
+			t.Errorf("%s: %d byte response, want at most %d", tt.name, len(reply), tt.limit)
+		}
+		resp, err := parseRequest(reply)
+		if err != nil {
+			t.Fatalf("%s: parseRequest: %v", tt.name, err)
+		}
+		if truncated := resp.Header.Truncation == 1; truncated != tt.wantTruncated || truncated == (len(resp.Answer) == 100) {
+			t.Errorf("%s: TC %v with %d answers, want TC %v", tt.name, truncated, len(resp.Answer), tt.wantTruncated)
+		}
+		opt, _ := resp.OPT()
+		switch {
+		case tt.advertised == 0 && opt != nil:
+			t.Errorf("%s: response to a query without EDNS has OPT %+v", tt.name, opt)
+		case tt.advertised != 0 && (opt == nil || opt.UDPSize != tt.advertised):
+			t.Errorf("%s: response advertises %+v, want UDP size %d", tt.name, opt, tt.advertised)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// classString returns the mnemonic for a record class.
+func classString(class uint16) string {
+	switch class {
+	case 1:
+		return "IN"
+	case 3:
+		return "CH"
+	case 4:
+		return "HS"
+	case 255:
+		return "ANY"
+	}
+	return fmt.Sprintf("CLASS%d", class)
+}
+
+// fqdn returns name with the trailing dot dig prints for absolute names.
+func fqdn(name string) string {
+	return name + "."
+}
+
+func (q *Question) String() string {
+	return fmt.Sprintf(";%s\t\t%s\t%s", fqdn(q.Name), classString(q.Class), q.Type)
+}
+
+func (a *Answer) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", fqdn(a.Name), a.TTL, classString(a.Class), a.Type, a.rdataString())
+}
+
+// rdataString renders RData in presentation format, falling back to the RFC
+// 3597 \# form for types it does not know or cannot decode. Names are decoded
+// from RData alone, which works for records that came through parseResponse
+// or were built locally, but not for compressed records straight out of
+// parseRequest.
+func (a *Answer) rdataString() string {
+	local := *a
+	local.RDataOffset = 0
+	var s string
+	var err error
+	switch a.Type {
+	case TypeA:
+		s, err = a.AString()
+	case TypeAAAA:
+		s, err = a.AAAAString()
+	case TypePTR:
+		s, err = parsePTR(a.RData, &local)
+		s = fqdn(s)
+	case TypeCNAME:
+		s, err = parseCNAME(a.RData, &local)
+		s = fqdn(s)
+	case TypeNS:
+		s, err = parseNS(a.RData, &local)
+		s = fqdn(s)
+	case TypeDNAME:
+		var dname *DNAMERecord
+		if dname, err = parseDNAME(a.RData, &local); err == nil {
+			s = fqdn(dname.Target)
+		}
+	case TypeMX:
+		var mx *MXRecord
+		if mx, err = parseMX(a.RData, &local); err == nil {
+			s = fmt.Sprintf("%d %s", mx.Preference, fqdn(mx.Exchange))
+		}
+	case TypeSRV:
+		var srv *SRVRecord
+		if srv, err = parseSRV(a.RData, &local); err == nil {
+			s = fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, fqdn(srv.Target))
+		}
+	case TypeSOA:
+		var soa *SOARecord
+		if soa, err = parseSOA(a.RData, &local); err == nil {
+			s = fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(soa.MName), fqdn(soa.RName),
+				soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum)
+		}
+	case TypeCAA:
+		var caa *CAARecord
+		if caa, err = parseCAA(a); err == nil {
+			s = fmt.Sprintf("%d %s %s", caa.Flags, caa.Tag, strconv.Quote(caa.Value))
+		}
+	case TypeNAPTR:
+		var naptr *NAPTRRecord
+		if naptr, err = parseNAPTR(a.RData, &local); err == nil {
+			s = fmt.Sprintf("%d %d %s %s %s %s", naptr.Order, naptr.Preference, strconv.Quote(naptr.Flags),
+				strconv.Quote(naptr.Services), strconv.Quote(naptr.Regexp), fqdn(naptr.Replacement))
+		}
+	case TypeHINFO:
+		var hinfo *HINFORecord
+		if hinfo, err = parseHINFO(a); err == nil {
+			s = strconv.Quote(hinfo.CPU) + " " + strconv.Quote(hinfo.OS)
+		}
+	case TypeTXT:
+		var strs []string
+		if strs, err = parseTXT(a); err == nil {
+			for i, str := range strs {
+				strs[i] = strconv.Quote(str)
+			}
+			s = strings.Join(strs, " ")
+		}
+	default:
+		err = errRecordType
+	}
+	if err != nil {
+		return fmt.Sprintf("\\# %d %s", len(a.RData), hex.EncodeToString(a.RData))
+	}
+	return s
+}
+
+func (h *Header) flagString() string {
+	flags := []string{}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", h.QRBit()},
+		{"aa", h.AABit()},
+		{"tc", h.TCBit()},
+		{"rd", h.RDBit()},
+		{"ra", h.RABit()},
+		{"ad", h.ADBit()},
+		{"cd", h.CDBit()},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return strings.Join(flags, " ")
+}
+
+// String renders m the way dig prints a response.
+func (m *Message) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", m.Header.OpCode, m.Header.ResponseCode, m.Header.ID)
+	fmt.Fprintf(&b, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		m.Header.flagString(), len(m.Question), len(m.Answer), len(m.Authority), len(m.Additional))
+	if len(m.Question) > 0 {
+		b.WriteString("\n;; QUESTION SECTION:\n")
+		for _, q := range m.Question {
+			fmt.Fprintln(&b, q)
+		}
+	}
+	for _, section := range []struct {
+		name    string
+		records []*Answer
+	}{
+		{"ANSWER", m.Answer},
+		{"AUTHORITY", m.Authority},
+		{"ADDITIONAL", m.Additional},
+	} {
+		if len(section.records) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n;; %s SECTION:\n", section.name)
+		for _, a := range section.records {
+			fmt.Fprintln(&b, a)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestMessageString(t *testing.T) {
+	msg, err := parseResponse(cnameResponse)
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	want := `;; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: 4660
+;; flags: qr rd ra; QUERY: 1, ANSWER: 2, AUTHORITY: 0, ADDITIONAL: 0
+
+;; QUESTION SECTION:
+;www.example.com.		IN	A
+
+;; ANSWER SECTION:
+www.example.com.	300	IN	CNAME	example.com.
+example.com.	300	IN	A	93.184.216.34
+`
+	if got := msg.String(); got != want {
+		t.Fatalf("String() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAnswerString(t *testing.T) {
+	msg, err := parseResponse(mxResponse)
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	nx, err := parseResponse(nxdomainResponse)
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	tests := []struct {
+		a    *Answer
+		want string
+	}{
+		{msg.Answer[0], "example.com.\t3600\tIN\tMX\t10 mail.example.com."},
+		{nx.Authority[0], "example.com.\t3600\tIN\tSOA\tns.icann.org. noc.dns.icann.org. 2024081501 7200 3600 1209600 3600"},
+		{&Answer{Name: "example.com", Type: TypeTXT, Class: 1, TTL: 60, RData: []byte("\x05hello\x05world")}, "example.com.\t60\tIN\tTXT\t\"hello\" \"world\""},
+		{&Answer{Name: "example.com", Type: TypeAAAA, Class: 1, TTL: 60, RDLength: 16, RData: make([]byte, 16)}, "example.com.\t60\tIN\tAAAA\t::"},
+		{&Answer{Name: "example.com", Type: 99, Class: 1, TTL: 60, RData: []byte{0xab, 0xcd}}, "example.com.\t60\tIN\tTYPE99\t\\# 2 abcd"},
+	}
+	for _, tt := range tests {
+		if got := tt.a.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
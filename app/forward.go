@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// errNoUpstreams is returned when there is nowhere to forward a query to.
+var errNoUpstreams = errors.New("no upstream resolvers configured")
+
+// errReplyMismatch is returned when an upstream reply is not for the query
+// that was sent, whether by mistake or because it was forged.
+var errReplyMismatch = errors.New("reply does not match the query")
+
+// errCacheOnly is returned in place of asking an upstream when the server
+// answers from its cache alone.
+var errCacheOnly = errors.New("not cached, and upstreams are not used")
+
+// forward sends req to the configured upstreams according to the configured
+// strategy.
+func (s *Server) forward(ctx context.Context, req *Message) (*Message, error) {
+	if len(s.config.Upstreams) == 0 {
+		return nil, errNoUpstreams
+	}
+	if s.config.Strategy == FanOut {
+		return s.forwardFanOut(ctx, req)
+	}
+	return s.forwardFailover(ctx, req)
+}
+
+// refusedReply reports whether resp is an upstream declining to answer
+// rather than an answer: SERVFAIL, REFUSED or NOTIMP. Another upstream may
+// well do better, so such replies are only relayed if none does.
+func refusedReply(resp *Message) bool {
+	switch resp.Header.ResponseCode {
+	case RCodeServFail, RCodeRefused, RCodeNotImp:
+		return true
+	}
+	return false
+}
+
+// forwardFailover tries each upstream in order and returns the first answer.
+// An upstream that replies with an error code is failed over from, and its
+// reply returned only if no later upstream answers.
+func (s *Server) forwardFailover(ctx context.Context, req *Message) (*Message, error) {
+	var fallback *Message
+	var err error
+	for _, upstream := range s.config.Upstreams {
+		var resp *Message
+		resp, err = s.queryUpstream(ctx, req, upstream)
+		if err == nil && !refusedReply(resp) {
+			return resp, nil
+		}
+		if err == nil {
+			slog.Warn("upstream failed", "upstream", upstream, "rcode", resp.Header.ResponseCode)
+			if fallback == nil {
+				fallback = resp
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		slog.Warn("upstream failed", "upstream", upstream, "err", err)
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, err
+}
+
+type upstreamResult struct {
+	resp *Message
+	err  error
+}
+
+// forwardFanOut sends req to every upstream at once and returns the first
+// successful answer. The queries that lose the race are cancelled. Replies
+// with an error code do not win: they are returned only once every upstream
+// has replied or failed without a better one.
+func (s *Server) forwardFanOut(ctx context.Context, req *Message) (*Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Buffered so the losers never block on send after we have returned.
+	results := make(chan upstreamResult, len(s.config.Upstreams))
+	for _, upstream := range s.config.Upstreams {
+		go func(upstream Upstream) {
+			// A panic here is out of reach of the request handler's
+			// recovery, so it fails this upstream alone.
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("panic querying upstream", "upstream", upstream, "panic", r, "stack", string(debug.Stack()))
+					results <- upstreamResult{nil, fmt.Errorf("upstream panic: %v", r)}
+				}
+			}()
+			resp, err := s.queryUpstream(ctx, req, upstream)
+			results <- upstreamResult{resp, err}
+		}(upstream)
+	}
+	var fallback *Message
+	var err error
+	for range s.config.Upstreams {
+		result := <-results
+		switch {
+		case result.err != nil:
+			err = result.err
+		case refusedReply(result.resp):
+			if fallback == nil {
+				fallback = result.resp
+			}
+		default:
+			return result.resp, nil
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, err
+}
+
+// queryUpstream exchanges req with upstream, retrying on failure as
+// configured after a pause that grows with each failure. Each attempt gets
+// the configured timeout, or the longer one upstream asks for, and there are
+// no more attempts once ctx is done.
+func (s *Server) queryUpstream(ctx context.Context, req *Message, upstream Upstream) (*Message, error) {
+	var resp *Message
+	var err error
+	for attempt := 0; attempt <= s.config.Retries; attempt++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		start := time.Now()
+		attemptCtx, cancel := context.WithTimeout(ctx, s.attemptTimeout(upstream))
+		resp, err = upstream.Exchange(attemptCtx, req)
+		cancel()
+		if err == nil {
+			err = checkReply(req, resp)
+		}
+		if err == nil {
+			s.metrics.observeUpstreamLatency(time.Since(start))
+			break
+		}
+		if ctx.Err() != nil {
+			// Given up on rather than failed, so not the upstream's
+			// fault.
+			return nil, err
+		}
+		s.metrics.upstreamErrors.Add(1)
+		slog.Warn("upstream query failed", "upstream", upstream, "attempt", attempt+1, "err", err)
+		if attempt < s.config.Retries {
+			if s.sleep(ctx, s.backoff.delay(attempt)) != nil {
+				return nil, err
+			}
+		}
+	}
+	return resp, err
+}
+
+// checkReply verifies that resp answers req: it must carry the same ID and
+// repeat the question exactly, down to the case of the name. Anything else is
+// rejected so that a stray or forged datagram cannot be relayed or cached.
+func checkReply(req, resp *Message) error {
+	if resp.Header.ID != req.Header.ID {
+		return fmt.Errorf("%w: sent ID %d, got %d", errReplyMismatch, req.Header.ID, resp.Header.ID)
+	}
+	if resp.Header.QR != 1 {
+		return fmt.Errorf("%w: got a query instead of a reply", errReplyMismatch)
+	}
+	if err := checkCase(req, resp); err != nil {
+		return err
+	}
+	want, got := req.Question[0], resp.Question[0]
+	if got.Type != want.Type || got.Class != want.Class {
+		return fmt.Errorf("%w: sent %s class %d, got %s class %d", errReplyMismatch, want.Type, want.Class, got.Type, got.Class)
+	}
+	return nil
+}
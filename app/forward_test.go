@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// answerAWith returns a handler answering every query with address ip after
+// waiting delay.
+func answerAWith(ip []byte, delay time.Duration) func(*Message) *Message {
+	return func(req *Message) *Message {
+		time.Sleep(delay)
+		resp := answerA(req)
+		resp.Answer[0].RData = ip
+		return resp
+	}
+}
+
+func TestFanOutUsesFastestUpstream(t *testing.T) {
+	slow := newMockUpstream(t, answerAWith([]byte{192, 0, 2, 1}, 500*time.Millisecond))
+	fast := newMockUpstream(t, answerAWith([]byte{192, 0, 2, 2}, 0))
+	cfg := testConfig(slow)
+	cfg.Upstreams = []Upstream{slow.upstream(), fast.upstream()}
+	cfg.Strategy = FanOut
+	s := newServer(cfg)
+
+	req := &Message{
+		Header:   &Header{ID: 1, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: 1, Class: 1}},
+	}
+	start := time.Now()
+	resp, err := s.forward(context.Background(), req)
+	if err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Fatalf("fan-out waited %v for the slow upstream", elapsed)
+	}
+	if !bytes.Equal(resp.Answer[0].RData, []byte{192, 0, 2, 2}) {
+		t.Fatalf("answer %v did not come from the fast upstream", resp.Answer[0].RData)
+	}
+	if len(fast.seen()) != 1 {
+		t.Fatalf("fast upstream saw %d queries, want 1", len(fast.seen()))
+	}
+}
+
+func TestFanOutCancelsLosers(t *testing.T) {
+	fast := newMockUpstream(t, answerA)
+	cancelled := make(chan struct{})
+	slow := upstreamFunc(func(ctx context.Context, req *Message) (*Message, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+	cfg := testConfig(fast)
+	cfg.Upstreams = []Upstream{slow, fast.upstream()}
+	cfg.Strategy = FanOut
+	cfg.Timeout = time.Hour
+	s := newServer(cfg)
+
+	req := &Message{
+		Header:   &Header{ID: 1, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	if _, err := s.forward(context.Background(), req); err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the losing query was not cancelled")
+	}
+}
+
+func TestFanOutSurvivesPanickingUpstream(t *testing.T) {
+	alive := newMockUpstream(t, answerAWith([]byte{192, 0, 2, 1}, 20*time.Millisecond))
+	panicking := upstreamFunc(func(ctx context.Context, req *Message) (*Message, error) {
+		panic("exchange bug")
+	})
+	cfg := testConfig(alive)
+	cfg.Upstreams = []Upstream{panicking, alive.upstream()}
+	cfg.Strategy = FanOut
+	s := newServer(cfg)
+
+	req := &Message{
+		Header:   &Header{ID: 1, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	resp, err := s.forward(context.Background(), req)
+	if err != nil || len(resp.Answer) != 1 {
+		t.Fatalf("got %+v, %v; want the other upstream's answer", resp, err)
+	}
+}
+
+func TestFailoverSkipsDeadUpstream(t *testing.T) {
+	dead := newMockUpstream(t, func(*Message) *Message { return nil })
+	alive := newMockUpstream(t, answerA)
+	cfg := testConfig(dead)
+	cfg.Upstreams = []Upstream{dead.upstream(), alive.upstream()}
+	cfg.Timeout = 50 * time.Millisecond
+	s := newServer(cfg)
+
+	req := &Message{
+		Header:   &Header{ID: 1, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: 1, Class: 1}},
+	}
+	resp, err := s.forward(context.Background(), req)
+	if err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("got %d answers, want 1", len(resp.Answer))
+	}
+	if len(dead.seen()) != 1 {
+		t.Fatalf("dead upstream saw %d queries, want 1", len(dead.seen()))
+	}
+}
+
+// answerRCode returns a handler replying to every query with rcode and no
+// records.
+func answerRCode(rcode RCode) func(*Message) *Message {
+	return func(req *Message) *Message {
+		resp := answerA(req)
+		resp.Answer = nil
+		resp.Header.ResponseCode = rcode
+		return resp
+	}
+}
+
+func TestFanOutPrefersAnswerToFastError(t *testing.T) {
+	failing := newMockUpstream(t, answerRCode(RCodeServFail))
+	slow := newMockUpstream(t, answerAWith([]byte{192, 0, 2, 1}, 100*time.Millisecond))
+	cfg := testConfig(failing)
+	cfg.Upstreams = []Upstream{failing.upstream(), slow.upstream()}
+	cfg.Strategy = FanOut
+	s := newServer(cfg)
+
+	req := &Message{
+		Header:   &Header{ID: 1, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	resp, err := s.forward(context.Background(), req)
+	if err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	if resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 1 {
+		t.Fatalf("got %s with %d answers, want the slower upstream's answer", resp.Header.ResponseCode, len(resp.Answer))
+	}
+}
+
+func TestFailoverPastErrorReplies(t *testing.T) {
+	for _, rcode := range []RCode{RCodeServFail, RCodeRefused, RCodeNotImp} {
+		failing := newMockUpstream(t, answerRCode(rcode))
+		alive := newMockUpstream(t, answerA)
+		cfg := testConfig(failing)
+		cfg.Upstreams = []Upstream{failing.upstream(), alive.upstream()}
+		s := newServer(cfg)
+
+		req := &Message{
+			Header:   &Header{ID: 1, RecursionDesired: 1},
+			Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		}
+		resp, err := s.forward(context.Background(), req)
+		if err != nil || resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 1 {
+			t.Fatalf("%s first: got %+v, %v; want the second upstream's answer", rcode, resp, err)
+		}
+	}
+}
+
+func TestErrorReplyReturnedWhenNothingBetter(t *testing.T) {
+	for _, strategy := range []UpstreamStrategy{Failover, FanOut} {
+		refusing := newMockUpstream(t, answerRCode(RCodeRefused))
+		dead := newMockUpstream(t, func(*Message) *Message { return nil })
+		cfg := testConfig(refusing)
+		cfg.Upstreams = []Upstream{refusing.upstream(), dead.upstream()}
+		cfg.Strategy = strategy
+		cfg.Timeout = 50 * time.Millisecond
+		s := newServer(cfg)
+
+		req := &Message{
+			Header:   &Header{ID: 1, RecursionDesired: 1},
+			Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		}
+		resp, err := s.forward(context.Background(), req)
+		if err != nil || resp.Header.ResponseCode != RCodeRefused {
+			t.Fatalf("strategy %d: got %+v, %v; want the REFUSED reply", strategy, resp, err)
+		}
+	}
+}
+
+func TestCheckReply(t *testing.T) {
+	req := &Message{
+		Header:   &Header{ID: 42},
+		Question: []*Question{{Name: "ExAmple.com", Type: TypeA, Class: 1}},
+	}
+	reply := func(edit func(*Message)) *Message {
+		resp := answerA(req)
+		resp.Question = []*Question{{Name: "ExAmple.com", Type: TypeA, Class: 1}}
+		edit(resp)
+		return resp
+	}
+	if err := checkReply(req, reply(func(*Message) {})); err != nil {
+		t.Fatalf("checkReply rejected a matching reply: %v", err)
+	}
+	for name, edit := range map[string]func(*Message){
+		"id":       func(m *Message) { m.Header.ID = 43 },
+		"qr":       func(m *Message) { m.Header.QR = 0 },
+		"name":     func(m *Message) { m.Question[0].Name = "other.com" },
+		"case":     func(m *Message) { m.Question[0].Name = "example.com" },
+		"type":     func(m *Message) { m.Question[0].Type = TypeAAAA },
+		"class":    func(m *Message) { m.Question[0].Class = 3 },
+		"question": func(m *Message) { m.Question = nil },
+	} {
+		if err := checkReply(req, reply(edit)); !errors.Is(err, errReplyMismatch) {
+			t.Errorf("mismatched %s: got err %v, want %v", name, err, errReplyMismatch)
+		}
+	}
+}
+
+func TestMismatchedReplyIsRetried(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		mu.Lock()
+		defer mu.Unlock()
+		if calls++; calls == 1 {
+			resp.Question = []*Question{{Name: req.Question[0].Name, Type: TypeMX, Class: 1}}
+		}
+		return resp
+	})
+	cfg := testConfig(upstream)
+	cfg.Retries = 1
+	s := newServer(cfg)
+
+	req := &Message{
+		Header:   &Header{ID: 9, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	resp, err := s.forward(context.Background(), req)
+	if err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	if resp.Question[0].Type != TypeA || len(upstream.seen()) != 2 {
+		t.Fatalf("got %s reply after %d queries, want the A reply after 2", resp.Question[0].Type, len(upstream.seen()))
+	}
+}
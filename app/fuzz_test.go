@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func FuzzParseRequest(f *testing.F) {
+	for _, seed := range [][]byte{
+		sampleResponse,
+		nxdomainResponse,
+		mxResponse,
+		srvResponse,
+		ednsQuery,
+		{0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01},
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		msg, err := parseRequest(packet)
+		if (msg == nil) == (err == nil) {
+			t.Fatalf("parseRequest returned message %v and error %v", msg, err)
+		}
+		if err != nil {
+			return
+		}
+		// Whatever parses must also survive the rest of the pipeline.
+		_ = msg.String()
+		for _, section := range [][]*Answer{msg.Answer, msg.Authority, msg.Additional} {
+			for _, a := range section {
+				expandNames(packet, a)
+			}
+		}
+	})
+}
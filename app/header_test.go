@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := []Header{
+		{},
+		{ID: 0xffff, QR: 1, OpCode: 15, AuthorativeAnswer: 1, Truncation: 1, RecursionDesired: 1, RecursionAvailable: 1, Reserved: 1, AuthenticData: 1, CheckingDisabled: 1, ResponseCode: 15, QuestionCount: 0xffff, AnswerRecordCount: 0xffff, AuthorativeRecordCount: 0xffff, AdditionalRecordCount: 0xffff},
+		{ID: 0x1234, QR: 1, OpCode: OpCodeStatus, ResponseCode: RCodeRefused},
+		{ID: 1, OpCode: 5, Reserved: 1},
+		{ID: 2, OpCode: 8, AuthenticData: 1, RecursionDesired: 1},
+		{ID: 3, OpCode: 13, CheckingDisabled: 1, Truncation: 1},
+		{ID: 4, AuthorativeAnswer: 1, ResponseCode: RCodeNXDomain, AnswerRecordCount: 2},
+	}
+	for _, h := range tests {
+		got := parseHeader(h.ToBytes())
+		if !reflect.DeepEqual(*got, h) {
+			t.Errorf("round trip of %+v gave %+v", h, *got)
+		}
+	}
+}
+
+// TestHeaderFlagsExhaustive walks every combination of the flag and code
+// fields, which is small enough to cover completely.
+func TestHeaderFlagsExhaustive(t *testing.T) {
+	for opcode := 0; opcode < 16; opcode++ {
+		for z := byte(0); z < 8; z++ {
+			for rcode := 0; rcode < 16; rcode++ {
+				for bits := 0; bits < 32; bits++ {
+					h := Header{
+						ID:                 uint16(opcode<<8 | rcode),
+						QR:                 byte(bits & 1),
+						OpCode:             OpCode(opcode),
+						AuthorativeAnswer:  byte(bits >> 1 & 1),
+						Truncation:         byte(bits >> 2 & 1),
+						RecursionDesired:   byte(bits >> 3 & 1),
+						RecursionAvailable: byte(bits >> 4 & 1),
+						Reserved:           z & 1,
+						AuthenticData:      z >> 1 & 1,
+						CheckingDisabled:   z >> 2 & 1,
+						ResponseCode:       RCode(rcode),
+					}
+					if got := parseHeader(h.ToBytes()); *got != h {
+						t.Fatalf("round trip of %+v gave %+v", h, *got)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestHeaderRandomRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	buf := make([]byte, 12)
+	for i := 0; i < 10000; i++ {
+		r.Read(buf)
+		if got := parseHeader(buf).ToBytes(); !reflect.DeepEqual(got, buf) {
+			t.Fatalf("header bytes %x came back as %x", buf, got)
+		}
+	}
+}
+
+func TestHeaderFieldsDoNotOverlap(t *testing.T) {
+	// Values too wide for their fields must not leak into other bits.
+	h := Header{QR: 0xfe, OpCode: 0xf0, AuthorativeAnswer: 2, Truncation: 2, RecursionDesired: 2, RecursionAvailable: 2, Reserved: 0xfe, AuthenticData: 2, CheckingDisabled: 2, ResponseCode: 0xf0}
+	buf := h.ToBytes()
+	if buf[2] != 0 || buf[3] != 0 {
+		t.Fatalf("flag bytes = %#02x %#02x, want 0 0", buf[2], buf[3])
+	}
+}
+
+func TestHeaderFlagAccessors(t *testing.T) {
+	var h Header
+	h.SetQR(true)
+	h.SetAA(true)
+	h.SetTC(true)
+	h.SetRD(true)
+	h.SetRA(true)
+	if buf := h.ToBytes(); buf[2] != 0x87 || buf[3] != 0x80 {
+		t.Fatalf("flag bytes = %#02x %#02x, want 0x87 0x80", buf[2], buf[3])
+	}
+	if !h.QRBit() || !h.AABit() || !h.TCBit() || !h.RDBit() || !h.RABit() {
+		t.Fatalf("flags not all set: %+v", h)
+	}
+	h.SetAA(false)
+	h.SetRD(false)
+	if buf := h.ToBytes(); buf[2] != 0x82 {
+		t.Fatalf("flag byte = %#02x, want 0x82", buf[2])
+	}
+
+	// Out-of-range values written directly count only by their low bit,
+	// in the getters and on the wire alike.
+	h = Header{QR: 2, AuthorativeAnswer: 3, Truncation: 0xfe, RecursionDesired: 0xff, RecursionAvailable: 4}
+	if h.QRBit() || !h.AABit() || h.TCBit() || !h.RDBit() || h.RABit() {
+		t.Fatalf("getters disagree with the low bits of %+v", h)
+	}
+	if buf := h.ToBytes(); buf[2] != 0x05 || buf[3] != 0 {
+		t.Fatalf("flag bytes = %#02x %#02x, want 0x05 0", buf[2], buf[3])
+	}
+	if got := parseHeader(h.ToBytes()); got.QR != 0 || got.AuthorativeAnswer != 1 || got.RecursionDesired != 1 {
+		t.Fatalf("parsed back as %+v", got)
+	}
+}
+
+func TestHeaderADAndCDBits(t *testing.T) {
+	// Flags of a validated answer to a DNSSEC-aware query: qr rd ra ad.
+	buf := []byte{0x12, 0x34, 0x81, 0xa0, 0, 1, 0, 1, 0, 0, 0, 1}
+	h := parseHeader(buf)
+	if h.AuthenticData != 1 || h.CheckingDisabled != 0 || h.Reserved != 0 {
+		t.Fatalf("parsed %+v, want only AD among the Z, AD and CD bits", h)
+	}
+	if got := h.ToBytes(); !reflect.DeepEqual(got, buf) {
+		t.Fatalf("round trip gave %x, want %x", got, buf)
+	}
+	if got := h.flagString(); got != "qr rd ra ad" {
+		t.Fatalf("flags = %q", got)
+	}
+
+	h.SetAD(false)
+	h.SetCD(true)
+	if got := h.ToBytes()[3]; got != 0x90 {
+		t.Fatalf("flag byte = %#02x, want 0x90", got)
+	}
+}
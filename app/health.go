@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// defaultHealthName is the name resolved to check that upstreams work.
+const defaultHealthName = "example.com"
+
+// checkHealth resolves the canary name through each upstream in turn and
+// returns nil as soon as one answers in time. Probes bypass the cache, the
+// retries and the metrics so that they say only whether an upstream is
+// reachable right now.
+func (s *Server) checkHealth(ctx context.Context) error {
+	if len(s.config.Upstreams) == 0 {
+		return errNoUpstreams
+	}
+	var err error
+	for _, upstream := range s.config.Upstreams {
+		req := &Message{
+			Header:   &Header{ID: randomID(), RecursionDesired: 1},
+			Question: []*Question{{Name: s.config.HealthName, Type: TypeA, Class: 1}},
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, s.attemptTimeout(upstream))
+		var resp *Message
+		resp, err = upstream.Exchange(probeCtx, req)
+		cancel()
+		if err == nil {
+			err = checkReply(req, resp)
+		}
+		if err == nil && resp.Header.ResponseCode == RCodeServFail {
+			err = fmt.Errorf("upstream answered %s", resp.Header.ResponseCode)
+		}
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("%s: %w", upstream, err)
+	}
+	return err
+}
+
+// serveHealth answers 200 if an upstream can resolve the canary name and
+// 503 otherwise, for load balancers and orchestrators to poll.
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := s.checkHealth(r.Context()); err != nil {
+		slog.Warn("health check failed", "name", s.config.HealthName, "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
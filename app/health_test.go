@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var silent atomic.Bool
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		if silent.Load() {
+			return nil
+		}
+		return answerA(req)
+	})
+	cfg := testConfig(upstream)
+	cfg.Timeout = 100 * time.Millisecond
+	cfg.HealthName = "canary.example"
+	s := newServer(cfg)
+
+	rec := httptest.NewRecorder()
+	s.serveHealth(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d with an answering upstream: %s", rec.Code, rec.Body)
+	}
+	seen := upstream.seen()
+	if len(seen) != 1 || seen[0].Question[0].Name != "canary.example" {
+		t.Fatalf("unexpected probes %+v", seen)
+	}
+
+	silent.Store(true)
+	rec = httptest.NewRecorder()
+	s.serveHealth(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d with a silent upstream, want 503", rec.Code)
+	}
+	if n := s.metrics.upstreamErrors.Load(); n != 0 {
+		t.Fatalf("probes counted %d upstream errors", n)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// errCNAMEChain is returned for a CNAME chain that loops or is longer than
+// maxCNAMEs.
+var errCNAMEChain = errors.New("CNAME chain too long or looping")
+
+// errLameDelegation is returned when iterative resolution cannot make
+// progress: a referral that does not lead closer to the name, or one whose
+// nameservers cannot be reached.
+var errLameDelegation = errors.New("lame delegation")
+
+// maxReferrals bounds the delegations followed for one question, and
+// maxGluelessDepth how many nameserver lookups may nest inside each other
+// when a referral comes without glue.
+const (
+	maxReferrals     = 16
+	maxGluelessDepth = 4
+)
+
+// maxCNAMEs bounds the CNAMEs followed for one question.
+const maxCNAMEs = 8
+
+// nameserverTimeout is how long to wait for each nameserver, so that one that
+// does not answer leaves time to try the others.
+const nameserverTimeout = 800 * time.Millisecond
+
+// iterativeTimeout bounds the whole resolution of a question, from the root
+// down and through any CNAMEs. It takes many round trips, so it gets longer
+// than the timeout for a single forwarded query.
+const iterativeTimeout = 10 * time.Second
+
+// rootServers are the IPv4 addresses of a.root-servers.net through
+// m.root-servers.net.
+var rootServers = []netip.Addr{
+	netip.MustParseAddr("198.41.0.4"),
+	netip.MustParseAddr("170.247.170.2"),
+	netip.MustParseAddr("192.33.4.12"),
+	netip.MustParseAddr("199.7.91.13"),
+	netip.MustParseAddr("192.203.230.10"),
+	netip.MustParseAddr("192.5.5.241"),
+	netip.MustParseAddr("192.112.36.4"),
+	netip.MustParseAddr("198.97.190.53"),
+	netip.MustParseAddr("192.36.148.17"),
+	netip.MustParseAddr("192.58.128.30"),
+	netip.MustParseAddr("193.0.14.129"),
+	netip.MustParseAddr("199.7.83.42"),
+	netip.MustParseAddr("202.12.27.33"),
+}
+
+// iterativeUpstream resolves queries itself instead of forwarding them: it
+// starts at the root servers and follows NS referrals down the tree, using
+// the glue in each referral, until a server answers for the name. It plugs in
+// as an Upstream so that caching, retries and reply checks work as they do
+// for forwarding.
+//
+// Only IPv4 nameserver addresses are used. CNAMEs are followed, as clients
+// relying on us for recursion expect, and the answer carries the whole
+// chain.
+type iterativeUpstream struct {
+	roots []netip.Addr
+	// dial connects to the nameserver at addr, replaceable in tests.
+	dial func(addr netip.Addr) (*net.UDPConn, error)
+	// minimize asks each server only for the NS records of the name one
+	// label below the zone it serves (RFC 7816), instead of telling every
+	// server on the way the full name.
+	minimize bool
+}
+
+func newIterativeUpstream(minimize bool) *iterativeUpstream {
+	return &iterativeUpstream{roots: rootServers, dial: dialNameserver, minimize: minimize}
+}
+
+// dialNameserver connects to port 53 at addr.
+func dialNameserver(addr netip.Addr) (*net.UDPConn, error) {
+	return net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, 53)))
+}
+
+// Exchange resolves the question in req, waiting at most nameserverTimeout
+// for each nameserver on the way and iterativeTimeout for the whole.
+func (u *iterativeUpstream) Exchange(ctx context.Context, req *Message) (*Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, iterativeTimeout)
+	defer cancel()
+	resp, err := u.resolve(ctx, req, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp, err = u.followCNAMEs(ctx, req, resp); err != nil {
+		return nil, err
+	}
+	// The answer comes from an authoritative server, but the client gets
+	// it from a recursive one.
+	header := *resp.Header
+	header.ID = req.Header.ID
+	header.SetRD(req.Header.RDBit())
+	header.SetAA(false)
+	resp.Header = &header
+	return resp, nil
+}
+
+// timeout gives queryUpstream iterativeTimeout for each attempt.
+func (u *iterativeUpstream) timeout() time.Duration {
+	return iterativeTimeout
+}
+
+// followCNAMEs resolves the target of the CNAME chain resp starts for the
+// question of req, if resp has no records of the type asked for at the end
+// of it, and so on until there are, or there is no further CNAME. The
+// answers of every step are put together, and the rest of the response is
+// that of the last step (RFC 6604).
+func (u *iterativeUpstream) followCNAMEs(ctx context.Context, req *Message, resp *Message) (*Message, error) {
+	q := req.Question[0]
+	if q.Type == TypeCNAME || q.Type == TypeANY {
+		return resp, nil
+	}
+	answers := resp.Answer
+	name := strings.ToLower(q.Name)
+	seen := map[string]bool{name: true}
+	for {
+		target, final := chaseCNAMEs(resp.Answer, name, q.Type, seen)
+		if target == "" {
+			return nil, fmt.Errorf("%w: at %s", errCNAMEChain, name)
+		}
+		if final || target == name {
+			break
+		}
+		if len(seen)-1 > maxCNAMEs {
+			return nil, fmt.Errorf("%w: more than %d for %s", errCNAMEChain, maxCNAMEs, q.Name)
+		}
+		slog.Debug("following CNAME", "name", q.Name, "target", target)
+		next := &Message{
+			Header:     req.Header,
+			Question:   []*Question{{Name: target, Type: q.Type, Class: q.Class}},
+			Additional: req.Additional,
+		}
+		var err error
+		if resp, err = u.resolve(ctx, next, 0); err != nil {
+			return nil, err
+		}
+		answers = append(answers, resp.Answer...)
+		name = target
+	}
+	return &Message{
+		Header:     resp.Header,
+		Question:   req.Question,
+		Answer:     answers,
+		Authority:  resp.Authority,
+		Additional: resp.Additional,
+	}, nil
+}
+
+// chaseCNAMEs follows the CNAMEs in answers from the lowercase name, adding
+// each name it reaches to seen, and returns the name at the end of the chain
+// and whether answers have records of type qtype for it. The name is empty
+// if the chain comes back to a name in seen.
+func chaseCNAMEs(answers []*Answer, name string, qtype Type, seen map[string]bool) (string, bool) {
+	for {
+		var next string
+		for _, a := range answers {
+			if !strings.EqualFold(a.Name, name) {
+				continue
+			}
+			if a.Type == qtype {
+				return name, true
+			}
+			if a.Type != TypeCNAME {
+				continue
+			}
+			// Relayed records have their names expanded, so the
+			// target can be decoded from its RData alone.
+			local := *a
+			local.RDataOffset = 0
+			if target, err := parseCNAME(a.RData, &local); err == nil {
+				next = strings.ToLower(target)
+			}
+		}
+		if next == "" {
+			return name, false
+		}
+		if seen[next] {
+			return "", false
+		}
+		seen[next] = true
+		name = next
+	}
+}
+
+func (u *iterativeUpstream) String() string {
+	return "iterative"
+}
+
+// resolve follows referrals from the root down until a server answers req.
+// depth counts the glueless nameserver lookups this one is nested in.
+//
+// With minimize set, the servers of each zone are asked about one more label
+// of the name at a time, until they refer to a child zone or the whole name
+// is asked. below is the part of the name known to be served by the current
+// servers.
+func (u *iterativeUpstream) resolve(ctx context.Context, req *Message, depth int) (*Message, error) {
+	name := strings.ToLower(req.Question[0].Name)
+	servers, zone, below := u.roots, "", ""
+	minimize := u.minimize
+	for referrals := 0; referrals < maxReferrals; {
+		query, minimized := req, false
+		if qname := nextLabel(name, below); minimize && qname != name {
+			query, minimized = minimalQuery(req, qname), true
+		}
+		resp, err := u.ask(ctx, servers, query)
+		if err != nil {
+			return nil, err
+		}
+		child, nameservers := referral(resp)
+		if nameservers == nil && minimized {
+			if resp.Header.ResponseCode == RCodeNoError {
+				// No zone cut there, so the same servers are asked
+				// about the next label.
+				below = query.Question[0].Name
+			} else {
+				// Some servers deny names that only have names below
+				// them, so those get asked the full name.
+				minimize = false
+			}
+			continue
+		}
+		if nameservers == nil {
+			return resp, nil
+		}
+		// Each referral must lead strictly closer to the name, or a
+		// misconfigured or malicious server could keep us going in
+		// circles.
+		if child == zone || !inZone(child, zone) || !inZone(name, child) {
+			return nil, fmt.Errorf("%w: %s referred %s to %q", errLameDelegation, zonePrintable(zone), name, child)
+		}
+		addrs := glue(resp, nameservers, zone)
+		if len(addrs) == 0 {
+			addrs = u.lookupNameservers(ctx, nameservers, depth)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("%w: no address for any nameserver of %s", errLameDelegation, child)
+		}
+		slog.Debug("following referral", "name", name, "zone", child, "nameservers", nameservers)
+		servers, zone, below = addrs, child, child
+		referrals++
+	}
+	return nil, fmt.Errorf("%w: more than %d referrals for %s", errLameDelegation, maxReferrals, name)
+}
+
+// nextLabel returns the lowercase name one label longer than zone, an
+// ancestor of it, on the way down to name, or name itself if it is zone.
+func nextLabel(name, zone string) string {
+	if name == zone {
+		return name
+	}
+	prefix := name
+	if zone != "" {
+		prefix = strings.TrimSuffix(name, "."+zone)
+	}
+	return name[strings.LastIndexByte(prefix, '.')+1:]
+}
+
+// minimalQuery returns a query for the NS records of qname, in place of req.
+func minimalQuery(req *Message, qname string) *Message {
+	return &Message{
+		Header:     req.Header,
+		Question:   []*Question{{Name: qname, Type: TypeNS, Class: req.Question[0].Class}},
+		Additional: req.Additional,
+	}
+}
+
+// ask sends req without the RD bit to each of servers in turn and returns the
+// first reply that matches it.
+func (u *iterativeUpstream) ask(ctx context.Context, servers []netip.Addr, req *Message) (*Message, error) {
+	err := errNoUpstreams
+	for _, server := range servers {
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx)
+		}
+		header := *req.Header
+		header.ID = randomID()
+		header.SetRD(false)
+		query := &Message{Header: &header, Question: req.Question, Additional: req.Additional}
+
+		var conn *net.UDPConn
+		if conn, err = u.dial(server); err != nil {
+			continue
+		}
+		serverCtx, cancel := context.WithTimeout(ctx, nameserverTimeout)
+		var resp *Message
+		resp, err = exchange(serverCtx, query, conn)
+		cancel()
+		conn.Close()
+		if err == nil {
+			err = checkReply(query, resp)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		slog.Debug("nameserver query failed", "server", server, "name", req.Question[0].Name, "err", err)
+	}
+	return nil, err
+}
+
+// referral returns the zone resp delegates to and the host names of its
+// nameservers, or no nameservers if resp is an answer rather than a referral.
+func referral(resp *Message) (string, []string) {
+	if resp.Header.ResponseCode != RCodeNoError || resp.Header.AuthorativeAnswer == 1 || len(resp.Answer) > 0 {
+		return "", nil
+	}
+	var zone string
+	var nameservers []string
+	for _, a := range resp.Authority {
+		if a.Type != TypeNS {
+			continue
+		}
+		owner := strings.ToLower(a.Name)
+		if nameservers != nil && owner != zone {
+			continue
+		}
+		// Relayed records have their names expanded, so the NS target
+		// can be decoded from its RData alone.
+		local := *a
+		local.RDataOffset = 0
+		host, err := parseNS(a.RData, &local)
+		if err != nil {
+			continue
+		}
+		zone = owner
+		nameservers = append(nameservers, strings.ToLower(host))
+	}
+	return zone, nameservers
+}
+
+// glue returns the addresses the additional section of resp gives for
+// nameservers. Only records within zone, the one the answering server is
+// authoritative for, are believed.
+func glue(resp *Message, nameservers []string, zone string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, a := range resp.Additional {
+		owner := strings.ToLower(a.Name)
+		if a.Type != TypeA || len(a.RData) != 4 || !inZone(owner, zone) {
+			continue
+		}
+		for _, ns := range nameservers {
+			if owner == ns {
+				addrs = append(addrs, netip.AddrFrom4([4]byte(a.RData)))
+				break
+			}
+		}
+	}
+	return addrs
+}
+
+// lookupNameservers resolves the A records of nameservers, for referrals that
+// come without glue, stopping at the first nameserver that has any.
+func (u *iterativeUpstream) lookupNameservers(ctx context.Context, nameservers []string, depth int) []netip.Addr {
+	if depth >= maxGluelessDepth {
+		return nil
+	}
+	for _, ns := range nameservers {
+		req := &Message{
+			Header:   &Header{ID: randomID()},
+			Question: []*Question{{Name: ns, Type: TypeA, Class: 1}},
+		}
+		resp, err := u.resolve(ctx, req, depth+1)
+		if err != nil {
+			slog.Debug("looking up nameserver failed", "nameserver", ns, "err", err)
+			continue
+		}
+		var addrs []netip.Addr
+		for _, a := range resp.Answer {
+			if a.Type == TypeA && len(a.RData) == 4 {
+				addrs = append(addrs, netip.AddrFrom4([4]byte(a.RData)))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+	return nil
+}
+
+// inZone reports whether the lowercase name is zone or below it. The root
+// zone is the empty string.
+func inZone(name, zone string) bool {
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// zonePrintable names zone in messages, where the root would otherwise be
+// blank.
+func zonePrintable(zone string) string {
+	if zone == "" {
+		return "the root"
+	}
+	return zone
+}
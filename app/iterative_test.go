@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nameRData encodes name uncompressed, as it appears in the RData of an NS
+// record.
+func nameRData(t *testing.T, name string) []byte {
+	t.Helper()
+	w := newNameWriter(false, len(name)+2)
+	if err := w.writeName(name); err != nil {
+		t.Fatalf("writeName: %v", err)
+	}
+	return w.buf
+}
+
+// referTo returns a handler that delegates every query to zone, served by ns
+// at addr.
+func referTo(t *testing.T, zone, ns string, addr netip.Addr) func(req *Message) *Message {
+	rdata := nameRData(t, ns)
+	return func(req *Message) *Message {
+		header := *req.Header
+		header.QR = 1
+		return &Message{
+			Header:   &header,
+			Question: req.Question,
+			Authority: []*Answer{
+				{Name: zone, Type: TypeNS, Class: 1, TTL: 172800, RDLength: uint16(len(rdata)), RData: rdata},
+			},
+			Additional: []*Answer{
+				{Name: ns, Type: TypeA, Class: 1, TTL: 172800, RDLength: 4, RData: addr.AsSlice()},
+			},
+		}
+	}
+}
+
+// delegation is a root server that delegates com, a com server that
+// delegates example.com and an example.com server that answers, each given
+// a documentation address that dial maps to its mock. comHandler replaces the
+// com server's referral, and exampleHandler the example.com server's A
+// records, if they are not nil.
+type delegation struct {
+	root, com, example *mockUpstream
+	upstream           *iterativeUpstream
+}
+
+func newDelegation(t *testing.T, comHandler, exampleHandler func(req *Message) *Message) *delegation {
+	rootAddr := netip.MustParseAddr("192.0.2.1")
+	comAddr := netip.MustParseAddr("192.0.2.2")
+	exampleAddr := netip.MustParseAddr("192.0.2.3")
+	if comHandler == nil {
+		comHandler = referTo(t, "example.com", "ns1.example.com", exampleAddr)
+	}
+	if exampleHandler == nil {
+		exampleHandler = func(req *Message) *Message {
+			resp := answerA(req)
+			resp.Header.AuthorativeAnswer = 1
+			return resp
+		}
+	}
+	d := &delegation{
+		root:    newMockUpstream(t, referTo(t, "com", "a.gtld-servers.net", comAddr)),
+		com:     newMockUpstream(t, comHandler),
+		example: newMockUpstream(t, exampleHandler),
+	}
+	mocks := map[netip.Addr]*mockUpstream{rootAddr: d.root, comAddr: d.com, exampleAddr: d.example}
+	d.upstream = &iterativeUpstream{
+		roots: []netip.Addr{rootAddr},
+		dial: func(addr netip.Addr) (*net.UDPConn, error) {
+			mock, ok := mocks[addr]
+			if !ok {
+				t.Errorf("dialed unknown nameserver %s", addr)
+				return nil, errors.New("unknown nameserver")
+			}
+			return net.DialUDP("udp", nil, mock.addr())
+		},
+	}
+	return d
+}
+
+func TestIterativeResolution(t *testing.T) {
+	d := newDelegation(t, nil, nil)
+	upstream := newMockUpstream(t, answerA)
+	cfg := testConfig(upstream)
+	cfg.Upstreams = []Upstream{d.upstream}
+	s := newServer(cfg)
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 0x4242, "www.example.com", TypeA)))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Header.ID != 0x4242 || resp.Header.ResponseCode != RCodeNoError || resp.Header.AuthorativeAnswer != 0 {
+		t.Fatalf("response header %+v", resp.Header)
+	}
+	if len(resp.Answer) != 1 || !bytes.Equal(resp.Answer[0].RData, []byte{192, 0, 2, 1}) {
+		t.Fatalf("answers %+v, want the example.com server's A record", resp.Answer)
+	}
+	for _, mock := range []*mockUpstream{d.root, d.com, d.example} {
+		seen := mock.seen()
+		if len(seen) != 1 {
+			t.Fatalf("nameserver saw %d queries, want 1", len(seen))
+		}
+		if seen[0].Header.RecursionDesired != 0 {
+			t.Errorf("iterative query asked for recursion")
+		}
+		if !strings.EqualFold(seen[0].Question[0].Name, "www.example.com") {
+			t.Errorf("nameserver was asked about %s", seen[0].Question[0].Name)
+		}
+	}
+	if n := len(upstream.seen()); n != 0 {
+		t.Fatalf("query was forwarded %d times", n)
+	}
+}
+
+func TestIterativeRejectsLameReferral(t *testing.T) {
+	// A com server that refers back up to com would loop forever.
+	d := newDelegation(t, referTo(t, "com", "a.gtld-servers.net", netip.MustParseAddr("192.0.2.2")), nil)
+
+	req := &Message{
+		Header:   &Header{ID: 1},
+		Question: []*Question{{Name: "www.example.com", Type: TypeA, Class: 1}},
+	}
+	if _, err := d.upstream.Exchange(withTimeout(t, time.Second), req); !errors.Is(err, errLameDelegation) {
+		t.Fatalf("got err %v, want %v", err, errLameDelegation)
+	}
+}
+
+func TestNextLabel(t *testing.T) {
+	for _, tt := range []struct{ name, zone, want string }{
+		{"www.example.com", "", "com"},
+		{"www.example.com", "com", "example.com"},
+		{"www.example.com", "example.com", "www.example.com"},
+		{"www.example.com", "www.example.com", "www.example.com"},
+		{"com", "", "com"},
+		{"", "", ""},
+	} {
+		if got := nextLabel(tt.name, tt.zone); got != tt.want {
+			t.Errorf("nextLabel(%q, %q) = %q, want %q", tt.name, tt.zone, got, tt.want)
+		}
+	}
+}
+
+// asked returns the questions mock was sent, as name and type.
+func asked(mock *mockUpstream) []string {
+	var questions []string
+	for _, query := range mock.seen() {
+		q := query.Question[0]
+		questions = append(questions, strings.ToLower(q.Name)+" "+q.Type.String())
+	}
+	return questions
+}
+
+func TestQNAMEMinimization(t *testing.T) {
+	d := newDelegation(t, nil, nil)
+	d.upstream.minimize = true
+	req := &Message{
+		Header:   &Header{ID: 1},
+		Question: []*Question{{Name: "a.b.www.example.com", Type: TypeA, Class: 1}},
+	}
+	resp, err := d.upstream.Exchange(withTimeout(t, time.Second), req)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if len(resp.Answer) != 1 || resp.Question[0].Name != "a.b.www.example.com" {
+		t.Fatalf("got %s", resp)
+	}
+
+	// Each tier learns only the next label, and the example.com server,
+	// which has no zone cuts below it, is walked down to the full name.
+	for _, tt := range []struct {
+		tier string
+		mock *mockUpstream
+		want []string
+	}{
+		{"root", d.root, []string{"com NS"}},
+		{"com", d.com, []string{"example.com NS"}},
+		{"example.com", d.example, []string{"www.example.com NS", "b.www.example.com NS", "a.b.www.example.com A"}},
+	} {
+		if got := asked(tt.mock); strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+			t.Errorf("%s server was asked %v, want %v", tt.tier, got, tt.want)
+		}
+	}
+}
+
+func TestQNAMEMinimizationFallsBack(t *testing.T) {
+	// A com server that wrongly answers NXDOMAIN for names that only
+	// have names below them.
+	refer := referTo(t, "example.com", "ns1.example.com", netip.MustParseAddr("192.0.2.3"))
+	d := newDelegation(t, func(req *Message) *Message {
+		if req.Question[0].Type == TypeNS {
+			resp := answerA(req)
+			resp.Answer = nil
+			resp.Header.ResponseCode = RCodeNXDomain
+			return resp
+		}
+		return refer(req)
+	}, nil)
+	d.upstream.minimize = true
+	req := &Message{
+		Header:   &Header{ID: 1},
+		Question: []*Question{{Name: "www.example.com", Type: TypeA, Class: 1}},
+	}
+	if _, err := d.upstream.Exchange(withTimeout(t, time.Second), req); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if got, want := asked(d.com), []string{"example.com NS", "www.example.com A"}; strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("com server was asked %v, want %v", got, want)
+	}
+	if got, want := asked(d.example), []string{"www.example.com A"}; strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("example.com server was asked %v, want %v", got, want)
+	}
+}
+
+// cnames returns a handler for an authoritative server with the CNAMEs in
+// aliases, lowercase owner to target, that answers A for every other name.
+func cnames(t *testing.T, aliases map[string]string) func(req *Message) *Message {
+	return func(req *Message) *Message {
+		resp := answerA(req)
+		resp.Header.AuthorativeAnswer = 1
+		name := req.Question[0].Name
+		if target, ok := aliases[strings.ToLower(name)]; ok {
+			rdata := nameRData(t, target)
+			resp.Answer = []*Answer{{Name: name, Type: TypeCNAME, Class: 1, TTL: 300, RDLength: uint16(len(rdata)), RData: rdata}}
+		}
+		return resp
+	}
+}
+
+func TestIterativeFollowsCNAMEs(t *testing.T) {
+	d := newDelegation(t, nil, cnames(t, map[string]string{
+		"www.example.com": "web.example.com",
+		"web.example.com": "host.example.com",
+	}))
+	req := &Message{
+		Header:   &Header{ID: 1},
+		Question: []*Question{{Name: "www.example.com", Type: TypeA, Class: 1}},
+	}
+	resp, err := d.upstream.Exchange(withTimeout(t, time.Second), req)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	var got []string
+	for _, a := range resp.Answer {
+		got = append(got, strings.ToLower(a.Name)+" "+a.Type.String())
+	}
+	want := []string{"www.example.com CNAME", "web.example.com CNAME", "host.example.com A"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("answers %v, want %v", got, want)
+	}
+	if resp.Question[0].Name != "www.example.com" || resp.Header.ID != 1 {
+		t.Fatalf("response is for %s, ID %d", resp.Question[0].Name, resp.Header.ID)
+	}
+}
+
+func TestIterativeRejectsCNAMELoop(t *testing.T) {
+	d := newDelegation(t, nil, cnames(t, map[string]string{
+		"a.example.com": "b.example.com",
+		"b.example.com": "a.example.com",
+	}))
+	req := &Message{
+		Header:   &Header{ID: 1},
+		Question: []*Question{{Name: "a.example.com", Type: TypeA, Class: 1}},
+	}
+	if _, err := d.upstream.Exchange(withTimeout(t, time.Second), req); !errors.Is(err, errCNAMEChain) {
+		t.Fatalf("got err %v, want %v", err, errCNAMEChain)
+	}
+}
+
+func TestIterativeGetsItsOwnTimeout(t *testing.T) {
+	d := newDelegation(t, nil, nil)
+	forwarder := newMockUpstream(t, answerA)
+	s := newServer(testConfig(forwarder))
+	if got := s.attemptTimeout(d.upstream); got != iterativeTimeout {
+		t.Errorf("iterative attempts get %v, want %v", got, iterativeTimeout)
+	}
+	if got := s.attemptTimeout(forwarder.upstream()); got != time.Second {
+		t.Errorf("forwarded attempts get %v, want the configured second", got)
+	}
+}
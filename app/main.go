@@ -1,25 +1,77 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// errTruncated is returned when a length or offset in a message points past
+// the end of the buffer.
+var errTruncated = errors.New("message truncated")
+
+// errLabelTooLong and errNameTooLong are returned when serializing a name
+// that does not fit the limits of RFC 1035 2.3.4, and errEmptyLabel for one
+// with an empty label other than the root.
+var (
+	errLabelTooLong = errors.New("label longer than 63 bytes")
+	errNameTooLong  = errors.New("name longer than 255 bytes")
+	errEmptyLabel   = errors.New("name has an empty label")
+)
+
+// errPointerLoop is returned when a name follows more compression pointers
+// than any well-formed name could need, which means the pointers form a cycle.
+var errPointerLoop = errors.New("too many compression pointers")
+
+// errShortHeader is returned for a message too short to hold a header.
+var errShortHeader = errors.New("message shorter than a header")
+
+// errBadCounts is returned when the section counts in a header claim more
+// records than the message could possibly hold.
+var errBadCounts = errors.New("section counts do not fit the message")
+
+// maxQuestions is the most questions a message may carry. Real queries have
+// exactly one, so anything near the 65535 the header allows is an attack.
+const maxQuestions = 8
+
+// Every question takes at least 5 bytes (a root name, type and class) and
+// every resource record at least 11 (adding TTL and RDLENGTH).
+const (
+	minQuestionSize = 5
+	minRecordSize   = 11
+)
+
+// maxPointerFollows bounds the number of compression pointers followed while
+// decoding a single name. Names are at most 255 bytes and every pointer target
+// has to contribute at least one label, so this is never hit by valid input.
+const maxPointerFollows = 127
+
 type Header struct {
 	ID uint16 // 16 bits
 	// Query/Response indicator
 	QR                     byte   // 1 bit
-	OpCode                 byte   // 4 bits
+	OpCode                 OpCode // 4 bits
 	AuthorativeAnswer      byte   // 1 bit
 	Truncation             byte   // 1 bit
 	RecursionDesired       byte   // 1 bit
 	RecursionAvailable     byte   // 1 bit
-	Reserved               byte   // 3 bits
-	ResponseCode           byte   // 4 bits
+	Reserved               byte   // 1 bit, the Z bit
+	AuthenticData          byte   // 1 bit, AD (RFC 4035)
+	CheckingDisabled       byte   // 1 bit, CD (RFC 4035)
+	ResponseCode           RCode  // 4 bits
 	QuestionCount          uint16 // 16 bits
 	AnswerRecordCount      uint16 // 16 bits
 	AuthorativeRecordCount uint16 // 16 bits
@@ -30,30 +82,90 @@ type Message struct {
 	Header     *Header
 	Question   []*Question
 	Answer     []*Answer
-	Authority  byte
-	Additional byte
+	Authority  []*Answer
+	Additional []*Answer
 }
 
 type Answer struct {
 	Name     string
-	Type     uint16
+	Type     Type
 	Class    uint16
 	TTL      uint32
 	RDLength uint16
 	RData    []byte
+	// RDataOffset is where RData starts in the message the Answer was parsed
+	// from. Names inside RData may be compressed pointers into that message,
+	// so decoding them needs both the original buffer and this offset.
+	RDataOffset int
 }
 
 type Question struct {
 	Name  string
-	Type  uint16
+	Type  Type
 	Class uint16
 }
 
+// The one-bit flags are plain bytes so that headers can be written as
+// literals, but only their low bit is meaningful. The accessors below read
+// and write just that bit, which is also all ToBytes puts on the wire.
+
+// bit returns set as a flag value.
+func bit(set bool) byte {
+	if set {
+		return 1
+	}
+	return 0
+}
+
+// QRBit reports whether the message is a response.
+func (h *Header) QRBit() bool { return h.QR&1 == 1 }
+
+// AABit reports whether the answer is authoritative.
+func (h *Header) AABit() bool { return h.AuthorativeAnswer&1 == 1 }
+
+// TCBit reports whether the message was truncated.
+func (h *Header) TCBit() bool { return h.Truncation&1 == 1 }
+
+// RDBit reports whether recursion is desired.
+func (h *Header) RDBit() bool { return h.RecursionDesired&1 == 1 }
+
+// RABit reports whether recursion is available.
+func (h *Header) RABit() bool { return h.RecursionAvailable&1 == 1 }
+
+// ADBit reports whether the answer is authenticated (RFC 4035 3.2.3).
+func (h *Header) ADBit() bool { return h.AuthenticData&1 == 1 }
+
+// CDBit reports whether checking is disabled (RFC 4035 3.2.2).
+func (h *Header) CDBit() bool { return h.CheckingDisabled&1 == 1 }
+
+// SetQR marks the message as a response, or as a query.
+func (h *Header) SetQR(set bool) { h.QR = bit(set) }
+
+// SetAA sets or clears the authoritative answer flag.
+func (h *Header) SetAA(set bool) { h.AuthorativeAnswer = bit(set) }
+
+// SetTC sets or clears the truncation flag.
+func (h *Header) SetTC(set bool) { h.Truncation = bit(set) }
+
+// SetRD sets or clears the recursion desired flag.
+func (h *Header) SetRD(set bool) { h.RecursionDesired = bit(set) }
+
+// SetRA sets or clears the recursion available flag.
+func (h *Header) SetRA(set bool) { h.RecursionAvailable = bit(set) }
+
+// SetAD sets or clears the authentic data flag.
+func (h *Header) SetAD(set bool) { h.AuthenticData = bit(set) }
+
+// SetCD sets or clears the checking disabled flag.
+func (h *Header) SetCD(set bool) { h.CheckingDisabled = bit(set) }
+
 func (h *Header) ToBytes() []byte {
 	buf := make([]byte, 12)
 	binary.BigEndian.PutUint16(buf[:2], uint16(h.ID))
-	buf[2] = h.QR<<7 | h.OpCode<<3 | h.AuthorativeAnswer<<2 | h.Truncation<<1 | h.RecursionDesired
-	buf[3] = h.RecursionAvailable<<7 | h.Reserved<<4 | h.ResponseCode
+	// The codes are masked to their widths so an out-of-range value cannot
+	// spill into the neighbouring fields.
+	buf[2] = bit(h.QRBit())<<7 | byte(h.OpCode)&0x0F<<3 | bit(h.AABit())<<2 | bit(h.TCBit())<<1 | bit(h.RDBit())
+	buf[3] = bit(h.RABit())<<7 | h.Reserved&1<<6 | bit(h.ADBit())<<5 | bit(h.CDBit())<<4 | byte(h.ResponseCode)&0x0F
 	binary.BigEndian.PutUint16(buf[4:6], h.QuestionCount)
 	binary.BigEndian.PutUint16(buf[6:8], h.AnswerRecordCount)
 	binary.BigEndian.PutUint16(buf[8:10], h.AuthorativeRecordCount)
@@ -61,64 +173,114 @@ func (h *Header) ToBytes() []byte {
 	return buf
 }
 
-func (q *Question) ToBytes() []byte {
-	labels := strings.Split(q.Name, ".")
-	bufsize := 0
-	for _, label := range labels {
-		bufsize += len(label) + 1
+// nameLabels splits a dotted name into its labels. The root name, written as
+// either "" or ".", has no labels at all, and a trailing dot is ignored.
+func nameLabels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
 	}
-	bufsize += 5
-	buf := make([]byte, bufsize)
-	copied := 0
-	for _, label := range labels {
-		buf[copied] = byte(len(label))
-		copied++
-		copy(buf[copied:], label)
-		copied += len(label)
-	}
-	buf[copied] = 0
-	copied++
-	binary.BigEndian.PutUint16(buf[copied:copied+2], q.Type)
-	binary.BigEndian.PutUint16(buf[copied+2:copied+4], q.Class)
-	return buf
+	return strings.Split(name, ".")
 }
 
-func (a *Answer) ToBytes() []byte {
-	labels := strings.Split(a.Name, ".")
-	bufsize := 0
-	for _, label := range labels {
-		bufsize += len(label) + 1
+// nameWireLen returns how many bytes name takes on the wire uncompressed: a
+// length octet and the bytes of each label, then the root label. Each dot
+// stands in for the length octet of the label after it, so no splitting is
+// needed.
+func nameWireLen(name string) int {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return 1
 	}
-	bufsize += len(a.RData) + 11
-	buf := make([]byte, bufsize)
-	copied := 0
+	return len(name) + 2
+}
+
+// validateName checks that name can be encoded on the wire: no label may be
+// empty, as in "a..b", since a zero length octet would end the name there,
+// or longer than 63 bytes, and the encoded name, including the length
+// octets and the root label, no longer than 255.
+func validateName(name string) error {
+	labels := nameLabels(name)
 	for _, label := range labels {
-		buf[copied] = byte(len(label))
-		copied++
-		copy(buf[copied:], label)
-		copied += len(label)
-	}
-	buf[copied] = 0
-	copied++
-	binary.BigEndian.PutUint16(buf[copied:copied+2], a.Type)
-	binary.BigEndian.PutUint16(buf[copied+2:copied+4], a.Class)
-	binary.BigEndian.PutUint32(buf[copied+4:copied+8], a.TTL)
-	binary.BigEndian.PutUint16(buf[copied+8:copied+10], a.RDLength)
-	copy(buf[copied+10:], a.RData)
-	return buf
+		if label == "" {
+			return fmt.Errorf("%w: %q", errEmptyLabel, name)
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("%w: %q", errLabelTooLong, label)
+		}
+	}
+	if size := nameWireLen(name); size > 255 {
+		return fmt.Errorf("%w: %d bytes", errNameTooLong, size)
+	}
+	return nil
+}
+
+// NewQuestion returns a question for name, which is lowercased and loses any
+// trailing dot, after checking with validateName that it can be sent. "."
+// and "" both name the root.
+func NewQuestion(name string, qtype Type, qclass uint16) (*Question, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return &Question{Name: name, Type: qtype, Class: qclass}, nil
+}
+
+// Labels returns the labels of the question's name, as they are written on
+// the wire.
+func (q *Question) Labels() []string {
+	return nameLabels(q.Name)
+}
+
+// WireLen returns the length of the question as ToBytes writes it, with its
+// name uncompressed.
+func (q *Question) WireLen() int {
+	return nameWireLen(q.Name) + 4
+}
+
+// ToBytes serializes q on its own, with its name uncompressed.
+func (q *Question) ToBytes() ([]byte, error) {
+	w := newNameWriter(false, q.WireLen())
+	if err := w.writeQuestion(q); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+// Labels returns the labels of the record's owner name, as they are written
+// on the wire.
+func (a *Answer) Labels() []string {
+	return nameLabels(a.Name)
+}
+
+// WireLen returns the length of the record as ToBytes writes it, with its
+// owner name uncompressed. Names inside RData count as they are stored.
+func (a *Answer) WireLen() int {
+	return nameWireLen(a.Name) + 10 + len(a.RData)
+}
+
+// ToBytes serializes a on its own, with its owner name uncompressed.
+func (a *Answer) ToBytes() ([]byte, error) {
+	w := newNameWriter(false, a.WireLen())
+	if err := w.writeAnswer(a); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
 }
 
 func parseHeader(buf []byte) *Header {
 	header := Header{}
 	header.ID = binary.BigEndian.Uint16(buf[:2])
 	header.QR = buf[2] >> 7
-	header.OpCode = buf[2] >> 3 & 0x0F
+	header.OpCode = OpCode(buf[2] >> 3 & 0x0F)
 	header.AuthorativeAnswer = buf[2] >> 2 & 0x01
 	header.Truncation = buf[2] >> 1 & 0x01
 	header.RecursionDesired = buf[2] & 0x01
 	header.RecursionAvailable = buf[3] >> 7
-	header.Reserved = buf[3] >> 4 & 0x07
-	header.ResponseCode = buf[3] & 0x0F
+	header.Reserved = buf[3] >> 6 & 0x01
+	header.AuthenticData = buf[3] >> 5 & 0x01
+	header.CheckingDisabled = buf[3] >> 4 & 0x01
+	header.ResponseCode = RCode(buf[3] & 0x0F)
 	header.QuestionCount = binary.BigEndian.Uint16(buf[4:6])
 	header.AnswerRecordCount = binary.BigEndian.Uint16(buf[6:8])
 	header.AuthorativeRecordCount = binary.BigEndian.Uint16(buf[8:10])
@@ -126,194 +288,935 @@ func parseHeader(buf []byte) *Header {
 	return &header
 }
 
-func parseLabels(buf []byte, start int) ([]string, int) {
+func parseLabels(buf []byte, start int) ([]string, int, error) {
+	return parseLabelsFollow(buf, start, 0)
+}
+
+func parseLabelsFollow(buf []byte, start int, follows int) ([]string, int, error) {
 	labels := []string{}
 	i := start
-	for buf[i] != 0 {
+	for {
+		if i >= len(buf) {
+			return nil, 0, errTruncated
+		}
+		if buf[i] == 0 {
+			break
+		}
 		labelLength := int(buf[i])
 		if labelLength >= 0xC0 {
-			fmt.Printf("pointer: %d\n", i)
+			if i+2 > len(buf) {
+				return nil, 0, errTruncated
+			}
+			if follows >= maxPointerFollows {
+				return nil, 0, errPointerLoop
+			}
 			offset := int(binary.BigEndian.Uint16(buf[i:i+2]) & 0x3FFF)
-			labels_, _ := parseLabels(buf, offset)
+			labels_, _, err := parseLabelsFollow(buf, offset, follows+1)
+			if err != nil {
+				return nil, 0, err
+			}
 			labels = append(labels, labels_...)
-			fmt.Printf("pointer labels: %+v\n", labels)
-			return labels, i + 2
+			return labels, i + 2, nil
+		}
+		if i+1+labelLength > len(buf) {
+			return nil, 0, errTruncated
 		}
 		label := string(buf[i+1 : i+1+labelLength])
 		labels = append(labels, label)
 		i += labelLength + 1
 	}
-	fmt.Printf("labels: %+v\n", labels)
-	return labels, i + 1
+	return labels, i + 1, nil
 }
 
-func parseQuestion(buf []byte, start int) (*Question, int) {
+func parseQuestion(buf []byte, start int) (*Question, int, error) {
 	question := Question{}
-	labels, i := parseLabels(buf, start)
+	labels, i, err := parseLabels(buf, start)
+	if err != nil {
+		return nil, 0, err
+	}
+	if i+4 > len(buf) {
+		return nil, 0, errTruncated
+	}
 	question.Name = strings.Join(labels, ".")
-	question.Type = binary.BigEndian.Uint16(buf[i : i+2])
+	question.Type = Type(binary.BigEndian.Uint16(buf[i : i+2]))
 	question.Class = binary.BigEndian.Uint16(buf[i+2 : i+4])
-	return &question, i + 4
+	return &question, i + 4, nil
 }
 
-func parseAnswer(buf []byte, ansStart int) *Answer {
+func parseAnswer(buf []byte, ansStart int) (*Answer, int, error) {
 	answer := Answer{}
-	labels, i := parseLabels(buf, ansStart)
+	labels, i, err := parseLabels(buf, ansStart)
+	if err != nil {
+		return nil, 0, err
+	}
+	if i+10 > len(buf) {
+		return nil, 0, errTruncated
+	}
 	answer.Name = strings.Join(labels, ".")
-	answer.Type = binary.BigEndian.Uint16(buf[i : i+2])
+	answer.Type = Type(binary.BigEndian.Uint16(buf[i : i+2]))
 	answer.Class = binary.BigEndian.Uint16(buf[i+2 : i+4])
 	answer.TTL = binary.BigEndian.Uint32(buf[i+4 : i+8])
 	answer.RDLength = binary.BigEndian.Uint16(buf[i+8 : i+10])
-	answer.RData = buf[i+10 : i+10+int(answer.RDLength)]
-	return &answer
+	end := i + 10 + int(answer.RDLength)
+	if end > len(buf) {
+		return nil, 0, errTruncated
+	}
+	// Copy RData so the parsed Answer does not alias buf, which the caller
+	// may reuse for the next packet.
+	answer.RData = make([]byte, answer.RDLength)
+	copy(answer.RData, buf[i+10:end])
+	answer.RDataOffset = i + 10
+	return &answer, end, nil
+}
+
+// parseSection parses count resource records starting at start. The answer,
+// authority and additional sections all share this wire format.
+func parseSection(buf []byte, start int, count int) ([]*Answer, int, error) {
+	records := make([]*Answer, 0)
+	for i := 0; i < count; i++ {
+		record, next, err := parseAnswer(buf, start)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, record)
+		start = next
+	}
+	return records, start, nil
+}
+
+// checkCounts rejects a header whose counts cannot be right for a message of
+// size bytes, before any work is spent on parsing the sections.
+func checkCounts(header *Header, size int) error {
+	if header.QuestionCount > maxQuestions {
+		return fmt.Errorf("%w: %d questions", errBadCounts, header.QuestionCount)
+	}
+	records := int(header.AnswerRecordCount) + int(header.AuthorativeRecordCount) + int(header.AdditionalRecordCount)
+	if need := 12 + int(header.QuestionCount)*minQuestionSize + records*minRecordSize; need > size {
+		return fmt.Errorf("%w, %w: need at least %d bytes, have %d", errBadCounts, errTruncated, need, size)
+	}
+	return nil
 }
 
 func parseRequest(request []byte) (*Message, error) {
+	if len(request) < 12 {
+		return nil, fmt.Errorf("%w, %w: %d bytes", errShortHeader, errTruncated, len(request))
+	}
 	header := parseHeader(request)
+	if err := checkCounts(header, len(request)); err != nil {
+		return nil, err
+	}
 	questions := make([]*Question, 0)
 	nextStart := 12
 	var question *Question
-	answers := make([]*Answer, 0)
+	var err error
 	for i := 0; i < int(header.QuestionCount); i++ {
-		question, nextStart = parseQuestion(request, nextStart)
+		question, nextStart, err = parseQuestion(request, nextStart)
+		if err != nil {
+			return nil, err
+		}
 		questions = append(questions, question)
 	}
-	answerCount := int(header.AnswerRecordCount)
-	for i := 0; i < answerCount; i++ {
-		answers = append(answers, parseAnswer(request, nextStart))
+	answers, nextStart, err := parseSection(request, nextStart, int(header.AnswerRecordCount))
+	if err != nil {
+		return nil, err
+	}
+	authority, nextStart, err := parseSection(request, nextStart, int(header.AuthorativeRecordCount))
+	if err != nil {
+		return nil, err
+	}
+	additional, _, err := parseSection(request, nextStart, int(header.AdditionalRecordCount))
+	if err != nil {
+		return nil, err
 	}
 	return &Message{
-		Header:   header,
-		Question: questions,
-		Answer:   answers,
+		Header:     header,
+		Question:   questions,
+		Answer:     answers,
+		Authority:  authority,
+		Additional: additional,
 	}, nil
 }
 
-func queryDNS(msg *Message, udpConn *net.UDPConn) ([]byte, error) {
-	// serialize the message
-	buf := make([]byte, 1024*10)
-	copied := 0
-	copy(buf[copied:], msg.Header.ToBytes())
-	copied += 12
-	q := msg.Question[0]
-	copy(buf[copied:], q.ToBytes())
-	copied += len(q.ToBytes())
-	_, err := udpConn.Write(buf[:copied])
+// queryDNS sends msg over udpConn and waits for the reply, which is read into
+// buf, until ctx is done.
+func queryDNS(ctx context.Context, msg *Message, udpConn *net.UDPConn, buf []byte) ([]byte, error) {
+	req, err := msg.ToBytes()
 	if err != nil {
 		return nil, err
 	}
-	n, err := udpConn.Read(buf)
+	defer bindConn(ctx, udpConn)()
+	_, err = udpConn.Write(req)
+	if err == nil {
+		var n int
+		if n, err = udpConn.Read(buf); err == nil {
+			return buf[:n], nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
+	}
+	return nil, err
+}
+
+// exchange sends req to the upstream behind udpConn and parses the reply. If
+// the upstream sets the TC bit the query is repeated over TCP to the same
+// address; should that fail too, the truncated reply is returned as is so the
+// TC bit reaches the client.
+func exchange(ctx context.Context, req *Message, udpConn *net.UDPConn) (*Message, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	resp, err := queryDNS(ctx, req, udpConn, *buf)
 	if err != nil {
 		return nil, err
 	}
-	return buf[:n], nil
+	return parseUDPReply(ctx, req, resp, udpConn.RemoteAddr())
 }
 
-func handleConnection(conn *net.UDPConn) {
-	buf := make([]byte, 2048)
-	// read from udp with buffer
+// parseUDPReply parses the reply to req received over UDP from upstream, and
+// repeats the query over TCP if the reply was truncated.
+func parseUDPReply(ctx context.Context, req *Message, resp []byte, upstream net.Addr) (*Message, error) {
+	slog.Debug("upstream reply", "upstream", upstream, "bytes", len(resp))
+	// The read buffers are a byte longer than ednsUDPSize, so a reply that
+	// filled one was cut short by the read and is larger than we asked for.
+	if len(resp) > ednsUDPSize {
+		return nil, fmt.Errorf("%w: more than the %d bytes advertised", errReplyTooLarge, ednsUDPSize)
+	}
+	respMsg, err := parseResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if respMsg.Header.Truncation == 0 {
+		return respMsg, nil
+	}
 
-	_, source, err := conn.ReadFromUDP(buf)
+	resp, err = queryDNSTCP(ctx, req, upstream.String())
 	if err != nil {
-		fmt.Println("Error receiving data:", err)
-		return
+		slog.Warn("retrying truncated reply over TCP failed", "upstream", upstream, "err", err)
+		return respMsg, nil
 	}
+	tcpMsg, err := parseResponse(resp)
+	if err != nil {
+		slog.Warn("parsing TCP reply failed", "upstream", upstream, "err", err)
+		return respMsg, nil
+	}
+	return tcpMsg, nil
+}
 
-	// Create an empty response
-	msg, err := parseRequest(buf)
-	for _, question := range msg.Question {
-		fmt.Printf("question: %+v\n", question)
+// parseResponse parses an upstream response and expands any compressed names
+// in its RData so the records can be relayed or cached on their own.
+func parseResponse(resp []byte) (*Message, error) {
+	msg, err := parseRequest(resp)
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range [][]*Answer{msg.Answer, msg.Authority, msg.Additional} {
+		for _, a := range section {
+			if err := expandNames(resp, a); err != nil {
+				return nil, err
+			}
+		}
 	}
+	return msg, nil
+}
+
+// servfail builds a SERVFAIL response to req, so that a client whose query
+// could not be resolved hears about it instead of waiting for its own timeout.
+func servfail(req *Message) []byte {
+	return errorResponse(req, RCodeServFail)
+}
+
+// errorResponse builds an answerless response to req with the given rcode,
+// echoing its question when possible.
+func errorResponse(req *Message, rcode RCode) []byte {
+	header := *req.Header
+	header.SetQR(true)
+	header.SetRA(true)
+	header.ResponseCode = rcode
+	resp := &Message{
+		Header:   &header,
+		Question: req.Question,
+	}
+	response, err := resp.ToBytes()
 	if err != nil {
-		fmt.Println("Error parsing request:", err)
-		return
+		// The question could not be echoed, so answer without it.
+		resp.Question = nil
+		response, _ = resp.ToBytes()
 	}
+	return response
+}
 
-	// FIXME: this shouldn't be done here
-	addressStr := strings.Split(os.Args[1], ":")
-	port, err := strconv.Atoi(addressStr[1])
+// listen binds the UDP socket and TCP listener the server answers on, both
+// at addr. If addr asks for an ephemeral port, TCP uses the port UDP got.
+func listen(addr *net.UDPAddr) (*net.UDPConn, *net.TCPListener, error) {
+	udpConn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		fmt.Println("Error parsing port:", err)
-		return
+		return nil, nil, bindError(err)
 	}
+	bound := udpConn.LocalAddr().(*net.UDPAddr)
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: bound.IP, Port: bound.Port, Zone: bound.Zone})
+	if err != nil {
+		udpConn.Close()
+		return nil, nil, bindError(err)
+	}
+	return udpConn, tcpListener, nil
+}
 
-	forwardConn, err := net.DialUDP("udp", nil, &net.UDPAddr{
-		IP:   net.ParseIP(addressStr[0]),
-		Port: port,
-	})
+// listenAll binds a UDP socket and a TCP listener at each of addrs. If any
+// address fails, everything bound so far is closed again.
+func listenAll(addrs []*net.UDPAddr) ([]*net.UDPConn, []*net.TCPListener, error) {
+	var udpConns []*net.UDPConn
+	var tcpListeners []*net.TCPListener
+	for _, addr := range addrs {
+		udpConn, tcpListener, err := listen(addr)
+		if err != nil {
+			for i := range udpConns {
+				udpConns[i].Close()
+				tcpListeners[i].Close()
+			}
+			return nil, nil, fmt.Errorf("%s: %w", addr, err)
+		}
+		udpConns = append(udpConns, udpConn)
+		tcpListeners = append(tcpListeners, tcpListener)
+	}
+	return udpConns, tcpListeners, nil
+}
+
+// serve answers queries on every socket and listener, each from its own
+// loop, until all of them are closed. It then waits for the requests already
+// received to be answered, so that nothing is logged or dumped after it
+// returns. An idle TCP connection holds it up until tcpIdleTimeout.
+func (s *Server) serve(udpConns []*net.UDPConn, tcpListeners []*net.TCPListener) {
+	var wg sync.WaitGroup
+	for _, conn := range udpConns {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			s.serveUDP(conn)
+		}(conn)
+	}
+	for _, listener := range tcpListeners {
+		wg.Add(1)
+		go func(listener *net.TCPListener) {
+			defer wg.Done()
+			s.serveTCP(listener)
+		}(listener)
+	}
+	wg.Wait()
+	s.handlers.Wait()
+}
 
+// bindError explains the most common reason binding fails.
+func bindError(err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("%w (ports below 1024 need root or CAP_NET_BIND_SERVICE)", err)
+	}
+	return err
+}
+
+// Server holds the state shared by every request handler.
+type Server struct {
+	config  *Config
+	cache   *Cache
+	pending *pendingQueries
+	metrics *Metrics
+	limiter *rateLimiter
+	flights *flightGroup
+	// cookieSecret keys the server cookies given to clients.
+	cookieSecret []byte
+	// backoff paces retries of upstream queries, and sleep waits out each
+	// pause.
+	backoff backoff
+	sleep   func(ctx context.Context, d time.Duration) error
+	// queryLog records every query answered, when configured.
+	queryLog *queryLog
+	// dump records every UDP datagram received and sent, when configured.
+	dump *packetDump
+	// rotation counts responses, for RoundRobin.
+	rotation atomic.Uint32
+	// refreshing holds the cacheKeys of the answers being refreshed in
+	// the background.
+	refreshing sync.Map
+	// handlers counts the UDP requests and TCP connections being handled,
+	// so that serve can wait for them.
+	handlers sync.WaitGroup
+}
+
+func newServer(cfg *Config) *Server {
+	s := &Server{
+		config:  cfg,
+		cache:   newCache(cfg.CacheSize),
+		pending: newPendingQueries(),
+		metrics: newMetrics(),
+		flights: newFlightGroup(),
+
+		cookieSecret: newCookieSecret(),
+		backoff: backoff{
+			base:       cfg.RetryDelay,
+			multiplier: max(cfg.RetryMultiplier, 1),
+			max:        cfg.MaxRetryDelay,
+			jitter:     rand.Float64,
+		},
+		sleep: sleepContext,
+	}
+	s.metrics.cacheSize = s.cache.Len
+	s.cache.staleFor = cfg.ServeStale
+	s.cache.prefetchHits = cfg.Prefetch
+	s.cache.ttlJitter = cfg.TTLJitter
+	s.cache.minTTL, s.cache.maxTTL = cfg.MinTTL, cfg.MaxTTL
+	if cfg.RateLimit > 0 {
+		s.limiter = newRateLimiter(cfg.RateLimit)
+	}
+	return s
+}
+
+// handleConnection answers a single request received from source on conn.
+// It runs on its own goroutine, so request must not be shared with the read
+// loop.
+func (s *Server) handleConnection(conn *net.UDPConn, source *net.UDPAddr, request []byte) {
+	defer recoverPanic(source, nil)
+	local, _ := conn.LocalAddr().(*net.UDPAddr)
+	if err := s.dump.write(source, local, request); err != nil {
+		slog.Warn("dumping request failed", "err", err)
+	}
+	response := s.answerRequest(context.Background(), source, request)
+	if response == nil {
+		return
+	}
+	_, err := conn.WriteToUDP(response, source)
 	if err != nil {
-		fmt.Println("Error connecting to DNS server:", err)
+		slog.Error("sending response failed", "client", source, "err", err)
 		return
 	}
+	if err := s.dump.write(local, source, response); err != nil {
+		slog.Warn("dumping response failed", "err", err)
+	}
+}
+
+// answerRequest parses request, forwards its questions upstream and returns
+// the serialized response, or nil if the request should be dropped. It is
+// shared by the UDP and TCP listeners.
+//
+// Few resolvers accept more than one question per message, so each question
+// is resolved on its own, under its own copy of the client's header, and the
+// sections of the replies are merged into a single response.
+//
+// Responses to UDP clients are cut down to the size the client can receive,
+// with TC set when that loses records; TCP responses are sent whole.
+//
+// Upstream queries made on the request's behalf are abandoned once ctx is
+// done.
+func (s *Server) answerRequest(ctx context.Context, source net.Addr, request []byte) (reply []byte) {
+	s.metrics.queries.Add(1)
+	if !s.config.allows(source) {
+		slog.Warn("refusing client outside the allowed networks", "client", source)
+		if msg, err := parseRequest(request); err == nil {
+			return errorResponse(msg, RCodeRefused)
+		}
+		return nil
+	}
+	if !s.limiter.allow(clientIP(source)) {
+		// Dropped rather than refused so that a spoofed source gets
+		// nothing back, which is the point when this is abuse.
+		slog.Debug("dropping query over the rate limit", "client", source)
+		return nil
+	}
+	msg, err := parseRequest(request)
+	if errors.Is(err, errShortHeader) {
+		// Without the two ID bytes the client could not match a
+		// reply to its query, so there is no point sending one.
+		if len(request) < 2 {
+			slog.Warn("dropping request without an ID", "client", source, "packet", fmt.Sprintf("%x", request))
+			return nil
+		}
+		slog.Warn("rejecting short request", "client", source, "err", err)
+		id := binary.BigEndian.Uint16(request[:2])
+		return errorResponse(&Message{Header: &Header{ID: id}}, RCodeFormErr)
+	}
+	if errors.Is(err, errBadCounts) {
+		slog.Warn("rejecting request with bad section counts", "client", source, "err", err)
+		return errorResponse(&Message{Header: parseHeader(request)}, RCodeFormErr)
+	}
+	if err != nil {
+		slog.Warn("dropping unparsable request", "client", source, "err", err, "packet", fmt.Sprintf("%x", request))
+		return nil
+	}
+	for _, question := range msg.Question {
+		slog.Debug("question", "client", source, "name", question.Name, "type", question.Type)
+	}
+	// Logged last, once any panic below has turned into a SERVFAIL reply.
+	cached := len(msg.Question) > 0
+	if s.queryLog != nil {
+		defer func() { s.logQuery(source, msg, reply, cached) }()
+	}
+	// Once the request has parsed, every failure is answered with SERVFAIL
+	// so the client hears about it at once instead of timing out, even
+	// when the failure is a bug.
+	defer recoverPanic(source, func() { reply = servfail(msg) })
+	// Only standard queries are answered. The others, such as NOTIFY and
+	// UPDATE, are meant for the zone's own servers and go nowhere else.
+	if msg.Header.OpCode != OpCodeQuery {
+		cached = false
+		return errorResponse(msg, RCodeNotImp)
+	}
+
 	answers := make([]*Answer, 0)
-	questions := make([]*Question, 0)
+	authority := make([]*Answer, 0)
+	additional := make([]*Answer, 0)
+	truncated := false
+	authoritative := len(msg.Question) > 0
+	authenticated := len(msg.Question) > 0
+	rcode := RCodeNoError
+	clientOPT, _ := msg.OPT()
+	if malformedCookie(clientOPT) {
+		slog.Warn("rejecting request with a malformed cookie", "client", source)
+		return errorResponse(msg, RCodeFormErr)
+	}
+	cookie, validCookie := s.cookieOption(clientOPT, source)
+	if _, udp := source.(*net.UDPAddr); udp && s.config.RequireCookies && !validCookie {
+		return s.cookieRequired(msg, clientOPT, cookie)
+	}
+	subnet := s.clientSubnet(clientOPT)
+	if subnet != nil && checkSubnet(subnet) != nil {
+		slog.Warn("rejecting request with a malformed client subnet", "client", source)
+		return errorResponse(msg, RCodeFormErr)
+	}
+	// The upstream's reply to a passed subnet says, in its scope, how
+	// widely the answer applies, which the client needs to cache it.
+	var subnetReply *EDNSOption
+	dnssecOK := clientOPT != nil && clientOPT.DNSSECOK
 
 	for _, question := range msg.Question {
-		fmt.Printf("question: %+v\n", question)
-		header := msg.Header
-		header.QuestionCount = 1
-		header.AnswerRecordCount = 0
-		req := &Message{
-			Header:   header,
-			Question: []*Question{question},
+		respMsg, hit, err := s.resolve(ctx, source, msg.Header, question, subnet, dnssecOK)
+		if err == nil {
+			var aHit bool
+			respMsg, aHit, err = s.dns64(ctx, source, msg.Header, question, subnet, dnssecOK, respMsg)
+			hit = hit && aHit
 		}
-		resp, err := queryDNS(req, forwardConn)
 		if err != nil {
-			fmt.Println("Error querying DNS:", err)
-			return
+			// Misses are the normal case in cache-only mode, not errors.
+			level := slog.LevelError
+			if errors.Is(err, errCacheOnly) {
+				level = slog.LevelDebug
+			}
+			slog.Log(ctx, level, "resolving failed", "name", question.Name, "type", question.Type, "err", err)
+			return servfail(msg)
 		}
-		fmt.Printf("resp: %+v\n", resp)
-		respMsg, err := parseRequest(resp)
-		if err != nil {
-			fmt.Println("Error parsing response:", err)
-			return
+		cached = cached && hit
+		if respMsg.Header.Truncation == 1 {
+			truncated = true
+		}
+		if respMsg.Header.AuthorativeAnswer == 0 {
+			authoritative = false
+		}
+		if !respMsg.Header.ADBit() {
+			authenticated = false
+		}
+		if rcode == RCodeNoError {
+			rcode = respMsg.Header.ResponseCode
+		}
+		if upstreamOPT, _ := respMsg.OPT(); subnet != nil && subnetReply == nil {
+			subnetReply = upstreamOPT.option(optionClientSubnet)
 		}
-		questions = append(questions, respMsg.Question...)
 		answers = append(answers, respMsg.Answer...)
+		authority = append(authority, respMsg.Authority...)
+		additional = append(additional, withoutOPT(respMsg.Additional)...)
 	}
-	response := make([]byte, 12)
-	msg.Header.QR = 1
-	msg.Header.ResponseCode = 0
-	if msg.Header.OpCode != 0 {
-		msg.Header.ResponseCode = 4
+	if clientOPT != nil {
+		opt := &OPT{UDPSize: uint16(s.maxUDPSize())}
+		if cookie != nil {
+			opt.Options = append(opt.Options, *cookie)
+		}
+		if subnetReply != nil {
+			opt.Options = append(opt.Options, *subnetReply)
+		}
+		additional = append(additional, opt.toAnswer())
 	}
-	msg.Header.QuestionCount = uint16(len(questions))
-	msg.Header.AnswerRecordCount = uint16(len(answers))
-	copy(response, msg.Header.ToBytes())
-	copied := 12
-	for _, question := range questions {
-		response = append(response, question.ToBytes()...)
-		copied += len(question.ToBytes())
+	if s.config.RoundRobin {
+		rotateAddresses(answers, s.rotation.Add(1))
 	}
-	for _, answer := range answers {
-		fmt.Printf("answer: %+v\n", answer)
-		response = append(response, answer.ToBytes()...)
-		copied += len(answer.ToBytes())
+	// The response keeps the client's header, RD included, but always
+	// advertises recursion since every query can be forwarded upstream.
+	msg.Header.SetQR(true)
+	msg.Header.SetRA(true)
+	msg.Header.ResponseCode = rcode
+	msg.Header.SetTC(truncated)
+	msg.Header.SetAA(authoritative)
+	// AD is only passed on to clients that show they understand it by
+	// setting AD or DO in their query (RFC 6840 section 5.8). CD stays as
+	// the client sent it.
+	msg.Header.SetAD(authenticated && (msg.Header.ADBit() || clientOPT != nil && clientOPT.DNSSECOK))
+	// The client's own question is echoed rather than the one each part
+	// was answered for, which strict clients compare against their query
+	// down to the case of the name.
+	resp := &Message{
+		Header:     msg.Header,
+		Question:   msg.Question,
+		Answer:     answers,
+		Authority:  authority,
+		Additional: additional,
+	}
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		slog.Debug("response", "client", source, "message", resp.String())
+	}
+	var response []byte
+	if _, ok := source.(*net.UDPAddr); ok {
+		response, err = resp.packWithin(udpResponseLimit(clientOPT, s.maxUDPSize()))
+	} else {
+		response, err = resp.ToCompressedBytes()
 	}
-	fmt.Printf("response: %+v\n", response)
-
-	_, err = conn.WriteToUDP(response, source)
 	if err != nil {
-		fmt.Println("Failed to send response:", err)
+		slog.Error("serializing response failed", "client", source, "err", err)
+		return servfail(msg)
 	}
+	return response
 }
 
-func main() {
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
+// udpResponseLimit returns the largest UDP response a client can take: 512
+// bytes, or as much as its OPT record advertises up to limit.
+func udpResponseLimit(opt *OPT, limit int) int {
+	if opt == nil || opt.UDPSize <= minUDPSize {
+		return minUDPSize
+	}
+	return min(int(opt.UDPSize), limit)
+}
+
+// maxUDPSize returns the configured MaxUDPSize, or ednsUDPSize if none is.
+func (s *Server) maxUDPSize() int {
+	if s.config.MaxUDPSize == 0 {
+		return ednsUDPSize
+	}
+	return s.config.MaxUDPSize
+}
+
+// resolve answers a single question for source. Blocked names get NXDOMAIN;
+// otherwise the local zone or the cache is used when possible and the
+// upstream otherwise. Upstream queries go out under a fresh random ID and
+// with the case of the name randomized, and the response is given back the
+// client's ID and spelling.
+//
+// A non-nil subnet is the client's own subnet option, passed upstream with a
+// query that bypasses the cache. dnssecOK is the DO bit of the client's OPT
+// record; it is passed upstream too, and since the answer then carries
+// signatures, it is cached apart from the answer fetched without DO.
+// Queries with CD set may be answered from the cache, but what is fetched
+// for them is not cached.
+//
+// cached reports whether the answer came from the cache, stale or not.
+func (s *Server) resolve(ctx context.Context, source net.Addr, header *Header, question *Question, subnet *EDNSOption, dnssecOK bool) (resp *Message, cached bool, err error) {
+	if question.Class == classCH {
+		return s.chaosAnswer(header, question), false, nil
+	}
+	if s.config.Blocklist.Blocked(question.Name) {
+		slog.Debug("blocked", "name", question.Name, "type", question.Type)
+		return &Message{
+			Header:   &Header{ID: header.ID, QR: 1, ResponseCode: RCodeNXDomain},
+			Question: []*Question{question},
+		}, false, nil
+	}
+	if answers := s.config.Zone.Lookup(question); answers != nil {
+		slog.Debug("local answer", "name", question.Name, "type", question.Type)
+		return &Message{
+			Header:   &Header{ID: header.ID, QR: 1, AuthorativeAnswer: 1},
+			Question: []*Question{question},
+			Answer:   answers,
+		}, false, nil
+	}
+	if s.config.NoAAAA && question.Type == TypeAAAA {
+		slog.Debug("AAAA disabled", "name", question.Name)
+		return s.noData(header, question), false, nil
+	}
+	if subnet != nil {
+		resp, err := s.fetchOnce(ctx, source, header, question, subnet, dnssecOK)
+		return resp, false, err
+	}
+	if hit, ok := s.cache.Get(question, dnssecOK); ok {
+		slog.Debug("cache hit", "name", question.Name, "type", question.Type)
+		s.metrics.cacheHits.Add(1)
+		hit.Header.ID = header.ID
+		if s.cache.Prefetch(question, dnssecOK) {
+			slog.Debug("prefetching", "name", question.Name, "type", question.Type)
+			s.refresh(source, header, question, dnssecOK)
+		}
+		return hit, true, nil
+	}
+	s.metrics.cacheMisses.Add(1)
+	if header.CDBit() {
+		// Asked for with validation off, so the answer may be one a
+		// validating upstream would refuse. It is neither cached nor
+		// shared with queries that want it validated.
+		resp, err := s.fetchOnce(ctx, source, header, question, nil, dnssecOK)
+		return resp, false, err
+	}
+
+	resp, err = s.fetch(ctx, source, header, question, dnssecOK)
+	if err != nil && s.config.ServeStale > 0 {
+		if stale, ok := s.cache.GetStale(question, dnssecOK); ok {
+			slog.Warn("serving stale answer", "name", question.Name, "type", question.Type, "err", err)
+			stale.Header.ID = header.ID
+			s.refresh(source, header, question, dnssecOK)
+			return stale, true, nil
+		}
+	}
+	return resp, false, err
+}
+
+// fetch asks the upstreams question on behalf of source, with DO set if
+// dnssecOK is, and caches the answer.
+// Concurrent fetches of the same question and DO bit share a single upstream
+// query.
+func (s *Server) fetch(ctx context.Context, source net.Addr, header *Header, question *Question, dnssecOK bool) (*Message, error) {
+	// The query carries on for the other callers if this one gives up on
+	// it, so it gets copies of the request, and the flight's context.
+	headerCopy, questionCopy := *header, *question
+	shared, err := s.flights.do(ctx, newCacheKey(question, dnssecOK), func(ctx context.Context) (*Message, error) {
+		return s.fetchOnce(ctx, source, &headerCopy, &questionCopy, nil, dnssecOK)
+	})
 	if err != nil {
-		fmt.Println("Failed to resolve UDP address:", err)
-		return
+		return nil, err
 	}
+	resp := *shared
+	respHeader := *shared.Header
+	respHeader.ID = header.ID
+	resp.Header = &respHeader
+	resp.Answer = copyRecords(shared.Answer, 0)
+	resp.Authority = copyRecords(shared.Authority, 0)
+	resp.Additional = copyRecords(shared.Additional, 0)
+	restoreCase(&resp, question)
+	return &resp, nil
+}
 
-	udpConn, err := net.ListenUDP("udp", udpAddr)
+// fetchOnce forwards question to the upstreams. The query carries subnet if
+// it is not nil, and the configured subnet otherwise, if there is one, and
+// the client's CD bit. Only answers to queries without a client's subnet and
+// with validation on are cached, under the DO bit they were asked with.
+func (s *Server) fetchOnce(ctx context.Context, source net.Addr, header *Header, question *Question, subnet *EDNSOption, dnssecOK bool) (*Message, error) {
+	if s.config.CacheOnly {
+		return nil, errCacheOnly
+	}
+	opt := &OPT{UDPSize: ednsUDPSize, DNSSECOK: dnssecOK}
+	if subnet != nil {
+		opt.Options = append(opt.Options, *subnet)
+	} else if s.config.AddSubnet != nil {
+		opt.Options = append(opt.Options, subnetOption(s.config.AddSubnet))
+	}
+	upstreamHeader := *header
+	upstreamHeader.ID = s.pending.add(header.ID, source)
+	if s.config.ForceRD {
+		upstreamHeader.SetRD(true)
+	}
+	// Asking for AD gets it back from a validating upstream whether or
+	// not this client asked, so that the answer can be cached with it for
+	// the clients that do (RFC 6840 5.7).
+	upstreamHeader.SetAD(true)
+	upstreamQuestion := *question
+	upstreamQuestion.Name = randomizeCase(question.Name)
+	req := &Message{
+		Header:     &upstreamHeader,
+		Question:   []*Question{&upstreamQuestion},
+		Additional: []*Answer{opt.toAnswer()},
+	}
+	respMsg, err := s.forward(ctx, req)
+	pending, _ := s.pending.remove(upstreamHeader.ID)
 	if err != nil {
-		fmt.Println("Failed to bind to address:", err)
+		return nil, err
+	}
+	respMsg.Header.ID = pending.clientID
+	restoreCase(respMsg, question)
+	for _, section := range [][]*Answer{respMsg.Answer, respMsg.Authority, respMsg.Additional} {
+		clampTTLs(section, s.config.MinTTL, s.config.MaxTTL)
+	}
+	if subnet == nil && !header.CDBit() {
+		s.cache.Put(question, respMsg, dnssecOK)
+	}
+	return respMsg, nil
+}
+
+// refresh asks the upstreams question in the background, so that the cached
+// answer to it, stale or about to be, is replaced, unless that is already
+// under way.
+func (s *Server) refresh(source net.Addr, header *Header, question *Question, dnssecOK bool) {
+	key := newCacheKey(question, dnssecOK)
+	if _, running := s.refreshing.LoadOrStore(key, true); running {
 		return
 	}
-	defer udpConn.Close()
+	// Copies, since the request they belong to is done with once answered.
+	// The refreshed answer is cached, so it is asked for validated.
+	headerCopy, questionCopy := *header, *question
+	headerCopy.SetCD(false)
+	// No request handler is around to recover a panic in the refresh, so
+	// it recovers its own.
+	go func() {
+		defer s.refreshing.Delete(key)
+		defer recoverPanic(source, nil)
+		if _, err := s.fetch(context.Background(), source, &headerCopy, &questionCopy, dnssecOK); err != nil {
+			slog.Debug("refreshing cached answer failed", "name", question.Name, "type", question.Type, "err", err)
+		}
+	}()
+}
+
+// clampTTLs raises the TTL of every record below minTTL to minTTL and lowers
+// every TTL above maxTTL to maxTTL. A maxTTL of zero means no upper bound.
+// OPT records are left alone since their TTL field holds EDNS flags.
+func clampTTLs(records []*Answer, minTTL, maxTTL uint32) {
+	for _, a := range records {
+		if a.Type != TypeOPT {
+			a.TTL = clampTTL(a.TTL, minTTL, maxTTL)
+		}
+	}
+}
 
+// clampTTL returns ttl within minTTL and maxTTL, as clampTTLs does.
+func clampTTL(ttl, minTTL, maxTTL uint32) uint32 {
+	ttl = max(ttl, minTTL)
+	if maxTTL != 0 {
+		ttl = min(ttl, maxTTL)
+	}
+	return ttl
+}
+
+// recoverPanic keeps a bug triggered by one request from source from taking
+// down the whole server. It must be deferred by each request handler. If
+// onPanic is not nil, it is called after a panic has been logged, to answer
+// the request some other way.
+func recoverPanic(source net.Addr, onPanic func()) {
+	if r := recover(); r != nil {
+		slog.Error("panic handling request", "client", source, "panic", r, "stack", string(debug.Stack()))
+		if onPanic != nil {
+			onPanic()
+		}
+	}
+}
+
+func (s *Server) serveUDP(conn *net.UDPConn) {
 	for {
-		handleConnection(udpConn)
+		// Each packet gets its own buffer, which goes back to the pool
+		// once the handler is done with it.
+		buf := getBuffer()
+		n, source, err := conn.ReadFromUDP(*buf)
+		if err != nil {
+			putBuffer(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("receiving UDP request failed", "err", err)
+			continue
+		}
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			defer putBuffer(buf)
+			s.handleConnection(conn, source, (*buf)[:n])
+		}()
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		if err := runQuery(os.Args[2:], os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := newConfig(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println(usage)
+		fs := defaultSettings().flagSet()
+		fs.SetOutput(os.Stdout)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.LogLevel})))
+	if len(cfg.AllowedClients) == 0 {
+		slog.Warn("no -allow networks configured, answering queries from any client")
+	}
+
+	udpConns, tcpListeners, err := listenAll(cfg.ListenAddrs)
+	if err != nil {
+		slog.Error("cannot listen", "err", err)
+		os.Exit(1)
+	}
+	for _, conn := range udpConns {
+		slog.Info("listening", "addr", conn.LocalAddr())
+	}
+
+	server := newServer(cfg)
+	if cfg.CacheFile != "" {
+		n, err := loadCache(cfg.CacheFile, server.cache)
+		if err != nil {
+			slog.Error("cannot load cache", "file", cfg.CacheFile, "err", err)
+			os.Exit(1)
+		}
+		slog.Info("loaded cache", "file", cfg.CacheFile, "responses", n)
+	}
+	if cfg.QueryLog != "" {
+		server.queryLog, err = openQueryLog(cfg.QueryLog, cfg.QueryLogFormat)
+		if err != nil {
+			slog.Error("cannot open query log", "err", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.PacketDump != "" {
+		server.dump, err = openPacketDump(cfg.PacketDump)
+		if err != nil {
+			slog.Error("cannot open packet dump", "err", err)
+			os.Exit(1)
+		}
+	}
+	// The metrics and the health check get a listener each, or share one
+	// if they are configured on the same address.
+	muxes := make(map[string]*http.ServeMux)
+	handle := func(addr, pattern string, handler http.Handler) {
+		if addr == "" {
+			return
+		}
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		muxes[addr].Handle(pattern, handler)
+	}
+	handle(cfg.MetricsAddr, "/metrics", server.metrics)
+	handle(cfg.HealthAddr, "/healthz", http.HandlerFunc(server.serveHealth))
+	for addr, mux := range muxes {
+		go func(addr string, mux *http.ServeMux) {
+			err := http.ListenAndServe(addr, mux)
+			slog.Error("HTTP endpoint stopped", "addr", addr, "err", err)
+		}(addr, mux)
+	}
+
+	// An interrupt or termination closes the sockets and listeners, which
+	// ends serve once the requests in flight are answered, so that the
+	// query log and packet dump can be flushed and the cache saved on the
+	// way out.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		slog.Info("shutting down")
+		for i := range udpConns {
+			udpConns[i].Close()
+			tcpListeners[i].Close()
+		}
+	}()
+	server.serve(udpConns, tcpListeners)
+	// serve has waited for the handlers, so none of them is left to write
+	// to the log or the dump once they are closed.
+	if server.queryLog != nil {
+		if err := server.queryLog.Close(); err != nil {
+			slog.Error("closing query log failed", "err", err)
+		}
+	}
+	if server.dump != nil {
+		if err := server.dump.Close(); err != nil {
+			slog.Error("closing packet dump failed", "err", err)
+		}
+	}
+	if cfg.CacheFile != "" {
+		if err := saveCache(cfg.CacheFile, server.cache); err != nil {
+			slog.Error("cannot save cache", "file", cfg.CacheFile, "err", err)
+		}
 	}
+	closeUpstreams(cfg.Upstreams)
 }
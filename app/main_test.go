@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// sampleResponse is a response for example.com A IN carrying one answer whose
+// name is a compression pointer back to the question.
+var sampleResponse = []byte{
+	0x04, 0xd2, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+	0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+	0x00, 0x01, 0x00, 0x01,
+	0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x0e, 0x10, 0x00, 0x04,
+	93, 184, 216, 34,
+}
+
+// nxdomainResponse is an upstream NXDOMAIN for nope.example.com A IN with the
+// zone's SOA in the authority section. The SOA's RNAME is itself compressed
+// against the MNAME.
+var nxdomainResponse = []byte{
+	0xab, 0xcd, 0x81, 0x83, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00,
+	0x04, 0x6e, 0x6f, 0x70, 0x65, 0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c,
+	0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00, 0x00, 0x01, 0x00, 0x01, 0xc0, 0x11,
+	0x00, 0x06, 0x00, 0x01, 0x00, 0x00, 0x0e, 0x10, 0x00, 0x2c, 0x02, 0x6e,
+	0x73, 0x05, 0x69, 0x63, 0x61, 0x6e, 0x6e, 0x03, 0x6f, 0x72, 0x67, 0x00,
+	0x03, 0x6e, 0x6f, 0x63, 0x03, 0x64, 0x6e, 0x73, 0xc0, 0x31, 0x78, 0xa5,
+	0x08, 0x5d, 0x00, 0x00, 0x1c, 0x20, 0x00, 0x00, 0x0e, 0x10, 0x00, 0x12,
+	0x75, 0x00, 0x00, 0x00, 0x0e, 0x10,
+}
+
+// mustBytes serializes msg, failing the test if it cannot be.
+func mustBytes(t *testing.T, msg *Message) []byte {
+	t.Helper()
+	buf, err := msg.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes: %v", err)
+	}
+	return buf
+}
+
+func TestParseRequestSample(t *testing.T) {
+	msg, err := parseRequest(sampleResponse)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if len(msg.Question) != 1 || msg.Question[0].Name != "example.com" {
+		t.Fatalf("unexpected question section: %+v", msg.Question)
+	}
+	if len(msg.Answer) != 1 || msg.Answer[0].Name != "example.com" {
+		t.Fatalf("unexpected answer section: %+v", msg.Answer)
+	}
+}
+
+func TestParseRequestIsSilent(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	for _, packet := range [][]byte{sampleResponse, nxdomainResponse} {
+		if _, err := parseRequest(packet); err != nil {
+			t.Errorf("parseRequest: %v", err)
+		}
+	}
+	os.Stdout = stdout
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading stdout: %v", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("parseRequest wrote %q to stdout", out)
+	}
+}
+
+func TestParseRequestTruncated(t *testing.T) {
+	for n := 12; n < len(sampleResponse); n++ {
+		_, err := parseRequest(sampleResponse[:n])
+		if !errors.Is(err, errTruncated) {
+			t.Errorf("truncated at %d: got err %v, want %v", n, err, errTruncated)
+		}
+	}
+}
+
+func TestParseRequestBadCounts(t *testing.T) {
+	// A header claiming 65535 questions followed by a single real one.
+	buf := append([]byte(nil), sampleResponse[:29]...)
+	buf[4], buf[5] = 0xff, 0xff
+	buf[6], buf[7] = 0, 0
+	if _, err := parseRequest(buf); !errors.Is(err, errBadCounts) {
+		t.Fatalf("got err %v, want %v", err, errBadCounts)
+	}
+
+	// A plausible question count but far more answers than could fit.
+	buf = append([]byte(nil), sampleResponse...)
+	buf[6], buf[7] = 0x10, 0x00
+	if _, err := parseRequest(buf); !errors.Is(err, errBadCounts) {
+		t.Fatalf("got err %v, want %v", err, errBadCounts)
+	}
+}
+
+func TestParseRequestShortHeader(t *testing.T) {
+	for n := 0; n < 12; n++ {
+		if _, err := parseRequest(sampleResponse[:n]); !errors.Is(err, errShortHeader) {
+			t.Errorf("%d bytes: got err %v, want %v", n, err, errShortHeader)
+		}
+	}
+}
+
+func TestParseLabelsPointerPastEnd(t *testing.T) {
+	buf := []byte{0xc0}
+	if _, _, err := parseLabels(buf, 0); !errors.Is(err, errTruncated) {
+		t.Fatalf("got err %v, want %v", err, errTruncated)
+	}
+	buf = []byte{0xc0, 0x10}
+	if _, _, err := parseLabels(buf, 0); !errors.Is(err, errTruncated) {
+		t.Fatalf("got err %v, want %v", err, errTruncated)
+	}
+}
+
+func TestParseLabelsPointerLoop(t *testing.T) {
+	// A single question whose name is a pointer to itself at offset 12.
+	buf := []byte{
+		0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01,
+	}
+	if _, err := parseRequest(buf); !errors.Is(err, errPointerLoop) {
+		t.Fatalf("got err %v, want %v", err, errPointerLoop)
+	}
+}
+
+func TestParseRequestAuthority(t *testing.T) {
+	msg, err := parseRequest(nxdomainResponse)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if msg.Header.ResponseCode != 3 {
+		t.Fatalf("rcode = %d, want 3", msg.Header.ResponseCode)
+	}
+	if len(msg.Answer) != 0 || len(msg.Additional) != 0 {
+		t.Fatalf("unexpected answer/additional records: %+v %+v", msg.Answer, msg.Additional)
+	}
+	if len(msg.Authority) != 1 {
+		t.Fatalf("got %d authority records, want 1", len(msg.Authority))
+	}
+	soa := msg.Authority[0]
+	if soa.Name != "example.com" || soa.Type != 6 || soa.TTL != 3600 || soa.RDLength != 44 {
+		t.Fatalf("unexpected SOA record: %+v", soa)
+	}
+
+	// The SOA survives a trip through the serializer.
+	reparsed, err := parseRequest(mustBytes(t, msg))
+	if err != nil {
+		t.Fatalf("parseRequest after ToBytes: %v", err)
+	}
+	if len(reparsed.Authority) != 1 || reparsed.Authority[0].Name != "example.com" {
+		t.Fatalf("authority lost in serialization: %+v", reparsed.Authority)
+	}
+}
+
+func TestParseRequestTwoAnswers(t *testing.T) {
+	buf := []byte{
+		0x00, 0x2a, 0x81, 0x80, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+		0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x04,
+		1, 2, 3, 4,
+		0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x78, 0x00, 0x04,
+		5, 6, 7, 8,
+	}
+	msg, err := parseRequest(buf)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if len(msg.Answer) != 2 {
+		t.Fatalf("got %d answers, want 2", len(msg.Answer))
+	}
+	want := []struct {
+		ttl   uint32
+		rdata []byte
+	}{
+		{60, []byte{1, 2, 3, 4}},
+		{120, []byte{5, 6, 7, 8}},
+	}
+	for i, w := range want {
+		a := msg.Answer[i]
+		if a.Name != "example.com" || a.TTL != w.ttl || !bytes.Equal(a.RData, w.rdata) {
+			t.Errorf("answer %d = %+v, want TTL %d RData %v", i, a, w.ttl, w.rdata)
+		}
+	}
+}
+
+func TestParseRequestDoesNotAliasBuffer(t *testing.T) {
+	buf := make([]byte, 512)
+	n := copy(buf, sampleResponse)
+	first, err := parseRequest(buf[:n])
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	want := []byte{93, 184, 216, 34}
+
+	// Reuse the buffer for a second packet, as the read loop does.
+	for i := range buf {
+		buf[i] = 0
+	}
+	n = copy(buf, otherResponse())
+	if _, err := parseRequest(buf[:n]); err != nil {
+		t.Fatalf("parseRequest second packet: %v", err)
+	}
+
+	if !bytes.Equal(first.Answer[0].RData, want) {
+		t.Fatalf("first message RData changed to %v, want %v", first.Answer[0].RData, want)
+	}
+}
+
+// otherResponse is sampleResponse with a different answer address.
+func otherResponse() []byte {
+	buf := append([]byte(nil), sampleResponse...)
+	copy(buf[len(buf)-4:], []byte{10, 0, 0, 1})
+	return buf
+}
+
+func TestNewQuestion(t *testing.T) {
+	long := strings.Repeat("a", 63)
+	for _, tt := range []struct {
+		name    string
+		want    string
+		wantErr error
+	}{
+		{"example.com", "example.com", nil},
+		{"WWW.Example.COM", "www.example.com", nil},
+		{"example.com.", "example.com", nil},
+		{".", "", nil},
+		{"", "", nil},
+		{long + ".com", long + ".com", nil},
+		{"example..com", "", errEmptyLabel},
+		{".example.com", "", errEmptyLabel},
+		{"example.com..", "", errEmptyLabel},
+		{long + "a.com", "", errLabelTooLong},
+		{strings.Repeat(long+".", 4) + "com", "", errNameTooLong},
+	} {
+		q, err := NewQuestion(tt.name, TypeAAAA, 1)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("NewQuestion(%q) error %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (q.Name != tt.want || q.Type != TypeAAAA || q.Class != 1) {
+			t.Errorf("NewQuestion(%q) = %+v, want name %q", tt.name, q, tt.want)
+		}
+	}
+}
+
+func TestWireLen(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		labels int
+	}{
+		{"example.com", 2},
+		{"example.com.", 2},
+		{"www.Example.COM", 3},
+		{"", 0},
+		{".", 0},
+		{strings.Repeat("a", 63) + ".example", 2},
+	} {
+		q := &Question{Name: tt.name, Type: TypeA, Class: 1}
+		if got := len(q.Labels()); got != tt.labels {
+			t.Errorf("question %q has %d labels, want %d", tt.name, got, tt.labels)
+		}
+		buf, err := q.ToBytes()
+		if err != nil {
+			t.Fatalf("question %q: %v", tt.name, err)
+		}
+		if q.WireLen() != len(buf) {
+			t.Errorf("question %q: WireLen %d, serialized %d bytes", tt.name, q.WireLen(), len(buf))
+		}
+
+		a := &Answer{Name: tt.name, Type: TypeTXT, Class: 1, TTL: 60, RData: txtRData("hello")}
+		a.RDLength = uint16(len(a.RData))
+		if got := len(a.Labels()); got != tt.labels {
+			t.Errorf("answer %q has %d labels, want %d", tt.name, got, tt.labels)
+		}
+		buf, err = a.ToBytes()
+		if err != nil {
+			t.Fatalf("answer %q: %v", tt.name, err)
+		}
+		if a.WireLen() != len(buf) {
+			t.Errorf("answer %q: WireLen %d, serialized %d bytes", tt.name, a.WireLen(), len(buf))
+		}
+	}
+}
+
+func TestQuestionAndAnswerEncodeNamesAlike(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want []byte
+	}{
+		{"example.com", []byte("\x07example\x03com\x00")},
+		{"Example.COM.", []byte("\x07Example\x03COM\x00")},
+		{"", []byte{0}},
+		{"a.b.c", []byte("\x01a\x01b\x01c\x00")},
+	} {
+		q, err := (&Question{Name: tt.name, Type: TypeA, Class: 1}).ToBytes()
+		if err != nil {
+			t.Fatalf("question %q: %v", tt.name, err)
+		}
+		a, err := (&Answer{Name: tt.name, Type: TypeA, Class: 1, RDLength: 4, RData: []byte{192, 0, 2, 1}}).ToBytes()
+		if err != nil {
+			t.Fatalf("answer %q: %v", tt.name, err)
+		}
+		n := len(tt.want)
+		if !bytes.Equal(q[:n], tt.want) || !bytes.Equal(a[:n], tt.want) {
+			t.Errorf("%q encoded as % x in a question and % x in an answer, want % x", tt.name, q[:n], a[:n], tt.want)
+		}
+	}
+}
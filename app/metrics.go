@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the upstream latency
+// histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Metrics counts what the server does, for scraping in the Prometheus text
+// format. The zero value is not usable; call newMetrics.
+type Metrics struct {
+	queries        atomic.Uint64
+	cacheHits      atomic.Uint64
+	cacheMisses    atomic.Uint64
+	upstreamErrors atomic.Uint64
+	// cacheSize reports the number of cached responses, if set.
+	cacheSize func() int
+
+	mu sync.Mutex
+	// latencyCounts[i] counts observations no greater than
+	// latencyBuckets[i] but greater than the bucket before it.
+	latencyCounts []uint64
+	latencySum    float64
+	latencyCount  uint64
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{latencyCounts: make([]uint64, len(latencyBuckets))}
+}
+
+// observeUpstreamLatency records how long an upstream took to answer.
+func (m *Metrics) observeUpstreamLatency(d time.Duration) {
+	seconds := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			m.latencyCounts[i]++
+			break
+		}
+	}
+	m.latencySum += seconds
+	m.latencyCount++
+}
+
+// WriteTo writes every metric to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("dns_queries_total", "Requests received from clients.", m.queries.Load())
+	counter("dns_cache_hits_total", "Questions answered from the cache.", m.cacheHits.Load())
+	counter("dns_cache_misses_total", "Questions not found in the cache.", m.cacheMisses.Load())
+	counter("dns_upstream_errors_total", "Upstream queries that failed or timed out.", m.upstreamErrors.Load())
+
+	if m.cacheSize != nil {
+		fmt.Fprintf(cw, "# HELP dns_cache_entries Responses held in the cache.\n# TYPE dns_cache_entries gauge\ndns_cache_entries %d\n", m.cacheSize())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	const name = "dns_upstream_latency_seconds"
+	fmt.Fprintf(cw, "# HELP %s Time taken by upstreams to answer.\n# TYPE %s histogram\n", name, name)
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += m.latencyCounts[i]
+		fmt.Fprintf(cw, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(cw, "%s_bucket{le=\"+Inf\"} %d\n", name, m.latencyCount)
+	fmt.Fprintf(cw, "%s_sum %s\n", name, strconv.FormatFloat(m.latencySum, 'g', -1, 64))
+	fmt.Fprintf(cw, "%s_count %d\n", name, m.latencyCount)
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// countingWriter remembers the bytes written and the first error, so that
+// WriteTo can report them without checking every Fprintf.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+	for i, name := range []string{"example.com", "example.com", "example.org"} {
+		if s.answerRequest(context.Background(), clientAddr, newQuery(t, uint16(i), name, TypeA)) == nil {
+			t.Fatalf("no response for %s", name)
+		}
+	}
+
+	srv := httptest.NewServer(s.metrics)
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	for _, want := range []string{
+		"dns_queries_total 3\n",
+		"dns_cache_hits_total 1\n",
+		"dns_cache_misses_total 2\n",
+		"dns_upstream_errors_total 0\n",
+		"dns_cache_entries 2\n",
+		"# TYPE dns_upstream_latency_seconds histogram\n",
+		"dns_upstream_latency_seconds_bucket{le=\"+Inf\"} 2\n",
+		"dns_upstream_latency_seconds_count 2\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("scrape is missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestLatencyHistogramBuckets(t *testing.T) {
+	m := newMetrics()
+	m.observeUpstreamLatency(3 * time.Millisecond)
+	m.observeUpstreamLatency(30 * time.Millisecond)
+	m.observeUpstreamLatency(10 * time.Second)
+
+	var out strings.Builder
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	for _, want := range []string{
+		"dns_upstream_latency_seconds_bucket{le=\"0.005\"} 1\n",
+		"dns_upstream_latency_seconds_bucket{le=\"0.025\"} 1\n",
+		"dns_upstream_latency_seconds_bucket{le=\"0.05\"} 2\n",
+		"dns_upstream_latency_seconds_bucket{le=\"5\"} 2\n",
+		"dns_upstream_latency_seconds_bucket{le=\"+Inf\"} 3\n",
+		"dns_upstream_latency_seconds_count 3\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+}
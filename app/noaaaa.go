@@ -0,0 +1,39 @@
+package main
+
+// noDataSOA is the made-up SOA sent with the NODATA answers of NoAAAA. It
+// only exists so that clients cache the negative answer (RFC 2308 5); its
+// Minimum is filled in with the local TTL.
+var noDataSOA = SOARecord{
+	MName:   "localhost",
+	RName:   "nobody.invalid",
+	Serial:  1,
+	Refresh: 3600,
+	Retry:   600,
+	Expire:  86400,
+}
+
+// noData answers question with NOERROR and no records, as NoAAAA does for
+// AAAA queries. The authority section holds an SOA owned by the question's
+// name, as there is no real zone to name, with the local TTL.
+func (s *Server) noData(header *Header, question *Question) *Message {
+	resp := &Message{
+		Header:   &Header{ID: header.ID, QR: 1},
+		Question: []*Question{question},
+	}
+	soa := noDataSOA
+	soa.Minimum = s.config.LocalTTL
+	rdata, err := soaRData(&soa)
+	if err != nil {
+		// The names above are valid, so this cannot happen.
+		panic(err)
+	}
+	resp.Authority = []*Answer{{
+		Name:     question.Name,
+		Type:     TypeSOA,
+		Class:    question.Class,
+		TTL:      s.config.LocalTTL,
+		RDLength: uint16(len(rdata)),
+		RData:    rdata,
+	}}
+	return resp
+}
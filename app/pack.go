@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// nameWriter serializes a whole message into one buffer. Because every name
+// is written at a known offset, later names whose suffix has already been
+// written can be replaced by a compression pointer (RFC 1035 4.1.4).
+// Without compress it is also how single questions and records are
+// serialized, and offsets may be nil.
+type nameWriter struct {
+	buf      []byte
+	compress bool
+	offsets  map[string]int
+}
+
+// newNameWriter returns a writer whose buffer starts out with room for size
+// bytes.
+func newNameWriter(compress bool, size int) *nameWriter {
+	w := &nameWriter{
+		buf:      make([]byte, 0, size),
+		compress: compress,
+	}
+	if compress {
+		w.offsets = make(map[string]int)
+	}
+	return w
+}
+
+// writeName appends name as a sequence of labels, ending either in the root
+// label or in a pointer to a previously written suffix. Suffixes are matched
+// exactly so the casing of every name is preserved on the wire.
+func (w *nameWriter) writeName(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	labels := nameLabels(name)
+	for i, label := range labels {
+		if w.compress {
+			suffix := strings.Join(labels[i:], ".")
+			if offset, ok := w.offsets[suffix]; ok {
+				w.buf = binary.BigEndian.AppendUint16(w.buf, 0xC000|uint16(offset))
+				return nil
+			}
+			// Pointers only have 14 bits of offset.
+			if len(w.buf) <= 0x3FFF {
+				w.offsets[suffix] = len(w.buf)
+			}
+		}
+		w.buf = append(w.buf, byte(len(label)))
+		w.buf = append(w.buf, label...)
+	}
+	w.buf = append(w.buf, 0)
+	return nil
+}
+
+func (w *nameWriter) writeQuestion(q *Question) error {
+	if err := w.writeName(q.Name); err != nil {
+		return err
+	}
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(q.Type))
+	w.buf = binary.BigEndian.AppendUint16(w.buf, q.Class)
+	return nil
+}
+
+func (w *nameWriter) writeAnswer(a *Answer) error {
+	if err := w.writeName(a.Name); err != nil {
+		return err
+	}
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(a.Type))
+	w.buf = binary.BigEndian.AppendUint16(w.buf, a.Class)
+	w.buf = binary.BigEndian.AppendUint32(w.buf, a.TTL)
+	w.buf = binary.BigEndian.AppendUint16(w.buf, a.RDLength)
+	w.buf = append(w.buf, a.RData...)
+	return nil
+}
+
+// pack writes the header followed by every section of m. The section counts
+// in the written header always come from the slices, whatever m.Header says.
+func (m *Message) pack(compress bool) ([]byte, error) {
+	header := *m.Header
+	header.QuestionCount = uint16(len(m.Question))
+	header.AnswerRecordCount = uint16(len(m.Answer))
+	header.AuthorativeRecordCount = uint16(len(m.Authority))
+	header.AdditionalRecordCount = uint16(len(m.Additional))
+
+	// The uncompressed length is exact for ToBytes, and for compressed
+	// messages never too little, so the buffer is only allocated once.
+	size := 12
+	for _, q := range m.Question {
+		size += q.WireLen()
+	}
+	for _, section := range [][]*Answer{m.Answer, m.Authority, m.Additional} {
+		for _, a := range section {
+			size += a.WireLen()
+		}
+	}
+	w := newNameWriter(compress, size)
+	w.buf = append(w.buf, header.ToBytes()...)
+	for _, q := range m.Question {
+		if err := w.writeQuestion(q); err != nil {
+			return nil, err
+		}
+	}
+	for _, section := range [][]*Answer{m.Answer, m.Authority, m.Additional} {
+		for _, a := range section {
+			if err := w.writeAnswer(a); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return w.buf, nil
+}
+
+// ToBytes serializes m with every name written out in full.
+func (m *Message) ToBytes() ([]byte, error) {
+	return m.pack(false)
+}
+
+// ToCompressedBytes serializes m using name compression. Question.ToBytes and
+// Answer.ToBytes still write uncompressed names for callers that serialize
+// records on their own.
+func (m *Message) ToCompressedBytes() ([]byte, error) {
+	return m.pack(true)
+}
+
+// packWithin serializes m compressed to at most limit bytes. Records are
+// dropped from the end of the message until it fits: additional records
+// first, keeping any OPT, then authority and finally answer records. The
+// question section is always kept. Losing answer or authority records sets
+// the TC bit so the client knows to retry over TCP; losing only additional
+// records does not, as RFC 2181 section 9 allows.
+func (m *Message) packWithin(limit int) ([]byte, error) {
+	b, err := m.ToCompressedBytes()
+	if err != nil || len(b) <= limit {
+		return b, err
+	}
+	header := *m.Header
+	trimmed := &Message{
+		Header:     &header,
+		Question:   m.Question,
+		Answer:     m.Answer,
+		Authority:  m.Authority,
+		Additional: withoutOPT(m.Additional),
+	}
+	opt := m.Additional[:0:0]
+	for _, a := range m.Additional {
+		if a.Type == TypeOPT {
+			opt = append(opt, a)
+		}
+	}
+	for len(b) > limit {
+		switch {
+		case len(trimmed.Additional) > 0:
+			trimmed.Additional = trimmed.Additional[:len(trimmed.Additional)-1]
+		case len(trimmed.Authority) > 0:
+			trimmed.Authority = trimmed.Authority[:len(trimmed.Authority)-1]
+			header.SetTC(true)
+		case len(trimmed.Answer) > 0:
+			trimmed.Answer = trimmed.Answer[:len(trimmed.Answer)-1]
+			header.SetTC(true)
+		default:
+			// Nothing left to drop; the header, question and OPT are
+			// all there is.
+			return b, nil
+		}
+		full := *trimmed
+		full.Additional = append(trimmed.Additional[:len(trimmed.Additional):len(trimmed.Additional)], opt...)
+		if b, err = full.ToCompressedBytes(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
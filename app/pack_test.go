@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestToCompressedBytes(t *testing.T) {
+	msg := &Message{
+		Header: &Header{ID: 7, QR: 1, QuestionCount: 1, AnswerRecordCount: 2},
+		Question: []*Question{
+			{Name: "www.example.com", Type: 1, Class: 1},
+		},
+		Answer: []*Answer{
+			{Name: "www.example.com", Type: 1, Class: 1, TTL: 60, RDLength: 4, RData: []byte{10, 0, 0, 1}},
+			{Name: "mail.example.com", Type: 1, Class: 1, TTL: 60, RDLength: 4, RData: []byte{10, 0, 0, 2}},
+		},
+	}
+	compressed, err := msg.ToCompressedBytes()
+	if err != nil {
+		t.Fatalf("ToCompressedBytes: %v", err)
+	}
+	plain := mustBytes(t, msg)
+	if len(compressed) >= len(plain) {
+		t.Fatalf("compressed length %d not smaller than uncompressed %d", len(compressed), len(plain))
+	}
+	// The first answer is a bare pointer to the question name at offset 12.
+	answerStart := 12 + 17 + 4
+	if !bytes.Equal(compressed[answerStart:answerStart+2], []byte{0xc0, 0x0c}) {
+		t.Fatalf("first answer name = %x, want pointer to offset 12", compressed[answerStart:answerStart+2])
+	}
+
+	parsed, err := parseRequest(compressed)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if parsed.Question[0].Name != "www.example.com" {
+		t.Fatalf("question name = %q", parsed.Question[0].Name)
+	}
+	if parsed.Answer[0].Name != "www.example.com" {
+		t.Fatalf("answer name = %q", parsed.Answer[0].Name)
+	}
+}
+
+func TestCompressionPointersAcrossSections(t *testing.T) {
+	a := func(name string, last byte) *Answer {
+		return &Answer{Name: name, Type: TypeA, Class: 1, TTL: 60, RDLength: 4, RData: []byte{192, 0, 2, last}}
+	}
+	msg := &Message{
+		Header:     &Header{ID: 9, QR: 1, QuestionCount: 1, AnswerRecordCount: 2, AuthorativeRecordCount: 1, AdditionalRecordCount: 1},
+		Question:   []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		Answer:     []*Answer{a("www.example.com", 1), a("mail.www.example.com", 2)},
+		Authority:  []*Answer{a("example.com", 3)},
+		Additional: []*Answer{a("ns.mail.www.example.com", 4)},
+	}
+	b, err := msg.ToCompressedBytes()
+	if err != nil {
+		t.Fatalf("ToCompressedBytes: %v", err)
+	}
+	// Each name after the question is a label or two and a pointer back:
+	// the first answer into the question, the second into the first
+	// answer, whose name itself ends in a pointer, and so on.
+	for _, tt := range []struct {
+		offset int
+		want   []byte
+	}{
+		{29, []byte{3, 'w', 'w', 'w', 0xc0, 12}},
+		{49, []byte{4, 'm', 'a', 'i', 'l', 0xc0, 29}},
+		{70, []byte{0xc0, 12}},
+		{86, []byte{2, 'n', 's', 0xc0, 49}},
+	} {
+		if got := b[tt.offset : tt.offset+len(tt.want)]; !bytes.Equal(got, tt.want) {
+			t.Errorf("name at offset %d is %x, want %x", tt.offset, got, tt.want)
+		}
+	}
+
+	parsed, err := parseRequest(b)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	for _, section := range [][]*Answer{parsed.Answer, parsed.Authority, parsed.Additional} {
+		for _, a := range section {
+			a.RDataOffset = 0
+		}
+	}
+	if !reflect.DeepEqual(parsed, msg) {
+		t.Fatalf("round trip mismatch:\n got %s\nwant %s", parsed, msg)
+	}
+}
+
+func TestParsePointerToPointer(t *testing.T) {
+	// The first answer's name is a bare pointer to the question, and the
+	// second's a pointer to that pointer, which no writer of ours emits
+	// but the wire format allows.
+	b := []byte{
+		0, 1, 0x81, 0x80, 0, 1, 0, 2, 0, 0, 0, 0,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0, 1, 0, 1,
+		0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1,
+		0xc0, 29, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 2,
+	}
+	parsed, err := parseRequest(b)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	for i, a := range parsed.Answer {
+		if a.Name != "example.com" || a.RData[3] != byte(i+1) {
+			t.Errorf("answer %d is %s with %v, want example.com", i, a.Name, a.RData)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	msgs := []*Message{
+		{
+			Header: &Header{ID: 0xbeef, RecursionDesired: 1, QuestionCount: 1},
+			Question: []*Question{
+				{Name: "codecrafters.io", Type: 1, Class: 1},
+			},
+			Answer:     []*Answer{},
+			Authority:  []*Answer{},
+			Additional: []*Answer{},
+		},
+		{
+			Header: &Header{ID: 1, QR: 1, RecursionDesired: 1, RecursionAvailable: 1, QuestionCount: 1, AnswerRecordCount: 1},
+			Question: []*Question{
+				{Name: "example.com", Type: 1, Class: 1},
+			},
+			Answer: []*Answer{
+				{Name: "example.com", Type: 1, Class: 1, TTL: 3600, RDLength: 4, RData: []byte{93, 184, 216, 34}},
+			},
+			Authority:  []*Answer{},
+			Additional: []*Answer{},
+		},
+	}
+	for _, msg := range msgs {
+		for _, compress := range []bool{false, true} {
+			buf, err := msg.pack(compress)
+			if err != nil {
+				t.Fatalf("pack (compress=%v): %v", compress, err)
+			}
+			parsed, err := parseRequest(buf)
+			if err != nil {
+				t.Fatalf("parseRequest (compress=%v): %v", compress, err)
+			}
+			for _, a := range parsed.Answer {
+				a.RDataOffset = 0
+			}
+			if !reflect.DeepEqual(parsed, msg) {
+				t.Errorf("round trip (compress=%v) mismatch:\n got %+v\nwant %+v", compress, parsed, msg)
+			}
+		}
+	}
+}
+
+func TestMessageToBytesSetsCounts(t *testing.T) {
+	msg := &Message{
+		Header:   &Header{QuestionCount: 5, AnswerRecordCount: 3},
+		Question: []*Question{{Name: "example.com", Type: 1, Class: 1}},
+	}
+	header := parseHeader(mustBytes(t, msg))
+	if header.QuestionCount != 1 || header.AnswerRecordCount != 0 {
+		t.Fatalf("counts = %d/%d, want 1/0", header.QuestionCount, header.AnswerRecordCount)
+	}
+}
+
+func TestNameLengthLimits(t *testing.T) {
+	label63 := strings.Repeat("a", 63)
+	// Four 63-byte labels encode to 4*64+1 = 257 bytes.
+	longName := strings.Join([]string{label63, label63, label63, label63}, ".")
+	// Three 63-byte labels and one of 61 encode to exactly 255.
+	maxName := strings.Join([]string{label63, label63, label63, strings.Repeat("b", 61)}, ".")
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{label63 + ".example.com", nil},
+		{maxName, nil},
+		{label63 + "a.example.com", errLabelTooLong},
+		{longName, errNameTooLong},
+		{"a..b.", errEmptyLabel},
+		{".example.com", errEmptyLabel},
+	}
+	for _, tt := range tests {
+		q := &Question{Name: tt.name, Type: TypeA, Class: 1}
+		if _, err := q.ToBytes(); !errors.Is(err, tt.err) {
+			t.Errorf("Question.ToBytes(%d bytes): got err %v, want %v", len(tt.name), err, tt.err)
+		}
+		a := &Answer{Name: tt.name, Type: TypeA, Class: 1, RDLength: 4, RData: []byte{192, 0, 2, 1}}
+		if _, err := a.ToBytes(); !errors.Is(err, tt.err) {
+			t.Errorf("Answer.ToBytes(%d bytes): got err %v, want %v", len(tt.name), err, tt.err)
+		}
+		msg := &Message{Header: &Header{}, Question: []*Question{q}}
+		for _, compress := range []bool{false, true} {
+			if _, err := msg.pack(compress); !errors.Is(err, tt.err) {
+				t.Errorf("Message.pack(%d bytes, compress=%v): got err %v, want %v", len(tt.name), compress, err, tt.err)
+			}
+		}
+	}
+}
+
+func TestRootNameRoundTrip(t *testing.T) {
+	for _, name := range []string{"", "."} {
+		q := &Question{Name: name, Type: TypeSOA, Class: 1}
+		buf, err := q.ToBytes()
+		if err != nil {
+			t.Fatalf("Question.ToBytes(%q): %v", name, err)
+		}
+		if want := []byte{0, 0, 6, 0, 1}; !bytes.Equal(buf, want) {
+			t.Fatalf("Question.ToBytes(%q) = %x, want %x", name, buf, want)
+		}
+		parsed, _, err := parseQuestion(buf, 0)
+		if err != nil || parsed.Name != "" {
+			t.Fatalf("parseQuestion = %q, %v; want the root name", parsed.Name, err)
+		}
+
+		a := &Answer{Name: name, Type: TypeNS, Class: 1, TTL: 60, RDLength: 1, RData: []byte{0}}
+		if buf, err = a.ToBytes(); err != nil || buf[0] != 0 || buf[1] != 0 {
+			t.Fatalf("Answer.ToBytes(%q) = %x, %v", name, buf, err)
+		}
+
+		msg := &Message{Header: &Header{}, Question: []*Question{q}, Answer: []*Answer{a}}
+		for _, compress := range []bool{false, true} {
+			buf, err := msg.pack(compress)
+			if err != nil {
+				t.Fatalf("pack(%q, compress=%v): %v", name, compress, err)
+			}
+			reparsed, err := parseRequest(buf)
+			if err != nil {
+				t.Fatalf("parseRequest(%q, compress=%v): %v", name, compress, err)
+			}
+			if reparsed.Question[0].Name != "" || reparsed.Answer[0].Name != "" {
+				t.Fatalf("root name did not round-trip: %q, %q", reparsed.Question[0].Name, reparsed.Answer[0].Name)
+			}
+		}
+	}
+}
+
+func TestTrailingDotIgnored(t *testing.T) {
+	a, err := (&Question{Name: "example.com.", Type: TypeA, Class: 1}).ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes: %v", err)
+	}
+	b, err := (&Question{Name: "example.com", Type: TypeA, Class: 1}).ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes: %v", err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Fatalf("trailing dot changed the encoding: %x vs %x", a, b)
+	}
+}
+
+// manyAnswers returns n A records for name, more than fit in 512 bytes once n
+// passes about 30.
+func manyAnswers(name string, n int) []*Answer {
+	answers := make([]*Answer, n)
+	for i := range answers {
+		answers[i] = &Answer{Name: name, Type: TypeA, Class: 1, TTL: 60, RDLength: 4, RData: []byte{192, 0, 2, byte(i)}}
+	}
+	return answers
+}
+
+func TestPackWithinTruncates(t *testing.T) {
+	msg := &Message{
+		Header:     &Header{ID: 7, QR: 1},
+		Question:   []*Question{{Name: "big.example.com", Type: TypeA, Class: 1}},
+		Answer:     manyAnswers("big.example.com", 50),
+		Additional: []*Answer{(&OPT{UDPSize: ednsUDPSize}).toAnswer()},
+	}
+	b, err := msg.packWithin(minUDPSize)
+	if err != nil {
+		t.Fatalf("packWithin: %v", err)
+	}
+	if len(b) > minUDPSize {
+		t.Fatalf("packed %d bytes, limit %d", len(b), minUDPSize)
+	}
+	got, err := parseResponse(b)
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	if got.Header.Truncation != 1 {
+		t.Fatalf("TC not set")
+	}
+	if len(got.Question) != 1 || got.Question[0].Name != "big.example.com" {
+		t.Fatalf("question section lost: %+v", got.Question)
+	}
+	if n := len(got.Answer); n == 0 || n >= 50 {
+		t.Fatalf("kept %d of 50 answers", n)
+	}
+	if opt, _ := got.OPT(); opt == nil {
+		t.Fatalf("OPT record dropped")
+	}
+	if msg.Header.Truncation != 0 || len(msg.Answer) != 50 {
+		t.Fatalf("packWithin modified the message")
+	}
+
+	// Dropping additional records alone does not call for TC.
+	msg = &Message{
+		Header:     &Header{ID: 7, QR: 1},
+		Question:   []*Question{{Name: "big.example.com", Type: TypeA, Class: 1}},
+		Answer:     manyAnswers("big.example.com", 1),
+		Additional: manyAnswers("glue.example.com", 50),
+	}
+	if b, err = msg.packWithin(minUDPSize); err != nil {
+		t.Fatalf("packWithin: %v", err)
+	}
+	if len(b) > minUDPSize || parseHeader(b).Truncation != 0 || parseHeader(b).AnswerRecordCount != 1 {
+		t.Fatalf("packed %d bytes with header %+v", len(b), parseHeader(b))
+	}
+}
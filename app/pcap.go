@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// linkTypeRaw is the pcap link type of packets that start with their IPv4 or
+// IPv6 header.
+const linkTypeRaw = 101
+
+// packetDumpFlushInterval is how often buffered packets are written out to
+// the pcap file.
+const packetDumpFlushInterval = time.Second
+
+// packetDump writes the UDP datagrams the server receives and sends to a
+// pcap file, for reading with Wireshark or tcpdump. The datagrams are given
+// made-up IP and UDP headers, since the socket only hands over payloads.
+// Packets are buffered in memory and flushed every packetDumpFlushInterval,
+// like the query log, so that a busy server does not make a write call for
+// every one.
+type packetDump struct {
+	out io.Writer
+
+	mu  sync.Mutex
+	buf *bufio.Writer
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// openPacketDump creates the pcap file at path, replacing any file there.
+func openPacketDump(path string) (*packetDump, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newPacketDump(f, packetDumpFlushInterval)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// newPacketDump writes the pcap file header to out and returns a dump that
+// appends packets to it, flushed every flushEvery.
+func newPacketDump(out io.Writer, flushEvery time.Duration) (*packetDump, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+	d := &packetDump{
+		out:  out,
+		buf:  bufio.NewWriterSize(out, 64<<10),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go d.flushEvery(flushEvery)
+	return d, nil
+}
+
+func (d *packetDump) flushEvery(interval time.Duration) {
+	defer close(d.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.flush(); err != nil {
+				slog.Error("writing packet dump failed", "err", err)
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+func (d *packetDump) flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.buf.Flush()
+}
+
+// write records payload as a datagram sent from src to dst. A nil dump
+// records nothing, so that callers need not check whether dumping is on.
+func (d *packetDump) write(src, dst *net.UDPAddr, payload []byte) error {
+	if d == nil {
+		return nil
+	}
+	packet := udpPacket(src, dst, payload)
+	now := time.Now()
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	record = append(record, packet...)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err := d.buf.Write(record)
+	return err
+}
+
+// Close writes out what is buffered and closes the file.
+func (d *packetDump) Close() error {
+	close(d.stop)
+	<-d.done
+	err := d.flush()
+	if closer, ok := d.out.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// udpPacket wraps payload in the IPv4 or IPv6 and UDP headers it would have
+// had on the wire going from src to dst. IPv6 is used unless both addresses
+// are IPv4.
+func udpPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		// The UDP checksum is optional over IPv4, and left out.
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17
+	ip[7] = 64
+	copy(ip[8:], src.IP.To16())
+	copy(ip[24:], dst.IP.To16())
+	// Over IPv6 the checksum is required. It covers a pseudo-header of
+	// the addresses, the length and the protocol.
+	sum := sumWords(0, ip[8:40])
+	sum += uint32(len(udp)) + 17
+	sum = sumWords(sum, udp)
+	c := fold(sum)
+	if c == 0 {
+		c = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], c)
+	return append(ip, udp...)
+}
+
+// checksum returns the Internet checksum of b (RFC 1071), starting from sum.
+func checksum(sum uint32, b []byte) uint16 {
+	return fold(sumWords(sum, b))
+}
+
+// sumWords adds the big-endian 16 bit words of b to sum, padding an odd
+// last byte with zero.
+func sumWords(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// fold folds the carries of sum into 16 bits and complements the result.
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// readPcap returns the packets of a pcap file written by packetDump.
+func readPcap(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	if len(data) < 24 || binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 {
+		t.Fatalf("no pcap header in % x", data)
+	}
+	if lt := binary.LittleEndian.Uint32(data[20:]); lt != linkTypeRaw {
+		t.Fatalf("link type %d, want %d", lt, linkTypeRaw)
+	}
+	var packets [][]byte
+	for data = data[24:]; len(data) > 0; {
+		if len(data) < 16 {
+			t.Fatalf("truncated record header % x", data)
+		}
+		n := int(binary.LittleEndian.Uint32(data[8:]))
+		if orig := int(binary.LittleEndian.Uint32(data[12:])); orig != n || len(data) < 16+n {
+			t.Fatalf("record of %d bytes (%d on the wire) in %d left", n, orig, len(data)-16)
+		}
+		packets = append(packets, data[16:16+n])
+		data = data[16+n:]
+	}
+	return packets
+}
+
+func TestPacketDumpRoundTrip(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+	var out bytes.Buffer
+	dump, err := newPacketDump(&out, time.Hour)
+	if err != nil {
+		t.Fatalf("newPacketDump: %v", err)
+	}
+	s.dump = dump
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer conn.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer client.Close()
+
+	query := newQuery(t, 7, "example.com", TypeA)
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	s.handleConnection(conn, clientAddr, query)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, ednsUDPSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("no response: %v", err)
+	}
+	response := buf[:n]
+
+	// Nothing reaches out until the dump is flushed.
+	if out.Len() != 24 {
+		t.Fatalf("dump has %d bytes before flushing, want the 24 of the header", out.Len())
+	}
+	if err := dump.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	packets := readPcap(t, out.Bytes())
+	if len(packets) != 2 {
+		t.Fatalf("dumped %d packets, want 2", len(packets))
+	}
+	serverAddr := conn.LocalAddr().(*net.UDPAddr)
+	for i, want := range []struct {
+		src, dst *net.UDPAddr
+		payload  []byte
+	}{
+		{clientAddr, serverAddr, query},
+		{serverAddr, clientAddr, response},
+	} {
+		p := packets[i]
+		if len(p) < 28 || p[0] != 0x45 || p[9] != 17 {
+			t.Fatalf("packet %d is not IPv4 UDP: % x", i, p)
+		}
+		if checksum(0, p[:20]) != 0 {
+			t.Errorf("packet %d has a bad IP header checksum", i)
+		}
+		src, dst := net.IP(p[12:16]), net.IP(p[16:20])
+		sport, dport := int(binary.BigEndian.Uint16(p[20:])), int(binary.BigEndian.Uint16(p[22:]))
+		if !src.Equal(want.src.IP) || !dst.Equal(want.dst.IP) || sport != want.src.Port || dport != want.dst.Port {
+			t.Errorf("packet %d goes %v:%d -> %v:%d, want %v -> %v", i, src, sport, dst, dport, want.src, want.dst)
+		}
+		if !bytes.Equal(p[28:], want.payload) {
+			t.Errorf("packet %d carries % x, want % x", i, p[28:], want.payload)
+		}
+	}
+}
+
+func TestUDPPacketIPv6Checksum(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}
+	dst := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 53}
+	p := udpPacket(src, dst, []byte{1, 2, 3})
+	if len(p) != 40+8+3 || p[0]>>4 != 6 || p[6] != 17 {
+		t.Fatalf("not an IPv6 UDP packet: % x", p)
+	}
+	// Summing the pseudo-header and the datagram with its checksum in
+	// place comes to zero when the checksum is right.
+	sum := sumWords(0, p[8:40]) + uint32(len(p)-40) + 17
+	if c := checksum(sum, p[40:]); c != 0 {
+		t.Errorf("UDP checksum does not verify, residue %#04x", c)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// pendingQuery records who an outstanding upstream query was made for.
+type pendingQuery struct {
+	clientID uint16
+	client   net.Addr
+}
+
+// pendingQueries maps the random IDs of outstanding upstream queries back to
+// the client requests they were made for. Clients pick their own IDs, so
+// reusing them upstream would both let two clients collide and make the ID
+// trivially guessable for anyone spoofing responses.
+type pendingQueries struct {
+	mu   sync.Mutex
+	byID map[uint16]pendingQuery
+}
+
+func newPendingQueries() *pendingQueries {
+	return &pendingQueries{byID: make(map[uint16]pendingQuery)}
+}
+
+// randomID returns a cryptographically random transaction ID.
+func randomID() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// add registers a query for client and returns the upstream ID to use for it.
+func (p *pendingQueries) add(clientID uint16, client net.Addr) uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		id := randomID()
+		if _, taken := p.byID[id]; !taken {
+			p.byID[id] = pendingQuery{clientID: clientID, client: client}
+			return id
+		}
+	}
+}
+
+// remove forgets the query with upstream ID id and returns what it was for.
+func (p *pendingQueries) remove(id uint16) (pendingQuery, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	q, ok := p.byID[id]
+	delete(p.byID, id)
+	return q, ok
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueryLogFormat is how each line of the query log is written.
+type QueryLogFormat int
+
+const (
+	// TextQueryLog writes key=value pairs, like the server's own log.
+	TextQueryLog QueryLogFormat = iota
+	// JSONQueryLog writes a JSON object per line.
+	JSONQueryLog
+)
+
+// queryLogFlushInterval is how often buffered query log lines are written
+// out to the file.
+const queryLogFlushInterval = time.Second
+
+// queryLogEntry is one handled query, as the query log records it.
+type queryLogEntry struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	RCode   string    `json:"rcode"`
+	Answers int       `json:"answers"`
+	Cached  bool      `json:"cached"`
+}
+
+// queryLog appends a line per handled query to a file. Lines are buffered in
+// memory and flushed every queryLogFlushInterval, so that recording a query
+// does not wait on the disk.
+type queryLog struct {
+	format QueryLogFormat
+	out    io.Writer
+
+	mu  sync.Mutex
+	buf *bufio.Writer
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// openQueryLog opens the query log at path, creating it if needed and
+// appending to it otherwise.
+func openQueryLog(path string, format QueryLogFormat) (*queryLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return newQueryLog(file, format, queryLogFlushInterval), nil
+}
+
+// newQueryLog returns a query log writing to out, flushed every flushEvery.
+func newQueryLog(out io.Writer, format QueryLogFormat, flushEvery time.Duration) *queryLog {
+	l := &queryLog{
+		format: format,
+		out:    out,
+		buf:    bufio.NewWriterSize(out, 64<<10),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go l.flushEvery(flushEvery)
+	return l
+}
+
+func (l *queryLog) flushEvery(interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.flush(); err != nil {
+				slog.Error("writing query log failed", "err", err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *queryLog) flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Flush()
+}
+
+// record adds entry to the log.
+func (l *queryLog) record(entry queryLogEntry) {
+	var line []byte
+	switch l.format {
+	case JSONQueryLog:
+		line, _ = json.Marshal(entry)
+	default:
+		line = fmt.Appendf(nil, "time=%s client=%s name=%s type=%s rcode=%s answers=%d cached=%t",
+			entry.Time.UTC().Format(time.RFC3339Nano), entry.Client, logValue(entry.Name),
+			entry.Type, entry.RCode, entry.Answers, entry.Cached)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf.Write(append(line, '\n'))
+}
+
+// Close writes out what is buffered and closes the file.
+func (l *queryLog) Close() error {
+	close(l.stop)
+	<-l.done
+	err := l.flush()
+	if closer, ok := l.out.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// logValue quotes s if it could not otherwise be read back as one value of
+// a key=value line.
+func logValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\\") || strconv.Quote(s) != `"`+s+`"` {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// logQuery records in the query log the query msg from source and the reply
+// it got, if any. cached reports whether every answer came from the cache.
+func (s *Server) logQuery(source net.Addr, msg *Message, reply []byte, cached bool) {
+	if len(reply) < 12 {
+		return
+	}
+	header := parseHeader(reply)
+	entry := queryLogEntry{
+		Time:    time.Now(),
+		Client:  clientIP(source).String(),
+		RCode:   header.ResponseCode.String(),
+		Answers: int(header.AnswerRecordCount),
+		Cached:  cached,
+	}
+	if len(msg.Question) > 0 {
+		entry.Name, entry.Type = msg.Question[0].Name, msg.Question[0].Type.String()
+	}
+	s.queryLog.record(entry)
+}
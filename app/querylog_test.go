@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loggedQueries answers a query for example.com twice, the second time from
+// the cache, and one for a blocked name, and returns the log lines written.
+func loggedQueries(t *testing.T, format QueryLogFormat) []string {
+	t.Helper()
+	cfg := testConfig(newMockUpstream(t, answerA))
+	blocklist, err := parseBlocklist(strings.NewReader("ads.example\n"))
+	if err != nil {
+		t.Fatalf("parseBlocklist: %v", err)
+	}
+	cfg.Blocklist = blocklist
+	s := newServer(cfg)
+	var out bytes.Buffer
+	s.queryLog = newQueryLog(&out, format, time.Hour)
+	for i, name := range []string{"example.com", "example.com", "ads.example"} {
+		if reply := s.answerRequest(context.Background(), clientAddr, newQuery(t, uint16(i), name, TypeA)); reply == nil {
+			t.Fatalf("no reply for %s", name)
+		}
+	}
+	if out.Len() != 0 {
+		t.Errorf("query log was written before a flush: %q", out.String())
+	}
+	if err := s.queryLog.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+}
+
+func TestQueryLogText(t *testing.T) {
+	lines := loggedQueries(t, TextQueryLog)
+	want := []string{
+		`client=127.0.0.1 name=example.com type=A rcode=NOERROR answers=1 cached=false`,
+		`client=127.0.0.1 name=example.com type=A rcode=NOERROR answers=1 cached=true`,
+		`client=127.0.0.1 name=ads.example type=A rcode=NXDOMAIN answers=0 cached=false`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("logged %d lines, want %d:\n%s", len(lines), len(want), strings.Join(lines, "\n"))
+	}
+	stamp := regexp.MustCompile(`^time=(\S+) (.*)$`)
+	for i, line := range lines {
+		m := stamp.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("line %q does not start with a timestamp", line)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, m[1]); err != nil {
+			t.Errorf("line %q: %v", line, err)
+		}
+		if m[2] != want[i] {
+			t.Errorf("line %d logged %q, want %q", i, m[2], want[i])
+		}
+	}
+}
+
+func TestQueryLogJSON(t *testing.T) {
+	lines := loggedQueries(t, JSONQueryLog)
+	want := []queryLogEntry{
+		{Client: "127.0.0.1", Name: "example.com", Type: "A", RCode: "NOERROR", Answers: 1},
+		{Client: "127.0.0.1", Name: "example.com", Type: "A", RCode: "NOERROR", Answers: 1, Cached: true},
+		{Client: "127.0.0.1", Name: "ads.example", Type: "A", RCode: "NXDOMAIN"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("logged %d lines, want %d:\n%s", len(lines), len(want), strings.Join(lines, "\n"))
+	}
+	for i, line := range lines {
+		var got queryLogEntry
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if got.Time.IsZero() {
+			t.Errorf("line %q has no time", line)
+		}
+		got.Time = time.Time{}
+		if got != want[i] {
+			t.Errorf("line %d logged %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestQueryLogFlushesPeriodically(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	if err := os.WriteFile(path, []byte("earlier\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newQueryLog(file, TextQueryLog, 10*time.Millisecond)
+	defer l.Close()
+	l.record(queryLogEntry{Time: time.Now(), Client: "192.0.2.1", Name: "odd name.example", Type: "A", RCode: "NOERROR"})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Split(string(data), "\n"); len(lines) == 3 {
+			if lines[0] != "earlier" || !strings.Contains(lines[1], `name="odd name.example" `) {
+				t.Fatalf("log file holds %q", data)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("query was not flushed; log file holds %q", data)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rateSweepInterval is how often idle clients are dropped from the limiter.
+const rateSweepInterval = time.Minute
+
+// rateLimiter is a token bucket per client IP. Each client may send a burst of
+// up to one second's worth of queries, refilled at the configured rate.
+type rateLimiter struct {
+	rate float64 // queries per second
+	now  func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		now:       time.Now,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// burst is the size of each bucket.
+func (l *rateLimiter) burst() float64 {
+	return max(l.rate, 1)
+}
+
+// allow takes a token from ip's bucket and reports whether there was one. A
+// nil limiter allows everything.
+func (l *rateLimiter) allow(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateSweepInterval {
+		l.sweep(now)
+	}
+
+	key := ip.String()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst(), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst(), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets every client whose bucket has refilled completely, since a
+// fresh bucket would behave the same. l.mu must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst() {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
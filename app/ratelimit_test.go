@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(5)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+	client := net.IPv4(192, 0, 2, 1)
+	other := net.IPv4(192, 0, 2, 2)
+
+	for i := 0; i < 5; i++ {
+		if !l.allow(client) {
+			t.Fatalf("query %d of the burst was throttled", i+1)
+		}
+	}
+	if l.allow(client) {
+		t.Fatal("query past the burst was allowed")
+	}
+	if !l.allow(other) {
+		t.Fatal("another client was throttled")
+	}
+
+	now = now.Add(200 * time.Millisecond)
+	if !l.allow(client) {
+		t.Fatal("refilled token was not available")
+	}
+	if l.allow(client) {
+		t.Fatal("more than one token refilled in 200ms at 5 qps")
+	}
+}
+
+func TestRateLimiterSweepsIdleClients(t *testing.T) {
+	l := newRateLimiter(1)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+	l.lastSweep = now
+	l.allow(net.IPv4(192, 0, 2, 1))
+	l.allow(net.IPv4(192, 0, 2, 2))
+
+	now = now.Add(rateSweepInterval)
+	l.allow(net.IPv4(192, 0, 2, 3))
+	if len(l.buckets) != 1 {
+		t.Fatalf("%d buckets after the sweep, want only the new client's", len(l.buckets))
+	}
+}
+
+func TestServerDropsThrottledQueries(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	cfg := testConfig(upstream)
+	cfg.RateLimit = 2
+	s := newServer(cfg)
+
+	answered := 0
+	for i := 0; i < 5; i++ {
+		if s.answerRequest(context.Background(), clientAddr, newQuery(t, uint16(i), "example.com", TypeA)) != nil {
+			answered++
+		}
+	}
+	if answered != 2 {
+		t.Fatalf("%d of 5 queries answered, want 2", answered)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// errRecordType is returned by the typed RData decoders when the Answer is
+// not of the type they decode.
+var errRecordType = errors.New("unexpected record type")
+
+// errRDataLength is returned when RData is not the length its type requires.
+var errRDataLength = errors.New("unexpected rdata length")
+
+// checkType returns errRecordType unless a is of type want.
+func checkType(a *Answer, want Type) error {
+	if a.Type != want {
+		return fmt.Errorf("%w: got %s, want %s", errRecordType, a.Type, want)
+	}
+	return nil
+}
+
+// AString formats the RData of an A record as a dotted-quad IPv4 address.
+func (a *Answer) AString() (string, error) {
+	if err := checkType(a, TypeA); err != nil {
+		return "", err
+	}
+	if a.RDLength != 4 || len(a.RData) != 4 {
+		return "", fmt.Errorf("%w: A record has %d bytes", errRDataLength, len(a.RData))
+	}
+	return net.IP(a.RData).String(), nil
+}
+
+// AAAAString formats the RData of an AAAA record as an IPv6 address. It goes
+// through netip rather than net.IP so that IPv4-mapped addresses keep their
+// ::ffff: prefix instead of being printed as a bare IPv4 address.
+func (a *Answer) AAAAString() (string, error) {
+	if err := checkType(a, TypeAAAA); err != nil {
+		return "", err
+	}
+	if a.RDLength != 16 || len(a.RData) != 16 {
+		return "", fmt.Errorf("%w: AAAA record has %d bytes", errRDataLength, len(a.RData))
+	}
+	return netip.AddrFrom16([16]byte(a.RData)).String(), nil
+}
+
+// rdataName decodes the domain name found off bytes into the RData of a,
+// resolving any compression pointers against buf, the message a was parsed
+// from. It returns the name and the RData offset just past it.
+func rdataName(buf []byte, a *Answer, off int) (string, int, error) {
+	end := a.RDataOffset + len(a.RData)
+	if end > len(buf) {
+		return "", 0, errTruncated
+	}
+	labels, next, err := parseLabels(buf, a.RDataOffset+off)
+	if err != nil {
+		return "", 0, err
+	}
+	if next > end {
+		return "", 0, fmt.Errorf("%w: name runs past rdata", errRDataLength)
+	}
+	return strings.Join(labels, "."), next - a.RDataOffset, nil
+}
+
+// parseCNAME returns the canonical name a CNAME record points at. buf must be
+// the message the record was parsed from.
+func parseCNAME(buf []byte, a *Answer) (string, error) {
+	if err := checkType(a, TypeCNAME); err != nil {
+		return "", err
+	}
+	target, _, err := rdataName(buf, a, 0)
+	return target, err
+}
+
+// parsePTR returns the host name a PTR record points at. buf must be the
+// message the record was parsed from.
+func parsePTR(buf []byte, a *Answer) (string, error) {
+	if err := checkType(a, TypePTR); err != nil {
+		return "", err
+	}
+	host, _, err := rdataName(buf, a, 0)
+	return host, err
+}
+
+// parseNS returns the host name of the nameserver an NS record delegates
+// to. buf must be the message the record was parsed from, since referrals
+// compress nameserver names against each other and the owner name.
+func parseNS(buf []byte, a *Answer) (string, error) {
+	if err := checkType(a, TypeNS); err != nil {
+		return "", err
+	}
+	host, _, err := rdataName(buf, a, 0)
+	return host, err
+}
+
+// DNAMERecord redirects every name below its owner to the same name below
+// Target (RFC 6672).
+type DNAMERecord struct {
+	Target string
+}
+
+// parseDNAME decodes a DNAME record. buf must be the message the record was
+// parsed from: RFC 6672 forbids compressing the target, but older servers
+// following RFC 2672 may still do so.
+func parseDNAME(buf []byte, a *Answer) (*DNAMERecord, error) {
+	if err := checkType(a, TypeDNAME); err != nil {
+		return nil, err
+	}
+	target, _, err := rdataName(buf, a, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &DNAMERecord{Target: target}, nil
+}
+
+// reverseName returns the name a PTR query for addr asks about: the address
+// octets reversed under in-addr.arpa for IPv4, or the address nibbles
+// reversed under ip6.arpa for IPv6.
+func reverseName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	b := addr.AsSlice()
+	labels := make([]string, 0, 2*len(b)+2)
+	for i := len(b) - 1; i >= 0; i-- {
+		if addr.Is4() {
+			labels = append(labels, strconv.Itoa(int(b[i])))
+		} else {
+			labels = append(labels, strconv.FormatUint(uint64(b[i]&0x0F), 16), strconv.FormatUint(uint64(b[i]>>4), 16))
+		}
+	}
+	if addr.Is4() {
+		return strings.Join(append(labels, "in-addr", "arpa"), ".")
+	}
+	return strings.Join(append(labels, "ip6", "arpa"), ".")
+}
+
+type MXRecord struct {
+	Preference uint16
+	Exchange   string
+}
+
+// parseMX decodes an MX record. buf must be the message the record was parsed
+// from since the exchange name is usually compressed.
+func parseMX(buf []byte, a *Answer) (*MXRecord, error) {
+	if err := checkType(a, TypeMX); err != nil {
+		return nil, err
+	}
+	if len(a.RData) < 3 {
+		return nil, fmt.Errorf("%w: MX record has %d bytes", errRDataLength, len(a.RData))
+	}
+	exchange, _, err := rdataName(buf, a, 2)
+	if err != nil {
+		return nil, err
+	}
+	return &MXRecord{
+		Preference: binary.BigEndian.Uint16(a.RData[:2]),
+		Exchange:   exchange,
+	}, nil
+}
+
+type SRVRecord struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// parseSRV decodes an SRV record. buf must be the message the record was
+// parsed from; RFC 2782 forbids compressing the target, but some servers do
+// it anyway.
+func parseSRV(buf []byte, a *Answer) (*SRVRecord, error) {
+	if err := checkType(a, TypeSRV); err != nil {
+		return nil, err
+	}
+	if len(a.RData) < 7 {
+		return nil, fmt.Errorf("%w: SRV record has %d bytes", errRDataLength, len(a.RData))
+	}
+	target, _, err := rdataName(buf, a, 6)
+	if err != nil {
+		return nil, err
+	}
+	return &SRVRecord{
+		Priority: binary.BigEndian.Uint16(a.RData[0:2]),
+		Weight:   binary.BigEndian.Uint16(a.RData[2:4]),
+		Port:     binary.BigEndian.Uint16(a.RData[4:6]),
+		Target:   target,
+	}, nil
+}
+
+// readCharString reads the length-prefixed character-string at off in rdata
+// and returns it along with the offset just past it.
+func readCharString(rdata []byte, off int) (string, int, error) {
+	if off >= len(rdata) {
+		return "", 0, fmt.Errorf("%w: missing character-string", errRDataLength)
+	}
+	end := off + 1 + int(rdata[off])
+	if end > len(rdata) {
+		return "", 0, fmt.Errorf("%w: character-string runs past rdata", errRDataLength)
+	}
+	return string(rdata[off+1 : end]), end, nil
+}
+
+// parseTXT splits the RData of a TXT record into its character-strings.
+func parseTXT(a *Answer) ([]string, error) {
+	if err := checkType(a, TypeTXT); err != nil {
+		return nil, err
+	}
+	strs := []string{}
+	for off := 0; off < len(a.RData); {
+		str, next, err := readCharString(a.RData, off)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, str)
+		off = next
+	}
+	return strs, nil
+}
+
+// CAARecord says which certificate authorities may issue certificates for a
+// domain (RFC 8659).
+type CAARecord struct {
+	Flags byte
+	Tag   string
+	Value string
+}
+
+// parseCAA decodes a CAA record: a flags byte, the tag as a
+// character-string and the value filling the rest of the RData.
+func parseCAA(a *Answer) (*CAARecord, error) {
+	if err := checkType(a, TypeCAA); err != nil {
+		return nil, err
+	}
+	if len(a.RData) < 2 {
+		return nil, fmt.Errorf("%w: CAA record has %d bytes", errRDataLength, len(a.RData))
+	}
+	if a.RData[1] == 0 {
+		return nil, fmt.Errorf("%w: CAA record has an empty tag", errRDataLength)
+	}
+	tag, end, err := readCharString(a.RData, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &CAARecord{
+		Flags: a.RData[0],
+		Tag:   tag,
+		Value: string(a.RData[end:]),
+	}, nil
+}
+
+// HINFORecord describes the hardware and operating system of a host
+// (RFC 1035 3.3.2).
+type HINFORecord struct {
+	CPU string
+	OS  string
+}
+
+// parseHINFO decodes an HINFO record: the CPU and the OS as two
+// character-strings that make up the whole RData.
+func parseHINFO(a *Answer) (*HINFORecord, error) {
+	if err := checkType(a, TypeHINFO); err != nil {
+		return nil, err
+	}
+	cpu, off, err := readCharString(a.RData, 0)
+	if err != nil {
+		return nil, err
+	}
+	system, off, err := readCharString(a.RData, off)
+	if err != nil {
+		return nil, err
+	}
+	if off != len(a.RData) {
+		return nil, fmt.Errorf("%w: HINFO record has %d bytes after the OS", errRDataLength, len(a.RData)-off)
+	}
+	return &HINFORecord{CPU: cpu, OS: system}, nil
+}
+
+// NAPTRRecord is a rewrite rule used to discover services such as SIP from a
+// domain or an ENUM telephone number (RFC 3403).
+type NAPTRRecord struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Services    string
+	Regexp      string
+	Replacement string
+}
+
+// parseNAPTR decodes a NAPTR record: the order and preference, the flags,
+// services and regexp as character-strings, and the replacement name. buf
+// must be the message the record was parsed from.
+func parseNAPTR(buf []byte, a *Answer) (*NAPTRRecord, error) {
+	if err := checkType(a, TypeNAPTR); err != nil {
+		return nil, err
+	}
+	if len(a.RData) < 4 {
+		return nil, fmt.Errorf("%w: NAPTR record has %d bytes", errRDataLength, len(a.RData))
+	}
+	naptr := &NAPTRRecord{
+		Order:      binary.BigEndian.Uint16(a.RData[0:2]),
+		Preference: binary.BigEndian.Uint16(a.RData[2:4]),
+	}
+	off := 4
+	for _, field := range []*string{&naptr.Flags, &naptr.Services, &naptr.Regexp} {
+		var err error
+		if *field, off, err = readCharString(a.RData, off); err != nil {
+			return nil, err
+		}
+	}
+	replacement, off, err := rdataName(buf, a, off)
+	if err != nil {
+		return nil, err
+	}
+	if off != len(a.RData) {
+		return nil, fmt.Errorf("%w: NAPTR record has %d bytes after the replacement", errRDataLength, len(a.RData)-off)
+	}
+	naptr.Replacement = replacement
+	return naptr, nil
+}
+
+// txtRData encodes strs as the RData of a TXT record, splitting any string
+// longer than a character-string can hold.
+func txtRData(strs ...string) []byte {
+	var rdata []byte
+	for _, s := range strs {
+		for {
+			chunk := s[:min(len(s), 255)]
+			rdata = append(rdata, byte(len(chunk)))
+			rdata = append(rdata, chunk...)
+			s = s[len(chunk):]
+			if s == "" {
+				break
+			}
+		}
+	}
+	return rdata
+}
+
+type SOARecord struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	// Minimum is the TTL RFC 2308 uses for negative answers from the zone.
+	Minimum uint32
+}
+
+// soaRData encodes soa as the RData of an SOA record, with its names
+// uncompressed.
+func soaRData(soa *SOARecord) ([]byte, error) {
+	// Each name takes at most two bytes more than its dotted form.
+	w := newNameWriter(false, len(soa.MName)+len(soa.RName)+4+20)
+	if err := w.writeName(soa.MName); err != nil {
+		return nil, err
+	}
+	if err := w.writeName(soa.RName); err != nil {
+		return nil, err
+	}
+	for _, field := range []uint32{soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum} {
+		w.buf = binary.BigEndian.AppendUint32(w.buf, field)
+	}
+	return w.buf, nil
+}
+
+// parseSOA decodes an SOA record. buf must be the message the record was
+// parsed from since both names may be compressed.
+func parseSOA(buf []byte, a *Answer) (*SOARecord, error) {
+	if err := checkType(a, TypeSOA); err != nil {
+		return nil, err
+	}
+	mname, off, err := rdataName(buf, a, 0)
+	if err != nil {
+		return nil, err
+	}
+	rname, off, err := rdataName(buf, a, off)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.RData)-off != 20 {
+		return nil, fmt.Errorf("%w: SOA record has %d bytes after its names", errRDataLength, len(a.RData)-off)
+	}
+	fields := a.RData[off:]
+	return &SOARecord{
+		MName:   mname,
+		RName:   rname,
+		Serial:  binary.BigEndian.Uint32(fields[0:4]),
+		Refresh: binary.BigEndian.Uint32(fields[4:8]),
+		Retry:   binary.BigEndian.Uint32(fields[8:12]),
+		Expire:  binary.BigEndian.Uint32(fields[12:16]),
+		Minimum: binary.BigEndian.Uint32(fields[16:20]),
+	}, nil
+}
+
+// rdataNames returns where the names in the RData of a record of type t are:
+// prefix is the number of fixed bytes before the first name, names the
+// number of consecutive names. Only the types whose names may be compressed
+// are known, and names is zero for the rest.
+func rdataNames(t Type) (prefix, names int) {
+	switch t {
+	case TypeNS, 3, 4, TypeCNAME, 7, 8, 9, TypePTR, TypeDNAME: // and MD, MF, MB, MG, MR
+		return 0, 1
+	case TypeSOA, 14: // and MINFO
+		return 0, 2
+	case TypeMX:
+		return 2, 1
+	}
+	return 0, 0
+}
+
+// expandNames rewrites the RData of a so that any compressed names in it are
+// written out in full. Records relayed or cached from an upstream response
+// need this: their pointers refer to offsets in the upstream's message and
+// would be meaningless in ours. Only the types RFC 3597 allows compression in
+// are affected, plus DNAME, which was compressible before RFC 6672.
+func expandNames(buf []byte, a *Answer) error {
+	prefix, names := rdataNames(a.Type)
+	if names == 0 {
+		return nil
+	}
+	if len(a.RData) < prefix {
+		return fmt.Errorf("%w: %d bytes is too short for %s", errRDataLength, len(a.RData), a.Type)
+	}
+
+	w := newNameWriter(false, 2*len(a.RData))
+	w.buf = append(w.buf, a.RData[:prefix]...)
+	off := prefix
+	for i := 0; i < names; i++ {
+		name, next, err := rdataName(buf, a, off)
+		if err != nil {
+			return err
+		}
+		if err := w.writeName(name); err != nil {
+			return err
+		}
+		off = next
+	}
+	w.buf = append(w.buf, a.RData[off:]...)
+	a.RData = w.buf
+	a.RDLength = uint16(len(w.buf))
+	return nil
+}
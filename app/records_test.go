@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestAString(t *testing.T) {
+	a := &Answer{Name: "example.com", Type: 1, Class: 1, RDLength: 4, RData: []byte{93, 184, 216, 34}}
+	got, err := a.AString()
+	if err != nil {
+		t.Fatalf("AString: %v", err)
+	}
+	if got != "93.184.216.34" {
+		t.Fatalf("AString = %q, want 93.184.216.34", got)
+	}
+}
+
+func TestAStringBadLength(t *testing.T) {
+	a := &Answer{Name: "example.com", Type: 1, Class: 1, RDLength: 3, RData: []byte{93, 184, 216}}
+	if _, err := a.AString(); !errors.Is(err, errRDataLength) {
+		t.Fatalf("got err %v, want %v", err, errRDataLength)
+	}
+	a = &Answer{Name: "example.com", Type: 28, Class: 1, RDLength: 4, RData: []byte{93, 184, 216, 34}}
+	if _, err := a.AString(); !errors.Is(err, errRecordType) {
+		t.Fatalf("got err %v, want %v", err, errRecordType)
+	}
+}
+
+func TestAAAAString(t *testing.T) {
+	tests := []struct {
+		rdata []byte
+		want  string
+	}{
+		{[]byte{0x26, 0x06, 0x28, 0x00, 0x02, 0x20, 0, 1, 0x2, 0x48, 0x18, 0x93, 0x25, 0xc8, 0x19, 0x46}, "2606:2800:220:1:248:1893:25c8:1946"},
+		{make([]byte, 16), "::"},
+		{[]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, "::1"},
+		{[]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 0, 2, 1}, "::ffff:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		a := &Answer{Name: "example.com", Type: 28, Class: 1, RDLength: 16, RData: tt.rdata}
+		got, err := a.AAAAString()
+		if err != nil {
+			t.Fatalf("AAAAString(%x): %v", tt.rdata, err)
+		}
+		if got != tt.want {
+			t.Errorf("AAAAString(%x) = %q, want %q", tt.rdata, got, tt.want)
+		}
+	}
+}
+
+func TestAAAAStringBadLength(t *testing.T) {
+	a := &Answer{Name: "example.com", Type: 28, Class: 1, RDLength: 4, RData: []byte{1, 2, 3, 4}}
+	if _, err := a.AAAAString(); !errors.Is(err, errRDataLength) {
+		t.Fatalf("got err %v, want %v", err, errRDataLength)
+	}
+}
+
+func TestAAAAToBytes(t *testing.T) {
+	rdata := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	a := &Answer{Name: "example.com", Type: 28, Class: 1, TTL: 300, RDLength: 16, RData: rdata}
+	buf, err := a.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes: %v", err)
+	}
+	if !bytes.Equal(buf[len(buf)-16:], rdata) {
+		t.Fatalf("serialized RData = %x, want %x", buf[len(buf)-16:], rdata)
+	}
+	parsed, _, err := parseAnswer(buf, 0)
+	if err != nil {
+		t.Fatalf("parseAnswer: %v", err)
+	}
+	if parsed.RDLength != 16 || !bytes.Equal(parsed.RData, rdata) {
+		t.Fatalf("parsed RData = %x (len %d), want %x", parsed.RData, parsed.RDLength, rdata)
+	}
+}
+
+// cnameResponse answers www.example.com A with a CNAME to example.com, whose
+// target is a pointer into the question name, followed by the A record.
+var cnameResponse = []byte{
+	0x12, 0x34, 0x81, 0x80, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+	0x03, 0x77, 0x77, 0x77, 0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65,
+	0x03, 0x63, 0x6f, 0x6d, 0x00, 0x00, 0x01, 0x00, 0x01, 0xc0, 0x0c, 0x00,
+	0x05, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c, 0x00, 0x02, 0xc0, 0x10, 0xc0,
+	0x10, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c, 0x00, 0x04, 0x5d,
+	0xb8, 0xd8, 0x22,
+}
+
+func TestParseCNAME(t *testing.T) {
+	msg, err := parseRequest(cnameResponse)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	target, err := parseCNAME(cnameResponse, msg.Answer[0])
+	if err != nil {
+		t.Fatalf("parseCNAME: %v", err)
+	}
+	if target != "example.com" {
+		t.Fatalf("CNAME target = %q, want example.com", target)
+	}
+	if _, err := parseCNAME(cnameResponse, msg.Answer[1]); !errors.Is(err, errRecordType) {
+		t.Fatalf("parseCNAME on A record: got err %v, want %v", err, errRecordType)
+	}
+}
+
+// mxResponse answers example.com MX with two exchanges at preferences 10 and
+// 20, both compressed against the question name.
+var mxResponse = []byte{
+	0x0f, 0x0f, 0x81, 0x80, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+	0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d,
+	0x00, 0x00, 0x0f, 0x00, 0x01, 0xc0, 0x0c, 0x00, 0x0f, 0x00, 0x01, 0x00,
+	0x00, 0x0e, 0x10, 0x00, 0x09, 0x00, 0x0a, 0x04, 0x6d, 0x61, 0x69, 0x6c,
+	0xc0, 0x0c, 0xc0, 0x0c, 0x00, 0x0f, 0x00, 0x01, 0x00, 0x00, 0x0e, 0x10,
+	0x00, 0x0b, 0x00, 0x14, 0x06, 0x62, 0x61, 0x63, 0x6b, 0x75, 0x70, 0xc0,
+	0x0c,
+}
+
+func TestParseMX(t *testing.T) {
+	msg, err := parseRequest(mxResponse)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	want := []MXRecord{
+		{Preference: 10, Exchange: "mail.example.com"},
+		{Preference: 20, Exchange: "backup.example.com"},
+	}
+	if len(msg.Answer) != len(want) {
+		t.Fatalf("got %d answers, want %d", len(msg.Answer), len(want))
+	}
+	for i, w := range want {
+		mx, err := parseMX(mxResponse, msg.Answer[i])
+		if err != nil {
+			t.Fatalf("parseMX %d: %v", i, err)
+		}
+		if *mx != w {
+			t.Errorf("MX %d = %+v, want %+v", i, *mx, w)
+		}
+	}
+}
+
+func TestParseTXT(t *testing.T) {
+	tests := []struct {
+		rdata []byte
+		want  []string
+	}{
+		{[]byte("\x0bv=spf1 -all\x05hello"), []string{"v=spf1 -all", "hello"}},
+		{[]byte{0}, []string{""}},
+		{[]byte("\x00\x02hi"), []string{"", "hi"}},
+	}
+	for _, tt := range tests {
+		a := &Answer{Type: 16, Class: 1, RDLength: uint16(len(tt.rdata)), RData: tt.rdata}
+		got, err := parseTXT(a)
+		if err != nil {
+			t.Fatalf("parseTXT(%q): %v", tt.rdata, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTXT(%q) = %q, want %q", tt.rdata, got, tt.want)
+		}
+	}
+}
+
+func TestParseTXTOverrun(t *testing.T) {
+	rdata := []byte("\x05hi")
+	a := &Answer{Type: 16, Class: 1, RDLength: uint16(len(rdata)), RData: rdata}
+	if _, err := parseTXT(a); !errors.Is(err, errRDataLength) {
+		t.Fatalf("got err %v, want %v", err, errRDataLength)
+	}
+}
+
+func TestExpandNames(t *testing.T) {
+	msg, err := parseResponse(cnameResponse)
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	want := []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}
+	if !bytes.Equal(msg.Answer[0].RData, want) || msg.Answer[0].RDLength != uint16(len(want)) {
+		t.Fatalf("expanded CNAME RData = %x, want %x", msg.Answer[0].RData, want)
+	}
+
+	// The relayed SOA must still parse once it is in a different message.
+	msg, err = parseResponse(nxdomainResponse)
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	relayed := mustBytes(t, msg)
+	reparsed, err := parseRequest(relayed)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	soa := reparsed.Authority[0]
+	name, next, err := rdataName(relayed, soa, 0)
+	if err != nil || name != "ns.icann.org" {
+		t.Fatalf("MNAME = %q, %v", name, err)
+	}
+	if name, _, err = rdataName(relayed, soa, next); err != nil || name != "noc.dns.icann.org" {
+		t.Fatalf("RNAME = %q, %v", name, err)
+	}
+	if parsed, err := parseSOA(relayed, soa); err != nil || parsed.Minimum != 3600 {
+		t.Fatalf("parseSOA = %+v, %v", parsed, err)
+	}
+}
+
+func TestParseSOA(t *testing.T) {
+	msg, err := parseRequest(nxdomainResponse)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	soa, err := parseSOA(nxdomainResponse, msg.Authority[0])
+	if err != nil {
+		t.Fatalf("parseSOA: %v", err)
+	}
+	want := &SOARecord{
+		MName:   "ns.icann.org",
+		RName:   "noc.dns.icann.org",
+		Serial:  2024081501,
+		Refresh: 7200,
+		Retry:   3600,
+		Expire:  1209600,
+		Minimum: 3600,
+	}
+	if !reflect.DeepEqual(soa, want) {
+		t.Fatalf("parseSOA = %+v, want %+v", soa, want)
+	}
+
+	short := *msg.Authority[0]
+	short.RData = short.RData[:len(short.RData)-1]
+	if _, err := parseSOA(nxdomainResponse, &short); !errors.Is(err, errRDataLength) {
+		t.Fatalf("got err %v, want %v", err, errRDataLength)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"127.0.0.1", "1.0.0.127.in-addr.arpa"},
+		{"192.0.2.10", "10.2.0.192.in-addr.arpa"},
+		{"::ffff:192.0.2.10", "10.2.0.192.in-addr.arpa"},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+	for _, tt := range tests {
+		if got := reverseName(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("reverseName(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestParsePTR(t *testing.T) {
+	// 8.8.8.8.in-addr.arpa PTR dns.google, with the answer name compressed.
+	buf := []byte{
+		0x12, 0x34, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x01, '8', 0x01, '8', 0x01, '8', 0x01, '8',
+		0x07, 'i', 'n', '-', 'a', 'd', 'd', 'r', 0x04, 'a', 'r', 'p', 'a', 0x00,
+		0x00, 0x0c, 0x00, 0x01,
+		0xc0, 0x0c, 0x00, 0x0c, 0x00, 0x01, 0x00, 0x00, 0x0e, 0x10, 0x00, 0x0c,
+		0x03, 'd', 'n', 's', 0x06, 'g', 'o', 'o', 'g', 'l', 'e', 0x00,
+	}
+	msg, err := parseRequest(buf)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if msg.Question[0].Name != reverseName(netip.MustParseAddr("8.8.8.8")) {
+		t.Fatalf("question name = %q", msg.Question[0].Name)
+	}
+	host, err := parsePTR(buf, msg.Answer[0])
+	if err != nil {
+		t.Fatalf("parsePTR: %v", err)
+	}
+	if host != "dns.google" {
+		t.Fatalf("parsePTR = %q, want dns.google", host)
+	}
+	if _, err := parsePTR(buf, &Answer{Type: TypeA}); !errors.Is(err, errRecordType) {
+		t.Fatalf("got err %v, want %v", err, errRecordType)
+	}
+}
+
+// srvResponse answers _sip._tcp.example.com SRV with two targets, the one at
+// priority 20 listed before the one at priority 10.
+var srvResponse = []byte{
+	0x5e, 0x5e, 0x81, 0x80, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+	0x04, 0x5f, 0x73, 0x69, 0x70, 0x04, 0x5f, 0x74, 0x63, 0x70, 0x07, 0x65,
+	0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00, 0x00,
+	0x21, 0x00, 0x01, 0xc0, 0x0c, 0x00, 0x21, 0x00, 0x01, 0x00, 0x00, 0x01,
+	0x2c, 0x00, 0x18, 0x00, 0x14, 0x00, 0x00, 0x13, 0xc4, 0x04, 0x73, 0x69,
+	0x70, 0x32, 0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x03, 0x63,
+	0x6f, 0x6d, 0x00, 0xc0, 0x0c, 0x00, 0x21, 0x00, 0x01, 0x00, 0x00, 0x01,
+	0x2c, 0x00, 0x18, 0x00, 0x0a, 0x00, 0x3c, 0x13, 0xc4, 0x04, 0x73, 0x69,
+	0x70, 0x31, 0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x03, 0x63,
+	0x6f, 0x6d, 0x00,
+}
+
+func TestParseSRV(t *testing.T) {
+	msg, err := parseRequest(srvResponse)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if len(msg.Answer) != 2 {
+		t.Fatalf("got %d answers, want 2", len(msg.Answer))
+	}
+	want := []*SRVRecord{
+		{Priority: 20, Weight: 0, Port: 5060, Target: "sip2.example.com"},
+		{Priority: 10, Weight: 60, Port: 5060, Target: "sip1.example.com"},
+	}
+	for i, a := range msg.Answer {
+		srv, err := parseSRV(srvResponse, a)
+		if err != nil {
+			t.Fatalf("parseSRV %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(srv, want[i]) {
+			t.Errorf("parseSRV %d = %+v, want %+v", i, srv, want[i])
+		}
+	}
+	if got, want := msg.Answer[1].String(), "_sip._tcp.example.com.\t300\tIN\tSRV\t10 60 5060 sip1.example.com."; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	short := &Answer{Type: TypeSRV, RDLength: 6, RData: []byte{0, 1, 0, 2, 0, 3}}
+	if _, err := parseSRV(short.RData, short); !errors.Is(err, errRDataLength) {
+		t.Fatalf("got err %v, want %v", err, errRDataLength)
+	}
+}
+
+// referralResponse delegates example.com to a.iana-servers.net and
+// b.iana-servers.net, the second name compressed against the first, with
+// glue A records for both in the additional section.
+var referralResponse = []byte{
+	0x2a, 0x2a, 0x80, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x02,
+	0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d,
+	0x00, 0x00, 0x01, 0x00, 0x01, 0xc0, 0x0c, 0x00, 0x02, 0x00, 0x01, 0x00,
+	0x02, 0xa3, 0x00, 0x00, 0x14, 0x01, 0x61, 0x0c, 0x69, 0x61, 0x6e, 0x61,
+	0x2d, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x73, 0x03, 0x6e, 0x65, 0x74,
+	0x00, 0xc0, 0x0c, 0x00, 0x02, 0x00, 0x01, 0x00, 0x02, 0xa3, 0x00, 0x00,
+	0x04, 0x01, 0x62, 0xc0, 0x2b, 0xc0, 0x29, 0x00, 0x01, 0x00, 0x01, 0x00,
+	0x02, 0xa3, 0x00, 0x00, 0x04, 0xc7, 0x2b, 0x87, 0x35, 0xc0, 0x49, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x02, 0xa3, 0x00, 0x00, 0x04, 0xc7, 0x2b, 0x85,
+	0x35,
+}
+
+func TestParseNS(t *testing.T) {
+	msg, err := parseRequest(referralResponse)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if len(msg.Answer) != 0 || len(msg.Authority) != 2 || len(msg.Additional) != 2 {
+		t.Fatalf("got %d/%d/%d records, want a referral", len(msg.Answer), len(msg.Authority), len(msg.Additional))
+	}
+	wantNS := []string{"a.iana-servers.net", "b.iana-servers.net"}
+	for i, a := range msg.Authority {
+		host, err := parseNS(referralResponse, a)
+		if err != nil {
+			t.Fatalf("parseNS %d: %v", i, err)
+		}
+		if host != wantNS[i] {
+			t.Errorf("parseNS %d = %q, want %q", i, host, wantNS[i])
+		}
+	}
+	// The glue is owned by the names the NS records point at.
+	for i, a := range msg.Additional {
+		if a.Name != wantNS[i] || a.Type != TypeA {
+			t.Errorf("glue %d is %s %v, want A for %s", i, a.Name, a.Type, wantNS[i])
+		}
+	}
+
+	resp, err := parseResponse(referralResponse)
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	if got, want := resp.Authority[1].String(), "example.com.\t172800\tIN\tNS\tb.iana-servers.net."; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if _, err := parseNS(referralResponse, &Answer{Type: TypeA}); !errors.Is(err, errRecordType) {
+		t.Fatalf("got err %v, want %v", err, errRecordType)
+	}
+}
+
+func TestParseCAA(t *testing.T) {
+	rdata := append([]byte{0, 5}, "issueletsencrypt.org"...)
+	a := &Answer{Name: "example.com", Type: TypeCAA, Class: 1, TTL: 3600, RDLength: uint16(len(rdata)), RData: rdata}
+	caa, err := parseCAA(a)
+	if err != nil {
+		t.Fatalf("parseCAA: %v", err)
+	}
+	want := &CAARecord{Flags: 0, Tag: "issue", Value: "letsencrypt.org"}
+	if !reflect.DeepEqual(caa, want) {
+		t.Fatalf("parseCAA = %+v, want %+v", caa, want)
+	}
+	if got, want := a.String(), "example.com.\t3600\tIN\tCAA\t0 issue \"letsencrypt.org\""; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	for _, rdata := range [][]byte{
+		{0},
+		{0, 0, 'x'},
+		append([]byte{128, 9}, "issue"...),
+	} {
+		bad := &Answer{Type: TypeCAA, RDLength: uint16(len(rdata)), RData: rdata}
+		if _, err := parseCAA(bad); !errors.Is(err, errRDataLength) {
+			t.Errorf("parseCAA(%q) err = %v, want %v", rdata, err, errRDataLength)
+		}
+	}
+}
+
+func TestParseHINFO(t *testing.T) {
+	rdata := append(append([]byte{}, txtRData("INTEL-386")...), txtRData("Linux 6.1")...)
+	a := &Answer{Name: "host.example.com", Type: TypeHINFO, Class: 1, TTL: 3600, RDLength: uint16(len(rdata)), RData: rdata}
+	hinfo, err := parseHINFO(a)
+	if err != nil {
+		t.Fatalf("parseHINFO: %v", err)
+	}
+	want := &HINFORecord{CPU: "INTEL-386", OS: "Linux 6.1"}
+	if !reflect.DeepEqual(hinfo, want) {
+		t.Fatalf("parseHINFO = %+v, want %+v", hinfo, want)
+	}
+	if got, want := a.String(), "host.example.com.\t3600\tIN\tHINFO\t\"INTEL-386\" \"Linux 6.1\""; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	for _, rdata := range [][]byte{
+		{},
+		{3, 'x', '8', '6'},
+		{3, 'x', '8', '6', 5, 'L', 'i'},
+		append(append([]byte{}, rdata...), 0),
+	} {
+		bad := &Answer{Type: TypeHINFO, RDLength: uint16(len(rdata)), RData: rdata}
+		if _, err := parseHINFO(bad); !errors.Is(err, errRDataLength) {
+			t.Errorf("parseHINFO(%q) err = %v, want %v", rdata, err, errRDataLength)
+		}
+	}
+}
+
+func TestParseNAPTR(t *testing.T) {
+	// The ENUM entry for +1-555-0100, sending calls to a SIP URI.
+	rdata := append([]byte{0, 100, 0, 10}, txtRData("u", "E2U+sip", "!^.*$!sip:info@example.com!")...)
+	rdata = append(rdata, 0)
+	a := &Answer{Name: "0.0.1.0.5.5.5.1.e164.arpa", Type: TypeNAPTR, Class: 1, TTL: 3600, RDLength: uint16(len(rdata)), RData: rdata}
+	naptr, err := parseNAPTR(rdata, a)
+	if err != nil {
+		t.Fatalf("parseNAPTR: %v", err)
+	}
+	want := &NAPTRRecord{Order: 100, Preference: 10, Flags: "u", Services: "E2U+sip", Regexp: "!^.*$!sip:info@example.com!"}
+	if !reflect.DeepEqual(naptr, want) {
+		t.Fatalf("parseNAPTR = %+v, want %+v", naptr, want)
+	}
+	if got, want := a.String(), `0.0.1.0.5.5.5.1.e164.arpa.	3600	IN	NAPTR	100 10 "u" "E2U+sip" "!^.*$!sip:info@example.com!" .`; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	// A rule that hands over to the SIP-over-UDP SRV records instead.
+	rdata = append([]byte{0, 10, 0, 0}, txtRData("s", "SIP+D2U", "")...)
+	rdata = append(rdata, nameRData(t, "_sip._udp.example.com")...)
+	a = &Answer{Type: TypeNAPTR, RDLength: uint16(len(rdata)), RData: rdata}
+	if naptr, err = parseNAPTR(rdata, a); err != nil || naptr.Replacement != "_sip._udp.example.com" {
+		t.Fatalf("parseNAPTR = %+v, %v, want replacement _sip._udp.example.com", naptr, err)
+	}
+
+	for _, rdata := range [][]byte{
+		{0, 1, 0},
+		{0, 1, 0, 2, 1, 'u', 0},
+		append(append([]byte{0, 1, 0, 2}, txtRData("u", "E2U+sip", "")...), 0, 0),
+	} {
+		bad := &Answer{Type: TypeNAPTR, RDLength: uint16(len(rdata)), RData: rdata}
+		if _, err := parseNAPTR(rdata, bad); !errors.Is(err, errRDataLength) {
+			t.Errorf("parseNAPTR(%q) err = %v, want %v", rdata, err, errRDataLength)
+		}
+	}
+}
+
+// dnameResponse answers www.old.example.com A through a DNAME redirecting
+// old.example.com to new.example.com, with the target compressed, the CNAME
+// synthesized from it and the A record it leads to.
+var dnameResponse = []byte{
+	0x3c, 0x3c, 0x81, 0x80, 0x00, 0x01, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00,
+	0x03, 0x77, 0x77, 0x77, 0x03, 0x6f, 0x6c, 0x64, 0x07, 0x65, 0x78, 0x61,
+	0x6d, 0x70, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00, 0x00, 0x01, 0x00,
+	0x01, 0xc0, 0x10, 0x00, 0x27, 0x00, 0x01, 0x00, 0x00, 0x0e, 0x10, 0x00,
+	0x06, 0x03, 0x6e, 0x65, 0x77, 0xc0, 0x14, 0xc0, 0x0c, 0x00, 0x05, 0x00,
+	0x01, 0x00, 0x00, 0x0e, 0x10, 0x00, 0x06, 0x03, 0x77, 0x77, 0x77, 0xc0,
+	0x31, 0xc0, 0x43, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c, 0x00,
+	0x04, 0xc0, 0x00, 0x02, 0x50,
+}
+
+func TestParseDNAME(t *testing.T) {
+	msg, err := parseRequest(dnameResponse)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if len(msg.Answer) != 3 || msg.Answer[0].Name != "old.example.com" {
+		t.Fatalf("unexpected answers %+v", msg.Answer)
+	}
+	dname, err := parseDNAME(dnameResponse, msg.Answer[0])
+	if err != nil {
+		t.Fatalf("parseDNAME: %v", err)
+	}
+	if dname.Target != "new.example.com" {
+		t.Fatalf("parseDNAME = %q, want new.example.com", dname.Target)
+	}
+	if _, err := parseDNAME(dnameResponse, msg.Answer[1]); !errors.Is(err, errRecordType) {
+		t.Fatalf("got err %v, want %v", err, errRecordType)
+	}
+
+	// The target is expanded for relaying, so it prints without the
+	// original message.
+	resp, err := parseResponse(dnameResponse)
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	if got, want := resp.Answer[0].String(), "old.example.com.\t3600\tIN\tDNAME\tnew.example.com."; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got, want := resp.Answer[1].String(), "www.old.example.com.\t3600\tIN\tCNAME\twww.new.example.com."; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
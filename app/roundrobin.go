@@ -0,0 +1,28 @@
+package main
+
+import "strings"
+
+// rotateAddresses rotates each set of A or AAAA records in answers left by n
+// places, so that clients that always use the first address of a name are
+// spread over all of them as n changes from one response to the next. A set
+// is a run of records with the same name and type, which is how resolvers
+// send them.
+func rotateAddresses(answers []*Answer, n uint32) {
+	for start := 0; start < len(answers); {
+		end := start + 1
+		for end < len(answers) && sameRRset(answers[start], answers[end]) {
+			end++
+		}
+		if set := answers[start:end]; len(set) > 1 && (set[0].Type == TypeA || set[0].Type == TypeAAAA) {
+			shift := int(n % uint32(len(set)))
+			rotated := append(append([]*Answer{}, set[shift:]...), set[:shift]...)
+			copy(set, rotated)
+		}
+		start = end
+	}
+}
+
+// sameRRset reports whether a and b belong to the same set of records.
+func sameRRset(a, b *Answer) bool {
+	return a.Type == b.Type && a.Class == b.Class && strings.EqualFold(a.Name, b.Name)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRotateAddresses(t *testing.T) {
+	record := func(name string, qtype Type, last byte) *Answer {
+		return &Answer{Name: name, Type: qtype, Class: 1, RData: []byte{192, 0, 2, last}}
+	}
+	answers := []*Answer{
+		record("www.example.com", TypeCNAME, 0),
+		record("web.example.com", TypeA, 1),
+		record("WEB.example.com", TypeA, 2),
+		record("web.example.com", TypeA, 3),
+		record("mail.example.com", TypeMX, 4),
+		record("mail.example.com", TypeMX, 5),
+	}
+	rotateAddresses(answers, 4)
+	var got []byte
+	for _, a := range answers {
+		got = append(got, a.RData[3])
+	}
+	// The addresses move one place, 4 mod 3, and the rest stay put.
+	if want := []byte{0, 2, 3, 1, 4, 5}; string(got) != string(want) {
+		t.Fatalf("rotated order %v, want %v", got, want)
+	}
+}
+
+func TestRoundRobinAcrossResponses(t *testing.T) {
+	zone, err := parseZone(strings.NewReader("10.0.0.1 web.example\n10.0.0.2 web.example\n10.0.0.3 web.example\n"), defaultLocalTTL)
+	if err != nil {
+		t.Fatalf("parseZone: %v", err)
+	}
+	firsts := func(roundRobin bool) []byte {
+		cfg := testConfig(newMockUpstream(t, answerA))
+		cfg.Zone, cfg.RoundRobin = zone, roundRobin
+		s := newServer(cfg)
+		var first []byte
+		for i := 0; i < 4; i++ {
+			resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 1, "web.example", TypeA)))
+			if err != nil || len(resp.Answer) != 3 {
+				t.Fatalf("response %+v, %v", resp, err)
+			}
+			first = append(first, resp.Answer[0].RData[3])
+		}
+		return first
+	}
+
+	if got, want := firsts(true), []byte{2, 3, 1, 2}; string(got) != string(want) {
+		t.Errorf("with round robin, first addresses end in %v, want %v", got, want)
+	}
+	if got, want := firsts(false), []byte{1, 1, 1, 1}; string(got) != string(want) {
+		t.Errorf("without round robin, first addresses end in %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,1111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockUpstream is a UDP resolver on a loopback port that answers every query
+// with whatever handle returns for it, and remembers the queries it saw.
+type mockUpstream struct {
+	conn   *net.UDPConn
+	handle func(req *Message) *Message
+
+	mu      sync.Mutex
+	queries []*Message
+}
+
+func newMockUpstream(t testing.TB, handle func(req *Message) *Message) *mockUpstream {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	u := &mockUpstream{conn: conn, handle: handle}
+	t.Cleanup(func() { conn.Close() })
+	go u.serve()
+	return u
+}
+
+func (u *mockUpstream) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := parseRequest(buf[:n])
+		if err != nil {
+			continue
+		}
+		u.mu.Lock()
+		u.queries = append(u.queries, req)
+		u.mu.Unlock()
+		if resp := u.handle(req); resp != nil {
+			if buf, err := resp.ToBytes(); err == nil {
+				u.conn.WriteToUDP(buf, addr)
+			}
+		}
+	}
+}
+
+func (u *mockUpstream) addr() *net.UDPAddr {
+	return u.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (u *mockUpstream) seen() []*Message {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]*Message(nil), u.queries...)
+}
+
+// upstream returns the mock as an Upstream reached over UDP.
+func (u *mockUpstream) upstream() Upstream {
+	return &udpUpstream{addr: u.addr()}
+}
+
+// answerA answers every query with a single A record for 192.0.2.1.
+func answerA(req *Message) *Message {
+	header := *req.Header
+	header.QR = 1
+	return &Message{
+		Header:   &header,
+		Question: req.Question,
+		Answer: []*Answer{
+			{Name: req.Question[0].Name, Type: 1, Class: 1, TTL: 60, RDLength: 4, RData: []byte{192, 0, 2, 1}},
+		},
+	}
+}
+
+func testConfig(upstream *mockUpstream) *Config {
+	return &Config{
+		Upstreams: []Upstream{upstream.upstream()},
+		Timeout:   time.Second,
+		Retries:   0,
+	}
+}
+
+// clientAddr stands in for the address of the client sending a request.
+var clientAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+
+func newQuery(t *testing.T, id uint16, name string, qtype Type) []byte {
+	msg := &Message{
+		Header:   &Header{ID: id, RecursionDesired: 1},
+		Question: []*Question{{Name: name, Type: qtype, Class: 1}},
+	}
+	return mustBytes(t, msg)
+}
+
+func TestUpstreamIDIsRandomized(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+
+	const clientID = 0x1234
+	for i := 0; i < 5; i++ {
+		// Distinct names so none of the queries are served from the cache.
+		name := string(rune('a'+i)) + ".example.com"
+		response := s.answerRequest(context.Background(), clientAddr, newQuery(t, clientID, name, 1))
+		if response == nil {
+			t.Fatalf("no response for %s", name)
+		}
+		if id := parseHeader(response).ID; id != clientID {
+			t.Fatalf("response ID = %#x, want the client's %#x", id, clientID)
+		}
+	}
+
+	randomized := false
+	for _, q := range upstream.seen() {
+		if q.Header.ID != clientID {
+			randomized = true
+		}
+	}
+	if !randomized {
+		t.Fatalf("every upstream query reused the client's ID")
+	}
+	if len(s.pending.byID) != 0 {
+		t.Fatalf("%d upstream IDs left pending", len(s.pending.byID))
+	}
+}
+
+func TestUnresponsiveUpstreamGivesServfail(t *testing.T) {
+	upstream := newMockUpstream(t, func(*Message) *Message { return nil })
+	cfg := testConfig(upstream)
+	cfg.Timeout = 50 * time.Millisecond
+	cfg.Retries = 2
+	s := newServer(cfg)
+
+	response := s.answerRequest(context.Background(), clientAddr, newQuery(t, 7, "example.com", 1))
+	if response == nil {
+		t.Fatalf("request was dropped")
+	}
+	resp, err := parseRequest(response)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	h := resp.Header
+	if h.ID != 7 || h.QR != 1 || h.ResponseCode != 2 || h.RecursionAvailable != 1 {
+		t.Fatalf("unexpected response header %+v", h)
+	}
+	if len(resp.Question) != 1 || resp.Question[0].Name != "example.com" {
+		t.Fatalf("question not echoed: %+v", resp.Question)
+	}
+	if n := len(upstream.seen()); n != 3 {
+		t.Fatalf("upstream saw %d queries, want 3", n)
+	}
+}
+
+func TestServeStaleWhenUpstreamFails(t *testing.T) {
+	// The upstream answers, then goes quiet for one query, then answers
+	// with a new address.
+	var queries atomic.Int32
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		switch queries.Add(1) {
+		case 1:
+			return answerAWith([]byte{192, 0, 2, 1}, 0)(req)
+		case 2:
+			return nil
+		}
+		return answerAWith([]byte{192, 0, 2, 2}, 0)(req)
+	})
+	cfg := testConfig(upstream)
+	cfg.Timeout = 50 * time.Millisecond
+	cfg.ServeStale = time.Hour
+	s := newServer(cfg)
+	now := time.Now()
+	s.cache.now = func() time.Time { return now }
+
+	ask := func() *Message {
+		t.Helper()
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 9, "example.com", TypeA)))
+		if err != nil {
+			t.Fatalf("parseRequest: %v", err)
+		}
+		return resp
+	}
+	ask()
+	now = now.Add(2 * time.Minute)
+	resp := ask()
+	if resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 1 {
+		t.Fatalf("got %+v, want the stale answer", resp)
+	}
+	if a := resp.Answer[0]; !bytes.Equal(a.RData, []byte{192, 0, 2, 1}) || a.TTL != staleTTL {
+		t.Fatalf("stale answer %s, want 192.0.2.1 with TTL %d", a, staleTTL)
+	}
+
+	// The stale answer is refreshed in the background.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if cached, ok := s.cache.Get(resp.Question[0], false); ok && bytes.Equal(cached.Answer[0].RData, []byte{192, 0, 2, 2}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stale answer was not refreshed; upstream saw %d queries", queries.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOtherOpcodesNotImplemented(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+	for _, opcode := range []OpCode{OpCodeIQuery, OpCodeStatus, OpCodeNotify, OpCodeUpdate} {
+		query := mustBytes(t, &Message{
+			Header:   &Header{ID: 1, OpCode: opcode, RecursionDesired: 1},
+			Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		})
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, query))
+		if err != nil || resp.Header.ResponseCode != RCodeNotImp || len(resp.Answer) != 0 {
+			t.Errorf("%s: got %+v, %v; want NOTIMP", opcode, resp, err)
+		}
+	}
+	if n := len(upstream.seen()); n != 0 {
+		t.Fatalf("upstream saw %d queries, want none", n)
+	}
+}
+
+func TestPanickingRefreshIsRecovered(t *testing.T) {
+	// The upstream answers, then fails, so that the answer is served
+	// stale, and then panics on the refresh.
+	var queries atomic.Int32
+	refreshed := make(chan struct{})
+	cfg := testConfig(newMockUpstream(t, answerA))
+	cfg.Upstreams = []Upstream{upstreamFunc(func(ctx context.Context, req *Message) (*Message, error) {
+		switch queries.Add(1) {
+		case 1:
+			return answerA(req), nil
+		case 2:
+			return nil, errors.New("unreachable")
+		case 3:
+			close(refreshed)
+			panic("refresh bug")
+		}
+		return answerA(req), nil
+	})}
+	cfg.ServeStale = time.Hour
+	s := newServer(cfg)
+	now := time.Now()
+	s.cache.now = func() time.Time { return now }
+	ask := func() *Message {
+		t.Helper()
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 9, "example.com", TypeA)))
+		if err != nil {
+			t.Fatalf("parseRequest: %v", err)
+		}
+		return resp
+	}
+
+	ask()
+	now = now.Add(2 * time.Minute)
+	if resp := ask(); len(resp.Answer) != 1 {
+		t.Fatalf("got %+v, want the stale answer", resp)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("the stale answer was not refreshed")
+	}
+
+	// The server outlived the panic and goes on answering.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if resp := ask(); resp.Header.ResponseCode == RCodeNoError && len(resp.Answer) == 1 && resp.Answer[0].TTL != staleTTL {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no fresh answer after the panicking refresh; upstream saw %d queries", queries.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPrefetchRefreshesPopularAnswer(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	cfg := testConfig(upstream)
+	cfg.Prefetch = 2
+	s := newServer(cfg)
+	now := time.Now()
+	s.cache.now = func() time.Time { return now }
+	ask := func() {
+		t.Helper()
+		if s.answerRequest(context.Background(), clientAddr, newQuery(t, 11, "example.com", TypeA)) == nil {
+			t.Fatalf("request was dropped")
+		}
+	}
+
+	// answerA's records live for 60 seconds, so the second hit comes with
+	// less than a tenth of that left.
+	ask()
+	ask()
+	now = now.Add(55 * time.Second)
+	ask()
+
+	q := &Question{Name: "example.com", Type: TypeA, Class: 1}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if cached, ok := s.cache.Get(q, false); ok && cached.Answer[0].TTL == 60 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("answer was not prefetched; upstream saw %d queries", len(upstream.seen()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := len(upstream.seen()); n != 2 {
+		t.Fatalf("upstream saw %d queries, want 2", n)
+	}
+}
+
+func TestServerSurvivesPanickingPacket(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	go s.serveUDP(listener)
+
+	client, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+
+	// Shorter than a header, which the parser used to index past the end of.
+	if _, err := client.Write([]byte{0x12, 0x34, 0x01}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := client.Write(newQuery(t, 9, "example.com", TypeA)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, ednsUDPSize)
+	for {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("server stopped answering: %v", err)
+		}
+		if resp, err := parseRequest(buf[:n]); err == nil && resp.Header.ID == 9 {
+			return
+		}
+	}
+}
+
+func TestShortPacketGivesFormerr(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+
+	response := s.answerRequest(context.Background(), clientAddr, []byte{0xbe, 0xef, 0x01, 0x00, 0x00})
+	if response == nil {
+		t.Fatalf("request was dropped")
+	}
+	resp, err := parseRequest(response)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Header.ID != 0xbeef || resp.Header.QR != 1 || resp.Header.ResponseCode != RCodeFormErr {
+		t.Fatalf("got %+v, want a FORMERR response with ID 0xbeef", resp.Header)
+	}
+
+	if response := s.answerRequest(context.Background(), clientAddr, []byte{0xbe}); response != nil {
+		t.Fatalf("answered a packet without an ID: %x", response)
+	}
+	if n := len(upstream.seen()); n != 0 {
+		t.Fatalf("upstream saw %d queries, want none", n)
+	}
+}
+
+func TestBadCountsGiveFormerr(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+
+	query := newQuery(t, 0x4242, "example.com", TypeA)
+	query[4], query[5] = 0xff, 0xff
+	response := s.answerRequest(context.Background(), clientAddr, query)
+	if response == nil {
+		t.Fatalf("request was dropped")
+	}
+	resp, err := parseRequest(response)
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Header.ID != 0x4242 || resp.Header.ResponseCode != RCodeFormErr || len(resp.Question) != 0 {
+		t.Fatalf("got ID %#x rcode %s with %d questions, want FORMERR", resp.Header.ID, resp.Header.ResponseCode, len(resp.Question))
+	}
+	if n := len(upstream.seen()); n != 0 {
+		t.Fatalf("upstream saw %d queries, want none", n)
+	}
+}
+
+func TestClampTTLs(t *testing.T) {
+	records := []*Answer{
+		{Type: TypeA, TTL: 0},
+		{Type: TypeA, TTL: 30},
+		{Type: TypeA, TTL: 300},
+		{Type: TypeA, TTL: 86400 * 7},
+		{Type: TypeOPT, TTL: 0x8000},
+	}
+	clampTTLs(records, 30, 86400)
+	for i, want := range []uint32{30, 30, 300, 86400, 0x8000} {
+		if records[i].TTL != want {
+			t.Errorf("record %d TTL = %d, want %d", i, records[i].TTL, want)
+		}
+	}
+
+	unbounded := []*Answer{{Type: TypeA, TTL: 1 << 30}}
+	clampTTLs(unbounded, 0, 0)
+	if unbounded[0].TTL != 1<<30 {
+		t.Errorf("TTL = %d with no bounds, want it unchanged", unbounded[0].TTL)
+	}
+}
+
+func TestRelayedTTLsAreClamped(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	cfg := testConfig(upstream)
+	cfg.MinTTL = 120
+	s := newServer(cfg)
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 1, "example.com", TypeA)))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Answer[0].TTL != 120 {
+		t.Fatalf("relayed TTL = %d, want it raised to 120", resp.Answer[0].TTL)
+	}
+	cached, ok := s.cache.Get(&Question{Name: "example.com", Type: TypeA, Class: 1}, false)
+	if !ok || cached.Answer[0].TTL != 120 {
+		t.Fatalf("cached answer %+v, want TTL 120", cached)
+	}
+}
+
+func TestMultipleQuestions(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+
+	query := mustBytes(t, &Message{
+		Header: &Header{ID: 0x0b0b, RecursionDesired: 1},
+		Question: []*Question{
+			{Name: "one.example.com", Type: TypeA, Class: 1},
+			{Name: "two.example.com", Type: TypeA, Class: 1},
+		},
+	})
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, query))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Header.ID != 0x0b0b || resp.Header.QuestionCount != 2 || resp.Header.AnswerRecordCount != 2 {
+		t.Fatalf("unexpected header %+v", resp.Header)
+	}
+	for i, name := range []string{"one.example.com", "two.example.com"} {
+		if resp.Question[i].Name != name || resp.Answer[i].Name != name {
+			t.Errorf("question/answer %d = %s/%s, want %s", i, resp.Question[i].Name, resp.Answer[i].Name, name)
+		}
+	}
+
+	seen := upstream.seen()
+	if len(seen) != 2 {
+		t.Fatalf("upstream saw %d queries, want 2", len(seen))
+	}
+	for _, q := range seen {
+		if len(q.Question) != 1 || q.Header.QuestionCount != 1 {
+			t.Errorf("upstream query carried %d questions, want 1", len(q.Question))
+		}
+	}
+}
+
+func TestResponseSetsRecursionAvailable(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+
+	for _, rd := range []byte{0, 1} {
+		query := mustBytes(t, &Message{
+			Header:   &Header{ID: 0x0101, RecursionDesired: rd},
+			Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		})
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, query))
+		if err != nil {
+			t.Fatalf("parseRequest: %v", err)
+		}
+		if resp.Header.RecursionAvailable != 1 {
+			t.Errorf("RD=%d: response has RA=0", rd)
+		}
+		if resp.Header.RecursionDesired != rd {
+			t.Errorf("RD=%d: response has RD=%d", rd, resp.Header.RecursionDesired)
+		}
+	}
+}
+
+func TestForceRD(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		upstream := newMockUpstream(t, answerA)
+		cfg := testConfig(upstream)
+		cfg.ForceRD = force
+		s := newServer(cfg)
+		query := mustBytes(t, &Message{
+			Header:   &Header{ID: 0x0102},
+			Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		})
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, query))
+		if err != nil || len(resp.Answer) != 1 {
+			t.Fatalf("force %v: response %+v, %v", force, resp, err)
+		}
+		if resp.Header.RDBit() {
+			t.Errorf("force %v: response has RD set, but the query did not", force)
+		}
+		if sent := upstream.seen()[0].Header.RDBit(); sent != force {
+			t.Errorf("force %v: upstream query has RD %v", force, sent)
+		}
+	}
+}
+
+func TestCacheOnly(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	cfg := testConfig(upstream)
+	cfg.CacheOnly = true
+	s := newServer(cfg)
+	cached := &Question{Name: "cached.example", Type: TypeA, Class: 1}
+	s.cache.Put(cached, answerA(&Message{Header: &Header{ID: 1}, Question: []*Question{cached}}), false)
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 2, "cached.example", TypeA)))
+	if err != nil || resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 1 {
+		t.Fatalf("cached name got %+v, %v", resp, err)
+	}
+	resp, err = parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 3, "missing.example", TypeA)))
+	if err != nil || resp.Header.ResponseCode != RCodeServFail {
+		t.Fatalf("uncached name got %+v, %v; want SERVFAIL", resp, err)
+	}
+	if n := len(upstream.seen()); n != 0 {
+		t.Fatalf("upstream saw %d queries, want none", n)
+	}
+}
+
+func TestNoAAAA(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	cfg := testConfig(upstream)
+	cfg.NoAAAA = true
+	cfg.LocalTTL = 60
+	s := newServer(cfg)
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 1, "example.com", TypeAAAA)))
+	if err != nil || resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 0 {
+		t.Fatalf("AAAA got %+v, %v; want NODATA", resp, err)
+	}
+	if len(resp.Authority) != 1 || resp.Authority[0].Type != TypeSOA || resp.Authority[0].TTL != 60 {
+		t.Fatalf("authority %+v, want an SOA with TTL 60", resp.Authority)
+	}
+	local := *resp.Authority[0]
+	local.RDataOffset = 0
+	soa, err := parseSOA(local.RData, &local)
+	if err != nil || soa.Minimum != 60 {
+		t.Fatalf("SOA %+v, %v; want a minimum of 60", soa, err)
+	}
+	if n := len(upstream.seen()); n != 0 {
+		t.Fatalf("AAAA query was forwarded")
+	}
+
+	resp, err = parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 2, "example.com", TypeA)))
+	if err != nil || len(resp.Answer) != 1 {
+		t.Fatalf("A got %+v, %v", resp, err)
+	}
+	if n := len(upstream.seen()); n != 1 {
+		t.Fatalf("upstream saw %d queries, want the A query", n)
+	}
+}
+
+func TestRelaysAuthorityAndAdditional(t *testing.T) {
+	soa := append(append(nameRData(t, "ns.example.com"), nameRData(t, "admin.example.com")...),
+		0, 0, 0, 1, 0, 0, 0x0e, 0x10, 0, 0, 0x03, 0x84, 0, 0x09, 0x3a, 0x80, 0, 0, 0x01, 0x2c)
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		header := *req.Header
+		header.QR = 1
+		return &Message{
+			Header:    &header,
+			Question:  req.Question,
+			Authority: []*Answer{{Name: "example.com", Type: TypeSOA, Class: 1, TTL: 300, RDLength: uint16(len(soa)), RData: soa}},
+			Additional: []*Answer{
+				{Name: "ns.example.com", Type: TypeA, Class: 1, TTL: 300, RDLength: 4, RData: []byte{192, 0, 2, 53}},
+				(&OPT{UDPSize: 1232}).toAnswer(),
+			},
+		}
+	})
+	s := newServer(testConfig(upstream))
+	query := mustBytes(t, &Message{
+		Header:     &Header{ID: 5, RecursionDesired: 1},
+		Question:   []*Question{{Name: "nodata.example.com", Type: TypeAAAA, Class: 1}},
+		Additional: []*Answer{(&OPT{UDPSize: 1232}).toAnswer()},
+	})
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, query))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Header.AuthorativeRecordCount != 1 || len(resp.Authority) != 1 || resp.Authority[0].Type != TypeSOA || !bytes.Equal(resp.Authority[0].RData, soa) {
+		t.Fatalf("authority section %+v, want the upstream's SOA", resp.Authority)
+	}
+	// The glue is relayed, and the upstream's OPT replaced by ours.
+	if resp.Header.AdditionalRecordCount != 2 || len(resp.Additional) != 2 {
+		t.Fatalf("additional section %+v, want the glue and an OPT", resp.Additional)
+	}
+	if glue := resp.Additional[0]; glue.Type != TypeA || !bytes.Equal(glue.RData, []byte{192, 0, 2, 53}) {
+		t.Errorf("additional record %+v, want the glue", glue)
+	}
+	if opt, err := resp.OPT(); err != nil || opt == nil || opt.UDPSize != ednsUDPSize {
+		t.Errorf("response OPT %+v, %v", opt, err)
+	}
+}
+
+func TestTTLJitterOnlyAffectsCache(t *testing.T) {
+	cfg := testConfig(newMockUpstream(t, answerA))
+	cfg.TTLJitter = 20
+	s := newServer(cfg)
+	s.cache.jitter = func() float64 { return 0 }
+
+	// The first response is relayed with the upstream's TTL, and later
+	// ones come from the cached copy, 20% shorter.
+	for i, want := range []uint32{60, 48} {
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, uint16(i), "example.com", TypeA)))
+		if err != nil || len(resp.Answer) != 1 {
+			t.Fatalf("response %+v, %v", resp, err)
+		}
+		if got := resp.Answer[0].TTL; got != want {
+			t.Errorf("response %d has TTL %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestACLRefusesOutsiders(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	cfg := testConfig(upstream)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	cfg.AllowedClients = []*net.IPNet{loopback}
+	s := newServer(cfg)
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 1, "example.com", TypeA)))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 1 {
+		t.Fatalf("allowed client got rcode %s with %d answers", resp.Header.ResponseCode, len(resp.Answer))
+	}
+
+	outsider := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 5353}
+	resp, err = parseRequest(s.answerRequest(context.Background(), outsider, newQuery(t, 2, "example.org", TypeA)))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Header.ID != 2 || resp.Header.ResponseCode != RCodeRefused || len(resp.Answer) != 0 {
+		t.Fatalf("outsider got ID %d rcode %s with %d answers, want REFUSED", resp.Header.ID, resp.Header.ResponseCode, len(resp.Answer))
+	}
+	if n := len(upstream.seen()); n != 1 {
+		t.Fatalf("upstream saw %d queries, want 1", n)
+	}
+}
+
+func TestListenOnEphemeralPort(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+	udpConn, tcpListener, err := listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer udpConn.Close()
+	defer tcpListener.Close()
+	go s.serveUDP(udpConn)
+	go s.serveTCP(tcpListener)
+
+	addr := udpConn.LocalAddr().(*net.UDPAddr)
+	if tcpAddr := tcpListener.Addr().(*net.TCPAddr); tcpAddr.Port != addr.Port {
+		t.Fatalf("TCP bound port %d, UDP port %d", tcpAddr.Port, addr.Port)
+	}
+	req := &Message{
+		Header:   &Header{ID: 0x5151, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	resp, err := exchange(withTimeout(t, time.Second), req, conn)
+	if err != nil {
+		t.Fatalf("UDP exchange: %v", err)
+	}
+	if resp.Header.ID != 0x5151 || len(resp.Answer) != 1 {
+		t.Fatalf("unexpected UDP reply %+v", resp)
+	}
+
+	raw, err := queryDNSTCP(context.Background(), req, addr.String())
+	if err != nil {
+		t.Fatalf("TCP query: %v", err)
+	}
+	if resp, err = parseRequest(raw); err != nil || len(resp.Answer) != 1 {
+		t.Fatalf("unexpected TCP reply %+v, %v", resp, err)
+	}
+}
+
+func TestLargeUDPResponseIsTruncated(t *testing.T) {
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		resp.Answer = manyAnswers(req.Question[0].Name, 50)
+		return resp
+	})
+	s := newServer(testConfig(upstream))
+
+	query := newQuery(t, 1, "big.example.com", TypeA)
+	response := s.answerRequest(context.Background(), clientAddr, query)
+	if len(response) > minUDPSize {
+		t.Fatalf("UDP response is %d bytes", len(response))
+	}
+	header := parseHeader(response)
+	if header.Truncation != 1 || header.QuestionCount != 1 {
+		t.Fatalf("UDP response header %+v, want TC and the question", header)
+	}
+
+	tcpClient := &net.TCPAddr{IP: clientAddr.IP, Port: clientAddr.Port}
+	resp, err := parseResponse(s.answerRequest(context.Background(), tcpClient, query))
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	if resp.Header.Truncation != 0 || len(resp.Answer) != 50 {
+		t.Fatalf("TCP response TC=%d with %d answers", resp.Header.Truncation, len(resp.Answer))
+	}
+
+	edns := &Message{
+		Header:     &Header{ID: 2, RecursionDesired: 1},
+		Question:   []*Question{{Name: "big.example.com", Type: TypeA, Class: 1}},
+		Additional: []*Answer{(&OPT{UDPSize: 1232}).toAnswer()},
+	}
+	resp, err = parseResponse(s.answerRequest(context.Background(), clientAddr, mustBytes(t, edns)))
+	if err != nil {
+		t.Fatalf("parseResponse: %v", err)
+	}
+	if resp.Header.Truncation != 0 || len(resp.Answer) != 50 {
+		t.Fatalf("EDNS response TC=%d with %d answers", resp.Header.Truncation, len(resp.Answer))
+	}
+}
+
+func TestADBitRelayed(t *testing.T) {
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		resp.Header.AuthenticData = 1
+		return resp
+	})
+	s := newServer(testConfig(upstream))
+
+	for i, tt := range []struct {
+		ad, cd byte
+		wantAD bool
+	}{
+		{ad: 1, wantAD: true},
+		{ad: 1, cd: 1, wantAD: true},
+		{ad: 0, wantAD: false},
+	} {
+		// Distinct names so each query reaches the upstream.
+		name := string(rune('a'+i)) + ".example.com"
+		query := &Message{
+			Header:   &Header{ID: uint16(i), RecursionDesired: 1, AuthenticData: tt.ad, CheckingDisabled: tt.cd},
+			Question: []*Question{{Name: name, Type: TypeA, Class: 1}},
+		}
+		header := parseHeader(s.answerRequest(context.Background(), clientAddr, mustBytes(t, query)))
+		if header.ADBit() != tt.wantAD || header.CheckingDisabled != tt.cd {
+			t.Errorf("query with AD=%d CD=%d: response AD=%d CD=%d", tt.ad, tt.cd, header.AuthenticData, header.CheckingDisabled)
+		}
+	}
+}
+
+func TestADBitCached(t *testing.T) {
+	// Like a validating resolver, the upstream only sets AD for queries
+	// that ask for it.
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		resp.Header.SetAD(req.Header.ADBit())
+		return resp
+	})
+	s := newServer(testConfig(upstream))
+
+	for i, ad := range []byte{0, 1} {
+		query := &Message{
+			Header:   &Header{ID: uint16(i), RecursionDesired: 1, AuthenticData: ad},
+			Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		}
+		header := parseHeader(s.answerRequest(context.Background(), clientAddr, mustBytes(t, query)))
+		if header.AuthenticData != ad {
+			t.Errorf("query %d with AD=%d: response AD=%d", i, ad, header.AuthenticData)
+		}
+	}
+	if n := len(upstream.seen()); n != 1 {
+		t.Fatalf("upstream saw %d queries, want the second answered from the cache", n)
+	}
+}
+
+func TestDNSSECOKForwarded(t *testing.T) {
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		opt, _ := req.OPT()
+		resp.Header.SetAD(opt != nil && opt.DNSSECOK)
+		return resp
+	})
+	s := newServer(testConfig(upstream))
+	query := &Message{
+		Header:     &Header{ID: 1, RecursionDesired: 1},
+		Question:   []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		Additional: []*Answer{(&OPT{UDPSize: 1232, DNSSECOK: true}).toAnswer()},
+	}
+	for i := 0; i < 2; i++ {
+		header := parseHeader(s.answerRequest(context.Background(), clientAddr, mustBytes(t, query)))
+		if !header.ADBit() {
+			t.Errorf("query %d with DO set: response has no AD", i)
+		}
+	}
+	seen := upstream.seen()
+	if len(seen) != 1 {
+		t.Fatalf("upstream saw %d queries, want the second answered from the cache", len(seen))
+	}
+	if opt, err := seen[0].OPT(); err != nil || opt == nil || !opt.DNSSECOK {
+		t.Errorf("upstream query OPT %+v, %v; want DO set", opt, err)
+	}
+
+	// The answer fetched with DO is not given to a query without it.
+	s.answerRequest(context.Background(), clientAddr, newQuery(t, 2, "example.com", TypeA))
+	seen = upstream.seen()
+	if len(seen) != 2 {
+		t.Fatalf("upstream saw %d queries, want the query without DO forwarded", len(seen))
+	}
+	if opt, err := seen[1].OPT(); err != nil || opt == nil || opt.DNSSECOK {
+		t.Errorf("upstream query OPT %+v, %v; want DO clear", opt, err)
+	}
+}
+
+func TestCheckingDisabledPassedThrough(t *testing.T) {
+	// A validating upstream: bogus.example fails validation unless the
+	// query turns it off, and everything else validates.
+	upstream := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		resp.Header.SetAD(false)
+		if req.Header.CDBit() {
+			return resp
+		}
+		if strings.EqualFold(req.Question[0].Name, "bogus.example") {
+			resp.Answer = nil
+			resp.Header.ResponseCode = RCodeServFail
+			return resp
+		}
+		resp.Header.SetAD(true)
+		return resp
+	})
+	s := newServer(testConfig(upstream))
+	ask := func(id uint16, name string, cd bool) *Message {
+		t.Helper()
+		query := &Message{
+			Header:   &Header{ID: id, RecursionDesired: 1, AuthenticData: 1},
+			Question: []*Question{{Name: name, Type: TypeA, Class: 1}},
+		}
+		query.Header.SetCD(cd)
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, mustBytes(t, query)))
+		if err != nil {
+			t.Fatalf("parseRequest: %v", err)
+		}
+		if resp.Header.CDBit() != cd {
+			t.Errorf("query %d with CD %v: response has CD %v", id, cd, resp.Header.CDBit())
+		}
+		return resp
+	}
+	sentCD := func() []bool {
+		var cds []bool
+		for _, q := range upstream.seen() {
+			cds = append(cds, q.Header.CDBit())
+		}
+		return cds
+	}
+
+	// With CD, the client gets the data validation would have refused.
+	if resp := ask(1, "bogus.example", true); resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 1 || resp.Header.ADBit() {
+		t.Fatalf("CD query for bogus data got %s", resp)
+	}
+	// That answer was not cached for clients that want validation.
+	if resp := ask(2, "bogus.example", false); resp.Header.ResponseCode != RCodeServFail {
+		t.Fatalf("validated query for bogus data got %s", resp)
+	}
+	// The upstream's AD comes back, and a validated answer in the cache
+	// serves CD queries too.
+	if resp := ask(3, "good.example", false); !resp.Header.ADBit() {
+		t.Errorf("validated answer lost AD: %s", resp)
+	}
+	if resp := ask(4, "good.example", true); len(resp.Answer) != 1 {
+		t.Errorf("CD query for a cached name got %s", resp)
+	}
+	if got, want := sentCD(), []bool{true, false, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("upstream queries had CD %v, want %v", got, want)
+	}
+}
+
+func TestServeWaitsForHandlers(t *testing.T) {
+	upstream := newMockUpstream(t, answerAWith([]byte{192, 0, 2, 1}, 200*time.Millisecond))
+	s := newServer(testConfig(upstream))
+	var out, dumped bytes.Buffer
+	s.queryLog = newQueryLog(&out, TextQueryLog, time.Hour)
+	dump, err := newPacketDump(&dumped, time.Hour)
+	if err != nil {
+		t.Fatalf("newPacketDump: %v", err)
+	}
+	s.dump = dump
+	udpConn, tcpListener, err := listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.serve([]*net.UDPConn{udpConn}, []*net.TCPListener{tcpListener})
+		close(done)
+	}()
+
+	client, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write(newQuery(t, 1, "example.com", TypeA)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for len(upstream.seen()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The query is still waiting on the upstream when the sockets close.
+	udpConn.Close()
+	tcpListener.Close()
+	<-done
+	if err := s.queryLog.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !strings.Contains(out.String(), "name=example.com") {
+		t.Fatalf("query log %q is missing the query answered during shutdown", out.String())
+	}
+	// The reply cannot go out on the closed socket, but the request was
+	// dumped, and nothing was written to the dump once closed.
+	if err := dump.Close(); err != nil {
+		t.Fatalf("closing dump: %v", err)
+	}
+	if packets := readPcap(t, dumped.Bytes()); len(packets) != 1 {
+		t.Fatalf("dumped %d packets, want the request", len(packets))
+	}
+}
+
+func TestServeDualStack(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+	udpConns, tcpListeners, err := listenAll([]*net.UDPAddr{
+		{IP: net.IPv4(127, 0, 0, 1)},
+		{IP: net.IPv6loopback},
+	})
+	if err != nil {
+		t.Skipf("cannot bind both IPv4 and IPv6 loopback: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.serve(udpConns, tcpListeners)
+		close(done)
+	}()
+
+	for i, conn := range udpConns {
+		addr := conn.LocalAddr().(*net.UDPAddr)
+		client, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			t.Fatalf("dial %s: %v", addr, err)
+		}
+		req := &Message{
+			Header:   &Header{ID: uint16(i), RecursionDesired: 1},
+			Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+		}
+		resp, err := exchange(withTimeout(t, time.Second), req, client)
+		client.Close()
+		if err != nil {
+			t.Fatalf("query over %s: %v", addr, err)
+		}
+		if resp.Header.ID != uint16(i) || len(resp.Answer) != 1 {
+			t.Fatalf("unexpected reply over %s: %+v", addr, resp)
+		}
+		if raw, err := queryDNSTCP(context.Background(), req, addr.String()); err != nil || parseHeader(raw).AnswerRecordCount != 1 {
+			t.Fatalf("TCP query over %s failed: %v", addr, err)
+		}
+	}
+
+	// serve returns once every socket is closed.
+	for i := range udpConns {
+		udpConns[i].Close()
+		tcpListeners[i].Close()
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("serve did not return after its sockets were closed")
+	}
+}
+
+func TestResponseEchoesQuestion(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	s := newServer(testConfig(upstream))
+	// The first query goes upstream under a randomized spelling, and the
+	// second is answered from the entry the first one cached.
+	for i, name := range []string{"MiXeD.ExAmPlE.cOm", "mixed.EXAMPLE.com"} {
+		query := newQuery(t, uint16(i), name, TypeA)
+		response := s.answerRequest(context.Background(), clientAddr, query)
+		if len(response) < len(query) {
+			t.Fatalf("%s: response is only %d bytes", name, len(response))
+		}
+		if got, want := response[12:len(query)], query[12:]; !bytes.Equal(got, want) {
+			t.Errorf("%s: question section %x, want %x", name, got, want)
+		}
+	}
+	if n := len(upstream.seen()); n != 1 {
+		t.Fatalf("upstream saw %d queries, want 1", n)
+	}
+}
+
+// upstreamFunc adapts a function to the Upstream interface.
+type upstreamFunc func(ctx context.Context, req *Message) (*Message, error)
+
+func (f upstreamFunc) Exchange(ctx context.Context, req *Message) (*Message, error) {
+	return f(ctx, req)
+}
+
+func (f upstreamFunc) String() string { return "func" }
+
+func TestFailuresGiveServfail(t *testing.T) {
+	// closedAddr is a loopback port nothing listens on.
+	closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	closedAddr := closed.LocalAddr().(*net.UDPAddr)
+	closed.Close()
+
+	// garbage answers every query with its ID followed by junk.
+	garbage, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer garbage.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := garbage.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			garbage.WriteToUDP(append(buf[:2:n], 0x81, 0x80, 0xff, 0xff, 0, 1), addr)
+		}
+	}()
+
+	tests := []struct {
+		name     string
+		upstream Upstream
+	}{
+		{"unreachable upstream", &udpUpstream{addr: closedAddr}},
+		{"unparsable reply", &udpUpstream{addr: garbage.LocalAddr().(*net.UDPAddr)}},
+		{"exchange error", upstreamFunc(func(context.Context, *Message) (*Message, error) {
+			return nil, errors.New("dial failed")
+		})},
+		{"mismatched reply", upstreamFunc(func(_ context.Context, req *Message) (*Message, error) {
+			resp := answerA(req)
+			resp.Header.ID++
+			return resp, nil
+		})},
+		{"unencodable reply", upstreamFunc(func(_ context.Context, req *Message) (*Message, error) {
+			resp := answerA(req)
+			resp.Answer[0].Name = strings.Repeat("x", 64) + ".example.com"
+			return resp, nil
+		})},
+		{"panic", upstreamFunc(func(context.Context, *Message) (*Message, error) {
+			panic("bug")
+		})},
+	}
+	for i, tt := range tests {
+		cfg := &Config{Upstreams: []Upstream{tt.upstream}, Timeout: 100 * time.Millisecond}
+		s := newServer(cfg)
+		response := s.answerRequest(context.Background(), clientAddr, newQuery(t, uint16(i), "example.com", TypeA))
+		if response == nil {
+			t.Errorf("%s: request was dropped", tt.name)
+			continue
+		}
+		resp, err := parseRequest(response)
+		if err != nil {
+			t.Errorf("%s: parseRequest: %v", tt.name, err)
+			continue
+		}
+		if h := resp.Header; h.ID != uint16(i) || h.ResponseCode != RCodeServFail || !h.RABit() || !h.QRBit() {
+			t.Errorf("%s: response header %+v, want SERVFAIL", tt.name, h)
+		}
+		if len(resp.Question) != 1 || resp.Question[0].Name != "example.com" {
+			t.Errorf("%s: question not echoed: %+v", tt.name, resp.Question)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// flight is an upstream query under way, which other requests for the same
+// question can wait on instead of sending their own.
+type flight struct {
+	done chan struct{}
+	resp *Message
+	err  error
+	// waiters counts the callers still waiting on the flight, and cancel
+	// stops the query once none are. Both are guarded by the group's mu.
+	waiters int
+	cancel  context.CancelFunc
+	// panicked is what the query panicked with, if it did, for every
+	// waiter to panic with in turn.
+	panicked any
+}
+
+// flightGroup coalesces concurrent cache misses for the same question into
+// one upstream query, so that a popular name expiring does not send a query
+// upstream for every client asking for it. It is safe for concurrent use.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[cacheKey]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[cacheKey]*flight)}
+}
+
+// do returns the result of fn for key, calling it only if no call for key is
+// already under way and otherwise waiting for that call's result, which is
+// then shared with the caller. The response is shared with every caller and
+// must not be modified.
+//
+// fn runs on a goroutine of its own, so that it carries on for the others if
+// the caller that started it stops waiting, as each does once its ctx is
+// done. The context fn is given keeps the values of the first caller's ctx
+// but is only cancelled once every caller has stopped waiting; a later call
+// for key then starts afresh.
+func (g *flightGroup) do(ctx context.Context, key cacheKey, fn func(ctx context.Context) (*Message, error)) (*Message, error) {
+	g.mu.Lock()
+	f, shared := g.flights[key]
+	if !shared {
+		flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+		go func() {
+			defer func() {
+				f.panicked = recover()
+				cancel()
+				g.mu.Lock()
+				if g.flights[key] == f {
+					delete(g.flights, key)
+				}
+				g.mu.Unlock()
+				close(f.done)
+			}()
+			f.resp, f.err = fn(flightCtx)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		if f.panicked != nil {
+			panic(f.panicked)
+		}
+		return f.resp, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		if f.waiters--; f.waiters == 0 {
+			f.cancel()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentMissesShareUpstreamQuery(t *testing.T) {
+	// The reply is slow enough for every query to arrive while the first
+	// is still waiting on it.
+	upstream := newMockUpstream(t, answerAWith([]byte{192, 0, 2, 1}, 100*time.Millisecond))
+	s := newServer(testConfig(upstream))
+
+	const n = 20
+	names := []string{"example.com", "EXAMPLE.com", "Example.Com", "example.COM"}
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id uint16, name string) {
+			defer wg.Done()
+			resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, id, name, TypeA)))
+			switch {
+			case err != nil:
+				errs <- err
+			case resp.Header.ID != id || resp.Header.ResponseCode != RCodeNoError || len(resp.Answer) != 1:
+				errs <- errors.New("unexpected response " + resp.String())
+			case resp.Question[0].Name != name || resp.Answer[0].Name != name:
+				errs <- errors.New("response for " + name + " spells it " + resp.Answer[0].Name)
+			}
+		}(uint16(i), names[i%len(names)])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if got := len(upstream.seen()); got != 1 {
+		t.Fatalf("upstream saw %d queries, want 1", got)
+	}
+}
+
+func TestFlightGroupWaiterGivesUp(t *testing.T) {
+	g := newFlightGroup()
+	key := cacheKey{Name: "example.com", Type: TypeA, Class: 1}
+	release := make(chan struct{})
+	want := &Message{Header: &Header{ID: 1}}
+	first := make(chan *Message)
+	go func() {
+		resp, _ := g.do(context.Background(), key, func(context.Context) (*Message, error) {
+			<-release
+			return want, nil
+		})
+		first <- resp
+	}()
+	for {
+		g.mu.Lock()
+		_, running := g.flights[key]
+		g.mu.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A waiter whose context ends stops waiting, without affecting the
+	// query it joined.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := g.do(ctx, key, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got err %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if resp := <-first; resp != want {
+		t.Fatalf("got %v, want the query's response", resp)
+	}
+}
+
+func TestFlightGroupCancelledWhenAllGiveUp(t *testing.T) {
+	g := newFlightGroup()
+	key := cacheKey{Name: "example.com", Type: TypeA, Class: 1}
+	cancelled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	joined := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := g.do(ctx, key, func(ctx context.Context) (*Message, error) {
+				<-ctx.Done()
+				close(cancelled)
+				return nil, ctx.Err()
+			})
+			joined <- err
+		}()
+	}
+	for {
+		g.mu.Lock()
+		f := g.flights[key]
+		waiting := f != nil && f.waiters == 2
+		g.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-joined; !errors.Is(err, context.Canceled) {
+			t.Fatalf("got err %v, want %v", err, context.Canceled)
+		}
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("query carried on with nobody waiting for it")
+	}
+}
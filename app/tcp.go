@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// tcpIdleTimeout is how long a TCP client may stay silent between queries
+// before its connection is closed.
+const tcpIdleTimeout = 10 * time.Second
+
+// tcpQueryTimeout bounds a whole query to an upstream over TCP.
+const tcpQueryTimeout = 5 * time.Second
+
+// maxTCPMessageSize is the most the two-byte length prefix of DNS over TCP
+// can announce, and so the largest message any transport carries.
+const maxTCPMessageSize = 0xFFFF
+
+// readTCPMessage reads one message framed with the two-byte length prefix
+// used by DNS over TCP (RFC 1035 4.2.2). The prefix caps the message at
+// maxTCPMessageSize, but is not trusted beyond that: the buffer grows as the
+// message arrives, so a peer that announces 64KB and sends nothing does not
+// get that much allocated for it.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(prefix[:]))
+	msg, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return msg, nil
+}
+
+// writeTCPMessage writes msg with its two-byte length prefix.
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > maxTCPMessageSize {
+		return fmt.Errorf("message of %d bytes is too large for TCP", len(msg))
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// tcpUpstream reaches a resolver over plain DNS over TCP, with a connection
+// of its own for each query.
+type tcpUpstream struct {
+	addr string
+}
+
+func (u *tcpUpstream) Exchange(ctx context.Context, req *Message) (*Message, error) {
+	resp, err := queryDNSTCP(ctx, req, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(resp)
+}
+
+func (u *tcpUpstream) String() string {
+	return "tcp://" + u.addr
+}
+
+func (s *Server) serveTCP(listener *net.TCPListener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("accepting TCP connection failed", "err", err)
+			continue
+		}
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.handleTCPConnection(conn)
+		}()
+	}
+}
+
+// handleTCPConnection answers queries on conn until the client closes it or
+// goes idle. Clients may pipeline several queries on one connection.
+//
+// Requests are read on a goroutine of their own while the previous one is
+// answered, so that the client closing the connection is noticed at once.
+// Nobody is left to answer then, so the upstream queries still running for
+// the connection are cancelled. The idle timeout only runs while no request
+// is being answered.
+func (s *Server) handleTCPConnection(conn net.Conn) {
+	defer conn.Close()
+	defer recoverPanic(conn.RemoteAddr(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	requests := make(chan []byte)
+	conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+	go func() {
+		defer cancel()
+		defer close(requests)
+		for {
+			request, err := readTCPMessage(conn)
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					slog.Warn("reading TCP request failed", "client", conn.RemoteAddr(), "err", err)
+				}
+				return
+			}
+			select {
+			case requests <- request:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for request := range requests {
+		conn.SetReadDeadline(time.Time{})
+		response := s.answerRequest(ctx, conn.RemoteAddr(), request)
+		if response == nil || ctx.Err() != nil {
+			return
+		}
+		if err := writeTCPMessage(conn, response); err != nil {
+			slog.Error("sending TCP response failed", "client", conn.RemoteAddr(), "err", err)
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+	}
+}
+
+// queryDNSTCP sends msg to the upstream at addr over TCP and returns the raw
+// response. It takes no longer than tcpQueryTimeout, and gives up early if ctx
+// is done.
+func queryDNSTCP(ctx context.Context, msg *Message, addr string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, tcpQueryTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer bindConn(ctx, conn)()
+	req, err := msg.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTCPMessage(conn, req); err != nil {
+		return nil, err
+	}
+	resp, err := readTCPMessage(conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctxError(ctx)
+	}
+	return resp, err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPMessageFraming(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeTCPMessage(&buf, sampleResponse); err != nil {
+		t.Fatalf("writeTCPMessage: %v", err)
+	}
+	if err := writeTCPMessage(&buf, nxdomainResponse); err != nil {
+		t.Fatalf("writeTCPMessage: %v", err)
+	}
+	if got := buf.Bytes()[:2]; !bytes.Equal(got, []byte{0, byte(len(sampleResponse))}) {
+		t.Fatalf("length prefix = %x, want %d", got, len(sampleResponse))
+	}
+	for _, want := range [][]byte{sampleResponse, nxdomainResponse} {
+		got, err := readTCPMessage(&buf)
+		if err != nil {
+			t.Fatalf("readTCPMessage: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("readTCPMessage = %x, want %x", got, want)
+		}
+	}
+	if _, err := readTCPMessage(&buf); !errors.Is(err, io.EOF) {
+		t.Fatalf("got err %v at end of stream, want EOF", err)
+	}
+}
+
+func TestTCPMessageShortBody(t *testing.T) {
+	buf := bytes.NewReader([]byte{0x00, 0x10, 0x01, 0x02})
+	if _, err := readTCPMessage(buf); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got err %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// truncatingUpstream listens on UDP and TCP on the same loopback port. Over
+// UDP it answers every query with an empty, truncated reply; over TCP it
+// answers with a single A record.
+type truncatingUpstream struct {
+	udp *net.UDPConn
+	tcp *net.TCPListener
+}
+
+func newTruncatingUpstream(t *testing.T) *truncatingUpstream {
+	t.Helper()
+	var u truncatingUpstream
+	for attempt := 0; ; attempt++ {
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("ListenUDP: %v", err)
+		}
+		tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: udp.LocalAddr().(*net.UDPAddr).Port})
+		if err == nil {
+			u.udp, u.tcp = udp, tcp
+			break
+		}
+		udp.Close()
+		if attempt == 10 {
+			t.Fatalf("ListenTCP: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		u.udp.Close()
+		u.tcp.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := u.udp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req, err := parseRequest(buf[:n])
+			if err != nil {
+				continue
+			}
+			req.Header.QR = 1
+			req.Header.Truncation = 1
+			if buf, err := req.ToBytes(); err == nil {
+				u.udp.WriteToUDP(buf, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := u.tcp.Accept()
+			if err != nil {
+				return
+			}
+			request, err := readTCPMessage(conn)
+			if err == nil {
+				req, err := parseRequest(request)
+				if err == nil {
+					req.Header.QR = 1
+					req.Answer = []*Answer{
+						{Name: req.Question[0].Name, Type: 1, Class: 1, TTL: 60, RDLength: 4, RData: []byte{192, 0, 2, 1}},
+					}
+					if buf, err := req.ToBytes(); err == nil {
+						writeTCPMessage(conn, buf)
+					}
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return &u
+}
+
+func TestExchangeRetriesTruncatedOverTCP(t *testing.T) {
+	upstream := newTruncatingUpstream(t)
+	conn, err := net.DialUDP("udp", nil, upstream.udp.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	defer conn.Close()
+
+	req := &Message{
+		Header:   &Header{ID: 99, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: 1, Class: 1}},
+	}
+	resp, err := exchange(withTimeout(t, time.Second), req, conn)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if resp.Header.Truncation != 0 {
+		t.Fatalf("response still truncated")
+	}
+	if len(resp.Answer) != 1 || !bytes.Equal(resp.Answer[0].RData, []byte{192, 0, 2, 1}) {
+		t.Fatalf("unexpected answers %+v", resp.Answer)
+	}
+
+	// With TCP gone the truncated UDP reply is passed through.
+	upstream.tcp.Close()
+	resp, err = exchange(withTimeout(t, time.Second), req, conn)
+	if err != nil {
+		t.Fatalf("exchange without TCP: %v", err)
+	}
+	if resp.Header.Truncation != 1 {
+		t.Fatalf("expected the TC bit to be kept when TCP fails")
+	}
+}
+
+func TestTCPDisconnectCancelsUpstreamQuery(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	cfg := &Config{
+		Upstreams: []Upstream{upstreamFunc(func(ctx context.Context, req *Message) (*Message, error) {
+			close(started)
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		})},
+		Timeout: time.Minute,
+	}
+	s := newServer(cfg)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	defer listener.Close()
+	go s.serveTCP(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if err := writeTCPMessage(conn, newQuery(t, 1, "example.com", TypeA)); err != nil {
+		t.Fatalf("writeTCPMessage: %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("query never reached the upstream")
+	}
+	conn.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("upstream query carried on after the client disconnected")
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errUpstreamTimeout is returned when an upstream does not answer in time.
+var errUpstreamTimeout = errors.New("upstream did not answer in time")
+
+// errReplyTooLarge is returned for an upstream reply larger than the server
+// allows on its transport: ednsUDPSize over UDP, or 65535 bytes over HTTPS.
+var errReplyTooLarge = errors.New("upstream reply too large")
+
+// Upstream is a resolver queries can be forwarded to. Implementations differ
+// only in the transport used to reach it.
+type Upstream interface {
+	// Exchange sends req and returns the parsed reply. It gives up when
+	// ctx is done, with errUpstreamTimeout if ctx ran out of time.
+	Exchange(ctx context.Context, req *Message) (*Message, error)
+	// String identifies the upstream in logs.
+	String() string
+}
+
+// A timeoutUpstream takes longer to answer than a forwarding upstream, and
+// says how long each attempt at a query may take.
+type timeoutUpstream interface {
+	Upstream
+	timeout() time.Duration
+}
+
+// attemptTimeout returns how long each attempt to query upstream may take:
+// the configured timeout, or longer if upstream needs it.
+func (s *Server) attemptTimeout(upstream Upstream) time.Duration {
+	if u, ok := upstream.(timeoutUpstream); ok {
+		return max(s.config.Timeout, u.timeout())
+	}
+	return s.config.Timeout
+}
+
+// upstreamSpec is an upstream as configured: the transport it is reached over,
+// one of udp, tcp, tls and https, and its ip:port, or its URL for https.
+type upstreamSpec struct {
+	Transport string
+	Addr      string
+}
+
+// defaultPorts are the ports upstream URLs without one are reached on.
+var defaultPorts = map[string]string{"udp": "53", "tcp": "53", "tls": "853"}
+
+// parseUpstreamSpec parses an upstream given either as a URL naming its
+// transport, such as tls://1.1.1.1 or https://dns.google/dns-query, or as a
+// bare ip:port reached over transport.
+func parseUpstreamSpec(arg, transport string) (upstreamSpec, error) {
+	addr := arg
+	scheme, rest, isURL := strings.Cut(arg, "://")
+	if isURL {
+		transport, addr = scheme, rest
+	}
+	switch transport {
+	case "https":
+		u, err := url.Parse(arg)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return upstreamSpec{}, fmt.Errorf("invalid upstream resolver URL %q: need an https URL", arg)
+		}
+		return upstreamSpec{Transport: transport, Addr: arg}, nil
+	case "udp", "tcp", "tls":
+	default:
+		return upstreamSpec{}, fmt.Errorf("invalid upstream resolver %q: unknown transport %q", arg, transport)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil && isURL {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), defaultPorts[transport])
+	}
+	upstream, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return upstreamSpec{}, fmt.Errorf("invalid upstream resolver address %q: %w", arg, err)
+	}
+	if upstream.IP == nil || upstream.Port == 0 {
+		return upstreamSpec{}, fmt.Errorf("invalid upstream resolver address %q: need an ip:port", arg)
+	}
+	return upstreamSpec{Transport: transport, Addr: upstream.String()}, nil
+}
+
+// upstream returns the Upstream spec describes. DoT certificates must be
+// valid for tlsName, or for the upstream's IP if it is empty, and DoH
+// queries are sent as GET requests if useGET is set.
+func (spec upstreamSpec) upstream(tlsName string, useGET bool) Upstream {
+	switch spec.Transport {
+	case "https":
+		return newHTTPSUpstream(spec.Addr, useGET)
+	case "tls":
+		if tlsName == "" {
+			tlsName, _, _ = net.SplitHostPort(spec.Addr)
+		}
+		return newTLSUpstream(spec.Addr, tlsName)
+	case "tcp":
+		return &tcpUpstream{addr: spec.Addr}
+	}
+	return &udpUpstream{addr: net.UDPAddrFromAddrPort(netip.MustParseAddrPort(spec.Addr))}
+}
+
+// udpUpstream reaches a resolver over plain UDP, falling back to TCP when a
+// reply comes back truncated.
+//
+// All queries share one socket, dialed on first use. A single reader
+// goroutine hands each reply to the query waiting on its transaction ID,
+// which the server already keeps unique across outstanding queries.
+type udpUpstream struct {
+	addr *net.UDPAddr
+
+	mu      sync.Mutex
+	conn    *net.UDPConn
+	waiting map[uint16]chan *[]byte
+
+	cookies upstreamCookies
+}
+
+// Exchange sends req with a DNS cookie, which makes a spoofed reply easy to
+// spot over UDP. A BADCOOKIE reply carries the server cookie the upstream
+// wants, so the query is sent once more with it; a second BADCOOKIE is an
+// error rather than a reply, since the client did nothing wrong.
+func (u *udpUpstream) Exchange(ctx context.Context, req *Message) (*Message, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := u.send(ctx, u.cookies.attach(req))
+		if err != nil {
+			return nil, err
+		}
+		if err := u.cookies.check(resp); err != nil {
+			return nil, err
+		}
+		if !badCookie(resp) {
+			return resp, nil
+		}
+		if attempt > 0 {
+			return nil, errCookieNotTaken
+		}
+	}
+}
+
+func (u *udpUpstream) send(ctx context.Context, req *Message) (*Message, error) {
+	query, err := req.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	conn, replies, err := u.register(req.Header.ID)
+	if err != nil {
+		return nil, err
+	}
+	if replies == nil {
+		// Another query with this ID is in flight on the shared socket,
+		// so this one gets a socket of its own.
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "udp", u.addr.String())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return exchange(ctx, req, conn.(*net.UDPConn))
+	}
+	defer u.unregister(req.Header.ID, replies)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	select {
+	case buf := <-replies:
+		defer putBuffer(buf)
+		return parseUDPReply(ctx, req, *buf, u.addr)
+	case <-ctx.Done():
+		return nil, ctxError(ctx)
+	}
+}
+
+// register returns the shared socket, dialing it if needed, and a channel the
+// reply with transaction ID id will be delivered on. The channel is nil if a
+// query with the same ID is already waiting.
+func (u *udpUpstream) register(id uint16) (*net.UDPConn, chan *[]byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn == nil {
+		conn, err := net.DialUDP("udp", nil, u.addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		u.conn = conn
+		u.waiting = make(map[uint16]chan *[]byte)
+		go u.readReplies(conn)
+	}
+	if _, taken := u.waiting[id]; taken {
+		return u.conn, nil, nil
+	}
+	// Buffered so the reader never blocks on a query that gave up.
+	replies := make(chan *[]byte, 1)
+	u.waiting[id] = replies
+	return u.conn, replies, nil
+}
+
+func (u *udpUpstream) unregister(id uint16, replies chan *[]byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.waiting[id] == replies {
+		delete(u.waiting, id)
+	}
+}
+
+// readReplies delivers every packet read from conn to the query waiting on its
+// transaction ID, dropping those nobody is waiting for, until conn is closed.
+// Each packet is read into a buffer from the pool, cut to its length, which
+// the query hands back once it has parsed the reply.
+func (u *udpUpstream) readReplies(conn *net.UDPConn) {
+	for {
+		buf := getBuffer()
+		n, err := conn.Read(*buf)
+		if err != nil {
+			putBuffer(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Typically an ICMP error for an earlier query; the
+			// query itself will time out.
+			slog.Debug("reading from upstream failed", "upstream", u.addr, "err", err)
+			continue
+		}
+		if n < 2 {
+			putBuffer(buf)
+			continue
+		}
+		id := binary.BigEndian.Uint16((*buf)[:2])
+		u.mu.Lock()
+		replies, ok := u.waiting[id]
+		delete(u.waiting, id)
+		u.mu.Unlock()
+		if !ok {
+			putBuffer(buf)
+			slog.Debug("dropping unexpected upstream reply", "upstream", u.addr, "id", id)
+			continue
+		}
+		*buf = (*buf)[:n]
+		replies <- buf
+	}
+}
+
+// Close closes the shared socket, which stops its reader.
+func (u *udpUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn == nil {
+		return nil
+	}
+	err := u.conn.Close()
+	u.conn = nil
+	return err
+}
+
+func (u *udpUpstream) String() string {
+	return u.addr.String()
+}
+
+// closeUpstreams closes those of upstreams that hold on to a socket between
+// queries, as udpUpstream does.
+func closeUpstreams(upstreams []Upstream) {
+	for _, upstream := range upstreams {
+		if c, ok := upstream.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				slog.Warn("closing upstream failed", "upstream", upstream, "err", err)
+			}
+		}
+	}
+}
+
+// ctxError is the error for an exchange that ctx ended: running out of time
+// is an upstream timeout, anything else a cancellation.
+func ctxError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errUpstreamTimeout
+	}
+	return ctx.Err()
+}
+
+// bindConn makes ctx govern the I/O on conn: ctx's deadline becomes conn's,
+// and ctx being cancelled interrupts any read or write in progress. Calling
+// the returned function releases conn from ctx again.
+func bindConn(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+}
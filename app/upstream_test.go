@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withTimeout returns a context that runs out after d, released when the test
+// ends.
+func withTimeout(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestCloseUpstreams(t *testing.T) {
+	mock := newMockUpstream(t, answerA)
+	u := mock.upstream().(*udpUpstream)
+	req := &Message{
+		Header:   &Header{ID: 1, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	if _, err := u.Exchange(withTimeout(t, time.Second), req); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	conn := u.conn
+	closeUpstreams([]Upstream{u, &tcpUpstream{addr: mock.addr().String()}})
+	if u.conn != nil {
+		t.Fatalf("shared socket still open after closeUpstreams")
+	}
+	if _, err := conn.Write([]byte{0}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write on the old socket got %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestUDPUpstreamSharesSocket(t *testing.T) {
+	// Replies are delayed so the queries overlap on the shared socket.
+	mock := newMockUpstream(t, answerAWith([]byte{192, 0, 2, 1}, time.Millisecond))
+	u := mock.upstream().(*udpUpstream)
+	defer u.Close()
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			name := fmt.Sprintf("q%d.example.com", id)
+			req := &Message{
+				Header:   &Header{ID: id, RecursionDesired: 1},
+				Question: []*Question{{Name: name, Type: TypeA, Class: 1}},
+			}
+			resp, err := u.Exchange(withTimeout(t, 5*time.Second), req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if resp.Header.ID != id || resp.Question[0].Name != name || resp.Answer[0].Name != name {
+				errs <- fmt.Errorf("query %d for %s got reply %d for %s", id, name, resp.Header.ID, resp.Question[0].Name)
+			}
+		}(uint16(1000 + i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if len(mock.seen()) != n {
+		t.Fatalf("upstream saw %d queries, want %d", len(mock.seen()), n)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.waiting) != 0 {
+		t.Fatalf("%d queries still waiting after all were answered", len(u.waiting))
+	}
+}
+
+func TestUDPUpstreamTimeout(t *testing.T) {
+	mock := newMockUpstream(t, func(*Message) *Message { return nil })
+	u := mock.upstream().(*udpUpstream)
+	defer u.Close()
+
+	req := &Message{
+		Header:   &Header{ID: 5},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	if _, err := u.Exchange(withTimeout(t, 20*time.Millisecond), req); err != errUpstreamTimeout {
+		t.Fatalf("got err %v, want %v", err, errUpstreamTimeout)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.waiting) != 0 {
+		t.Fatalf("timed out query is still waiting")
+	}
+}
+
+func TestUDPUpstreamRejectsOversizedReply(t *testing.T) {
+	// Twenty 255-byte strings come to over 5KB, more than ednsUDPSize.
+	mock := newMockUpstream(t, func(req *Message) *Message {
+		resp := answerA(req)
+		rdata := txtRData(strings.Repeat("x", 255))
+		resp.Answer = nil
+		for i := 0; i < 20; i++ {
+			resp.Answer = append(resp.Answer, &Answer{Name: req.Question[0].Name, Type: TypeTXT, Class: 1, TTL: 60, RDLength: uint16(len(rdata)), RData: rdata})
+		}
+		return resp
+	})
+	req := &Message{
+		Header:   &Header{ID: 6},
+		Question: []*Question{{Name: "example.com", Type: TypeTXT, Class: 1}},
+	}
+
+	u := mock.upstream().(*udpUpstream)
+	defer u.Close()
+	if _, err := u.Exchange(withTimeout(t, time.Second), req); !errors.Is(err, errReplyTooLarge) {
+		t.Errorf("shared socket: got err %v, want %v", err, errReplyTooLarge)
+	}
+
+	conn, err := net.DialUDP("udp", nil, mock.addr())
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	defer conn.Close()
+	if _, err := exchange(withTimeout(t, time.Second), req, conn); !errors.Is(err, errReplyTooLarge) {
+		t.Errorf("own socket: got err %v, want %v", err, errReplyTooLarge)
+	}
+}
+
+func TestExchangeReturnsWhenCancelled(t *testing.T) {
+	mock := newMockUpstream(t, func(*Message) *Message { return nil })
+	u := mock.upstream().(*udpUpstream)
+	defer u.Close()
+	// silent accepts TCP connections and never answers on them.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	req := &Message{
+		Header:   &Header{ID: 6},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	for _, tt := range []struct {
+		name     string
+		exchange func(ctx context.Context) error
+	}{
+		{"shared socket", func(ctx context.Context) error {
+			_, err := u.Exchange(ctx, req)
+			return err
+		}},
+		{"own socket", func(ctx context.Context) error {
+			conn, err := net.DialUDP("udp", nil, mock.addr())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			_, err = exchange(ctx, req, conn)
+			return err
+		}},
+		{"tcp", func(ctx context.Context) error {
+			_, err := queryDNSTCP(ctx, req, silent.Addr().String())
+			return err
+		}},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		start := time.Now()
+		err := tt.exchange(ctx)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: got err %v, want %v", tt.name, err, context.Canceled)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: took %v to notice the cancellation", tt.name, elapsed)
+		}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.waiting) != 0 {
+		t.Fatalf("cancelled query is still waiting")
+	}
+}
+
+func TestParseUpstreamSpec(t *testing.T) {
+	for _, tt := range []struct {
+		arg, transport string
+		want           upstreamSpec
+	}{
+		{"1.1.1.1:53", "udp", upstreamSpec{"udp", "1.1.1.1:53"}},
+		{"1.1.1.1:853", "tls", upstreamSpec{"tls", "1.1.1.1:853"}},
+		{"udp://1.1.1.1:5353", "tls", upstreamSpec{"udp", "1.1.1.1:5353"}},
+		{"udp://1.1.1.1", "udp", upstreamSpec{"udp", "1.1.1.1:53"}},
+		{"tcp://9.9.9.9", "udp", upstreamSpec{"tcp", "9.9.9.9:53"}},
+		{"tls://1.1.1.1", "udp", upstreamSpec{"tls", "1.1.1.1:853"}},
+		{"tls://[2606:4700:4700::1111]", "udp", upstreamSpec{"tls", "[2606:4700:4700::1111]:853"}},
+		{"tcp://[2001:db8::1]:5353", "udp", upstreamSpec{"tcp", "[2001:db8::1]:5353"}},
+		{"https://dns.google/dns-query", "udp", upstreamSpec{"https", "https://dns.google/dns-query"}},
+		{"https://dns.google/dns-query", "https", upstreamSpec{"https", "https://dns.google/dns-query"}},
+	} {
+		got, err := parseUpstreamSpec(tt.arg, tt.transport)
+		if err != nil || got != tt.want {
+			t.Errorf("parseUpstreamSpec(%q, %q) = %+v, %v; want %+v", tt.arg, tt.transport, got, err, tt.want)
+		}
+	}
+
+	for _, arg := range []string{
+		"1.1.1.1",
+		"quic://1.1.1.1",
+		"udp://1.1.1.1:53/dns",
+		"tls://:853",
+		"https://",
+		"http://dns.google/dns-query",
+	} {
+		if spec, err := parseUpstreamSpec(arg, "udp"); err == nil {
+			t.Errorf("parseUpstreamSpec(%q) = %+v, want error", arg, spec)
+		}
+	}
+}
+
+func TestTCPUpstream(t *testing.T) {
+	// The forwarding server itself serves as the TCP resolver.
+	addr := startServer(t, testConfig(newMockUpstream(t, answerA)))
+	spec, err := parseUpstreamSpec("tcp://"+addr.String(), "udp")
+	if err != nil {
+		t.Fatalf("parseUpstreamSpec: %v", err)
+	}
+	u := spec.upstream("", false)
+	if got, want := u.String(), "tcp://"+addr.String(); got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+	req := &Message{
+		Header:   &Header{ID: 8, RecursionDesired: 1},
+		Question: []*Question{{Name: "example.com", Type: TypeA, Class: 1}},
+	}
+	resp, err := u.Exchange(withTimeout(t, time.Second), req)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if err := checkReply(req, resp); err != nil || len(resp.Answer) != 1 {
+		t.Fatalf("reply %+v, %v", resp, err)
+	}
+}
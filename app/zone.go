@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultLocalTTL is the TTL given to answers the server makes up itself,
+// from the local zone or for CHAOS queries, unless configured otherwise.
+const defaultLocalTTL = 300
+
+// Zone holds records the server answers authoritatively instead of
+// forwarding. It is loaded once at startup and read-only afterwards.
+//
+// A name whose first label is * is a wildcard standing in for every name
+// below its parent that the zone does not otherwise hold (RFC 4592).
+type Zone struct {
+	records map[cacheKey][]*Answer
+	// names holds every lowercase name in the zone, including those that
+	// only exist because a name below them does.
+	names map[string]bool
+}
+
+// loadZone reads a zone from a hosts-style file, see parseZone.
+func loadZone(path string, ttl uint32) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseZone(f, ttl)
+}
+
+// parseZone reads lines of the form
+//
+//	<ip address> <name> [<name>...]
+//
+// like /etc/hosts does. IPv4 addresses become A records and IPv6 addresses
+// AAAA records. Names may start with a *. wildcard label. Everything after a
+// # is a comment.
+//
+// The records have the given TTL, unless their line has a ttl=<seconds>
+// field in place of a name.
+func parseZone(r io.Reader, ttl uint32) (*Zone, error) {
+	z := &Zone{records: make(map[cacheKey][]*Answer), names: make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected an address followed by names", lineno)
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		qtype, rdata := TypeA, addr.AsSlice()
+		if !addr.Unmap().Is4() {
+			qtype = TypeAAAA
+		} else {
+			rdata = addr.Unmap().AsSlice()
+		}
+		lineTTL, names := ttl, fields[:1]
+		for _, field := range fields[1:] {
+			value, ok := strings.CutPrefix(field, "ttl=")
+			if !ok {
+				names = append(names, field)
+				continue
+			}
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid TTL %q: %w", lineno, value, err)
+			}
+			lineTTL = uint32(seconds)
+		}
+		if len(names) < 2 {
+			return nil, fmt.Errorf("line %d: expected an address followed by names", lineno)
+		}
+		for _, name := range names[1:] {
+			name = strings.TrimSuffix(name, ".")
+			if err := validateName(name); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+			if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+				return nil, fmt.Errorf("line %d: %q: a wildcard must be the first label of a name", lineno, name)
+			}
+			for owner := strings.ToLower(name); owner != ""; {
+				z.names[owner] = true
+				_, owner, _ = strings.Cut(owner, ".")
+			}
+			key := newCacheKey(&Question{Name: name, Type: qtype, Class: 1}, false)
+			z.records[key] = append(z.records[key], &Answer{
+				Name:     name,
+				Type:     qtype,
+				Class:    1,
+				TTL:      lineTTL,
+				RDLength: uint16(len(rdata)),
+				RData:    rdata,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// Lookup returns copies of the local records answering q, or nil if there
+// are none. The answers carry the question's spelling of the name.
+func (z *Zone) Lookup(q *Question) []*Answer {
+	if z == nil {
+		return nil
+	}
+	key := newCacheKey(q, false)
+	records := z.records[key]
+	if len(records) == 0 {
+		records = z.records[z.wildcard(key)]
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	answers := copyRecords(records, 0)
+	for _, a := range answers {
+		a.Name = q.Name
+	}
+	return answers
+}
+
+// wildcard returns the key of the wildcard that would answer for key. Only
+// names the zone does not hold are answered by wildcards, and only by the one
+// directly below their closest encloser, the nearest ancestor the zone holds,
+// so a wildcard never covers names below another name that exists.
+func (z *Zone) wildcard(key cacheKey) cacheKey {
+	name := key.Name
+	if z.names[name] {
+		return cacheKey{}
+	}
+	for name != "" {
+		_, name, _ = strings.Cut(name, ".")
+		if z.names[name] {
+			key.Name = "*." + name
+			return key
+		}
+	}
+	return cacheKey{}
+}
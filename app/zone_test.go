@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testZone = `
+# local overrides
+10.0.0.1    intranet.example  wiki.intranet.example.
+10.0.0.2    intranet.example
+fd00::1     intranet.example
+`
+
+func TestParseZone(t *testing.T) {
+	z, err := parseZone(strings.NewReader(testZone), defaultLocalTTL)
+	if err != nil {
+		t.Fatalf("parseZone: %v", err)
+	}
+	a := z.Lookup(&Question{Name: "Intranet.Example", Type: TypeA, Class: 1})
+	if len(a) != 2 || !bytes.Equal(a[0].RData, []byte{10, 0, 0, 1}) || !bytes.Equal(a[1].RData, []byte{10, 0, 0, 2}) {
+		t.Fatalf("A lookup = %+v", a)
+	}
+	if a[0].Name != "Intranet.Example" || a[0].TTL != defaultLocalTTL {
+		t.Fatalf("unexpected answer %+v", a[0])
+	}
+	aaaa := z.Lookup(&Question{Name: "intranet.example", Type: TypeAAAA, Class: 1})
+	if len(aaaa) != 1 || aaaa[0].RDLength != 16 {
+		t.Fatalf("AAAA lookup = %+v", aaaa)
+	}
+	if got := z.Lookup(&Question{Name: "wiki.intranet.example", Type: TypeA, Class: 1}); len(got) != 1 {
+		t.Fatalf("alias lookup = %+v", got)
+	}
+	if got := z.Lookup(&Question{Name: "wiki.intranet.example", Type: TypeAAAA, Class: 1}); got != nil {
+		t.Fatalf("unexpected AAAA for alias: %+v", got)
+	}
+}
+
+const wildcardZone = `
+10.0.0.9    *.internal.example
+10.0.0.5    db.internal.example
+10.0.1.9    *.lab.internal.example
+10.0.2.1    host.staging.internal.example
+`
+
+func TestZoneWildcards(t *testing.T) {
+	z, err := parseZone(strings.NewReader(wildcardZone), defaultLocalTTL)
+	if err != nil {
+		t.Fatalf("parseZone: %v", err)
+	}
+	for _, tt := range []struct {
+		name  string
+		qtype Type
+		want  []byte
+	}{
+		{"anything.internal.example", TypeA, []byte{10, 0, 0, 9}},
+		{"Two.Levels.internal.example", TypeA, []byte{10, 0, 0, 9}},
+		// A name that exists beats the wildcard, even for a type it
+		// lacks, and so do the names below it.
+		{"db.internal.example", TypeA, []byte{10, 0, 0, 5}},
+		{"db.internal.example", TypeAAAA, nil},
+		{"x.db.internal.example", TypeA, nil},
+		// The wildcard closest to the name is the one that applies.
+		{"pc1.lab.internal.example", TypeA, []byte{10, 0, 1, 9}},
+		{"a.b.lab.internal.example", TypeA, []byte{10, 0, 1, 9}},
+		// staging exists only as the parent of a name, so its own
+		// wildcard, which it lacks, is the one that would apply.
+		{"staging.internal.example", TypeA, nil},
+		{"web.staging.internal.example", TypeA, nil},
+		{"internal.example", TypeA, nil},
+		{"anything.internal.example", TypeAAAA, nil},
+		{"other.example", TypeA, nil},
+	} {
+		answers := z.Lookup(&Question{Name: tt.name, Type: tt.qtype, Class: 1})
+		switch {
+		case tt.want == nil && answers != nil:
+			t.Errorf("%s %s: got %+v, want no answer", tt.name, tt.qtype, answers)
+		case tt.want != nil && (len(answers) != 1 || !bytes.Equal(answers[0].RData, tt.want) || answers[0].Name != tt.name):
+			t.Errorf("%s %s: got %+v, want %v", tt.name, tt.qtype, answers, tt.want)
+		}
+	}
+}
+
+func TestLocalAnswersCarryConfiguredTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zone")
+	zone := "10.0.0.1 default.example\n10.0.0.2 short.example ttl=5 other.example\n"
+	if err := os.WriteFile(path, []byte(zone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := newConfig([]string{"-zone", path, "-local-ttl", "42", "8.8.8.8:53"})
+	if err != nil {
+		t.Fatalf("newConfig: %v", err)
+	}
+	s := newServer(cfg)
+	for i, tt := range []struct {
+		query []byte
+		want  uint32
+	}{
+		{newQuery(t, 1, "default.example", TypeA), 42},
+		{newQuery(t, 2, "short.example", TypeA), 5},
+		{newQuery(t, 3, "other.example", TypeA), 5},
+		{newChaosQuery(t, 4, "version.bind"), 42},
+	} {
+		resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, tt.query))
+		if err != nil || len(resp.Answer) != 1 {
+			t.Fatalf("query %d: response %+v, %v", i, resp, err)
+		}
+		if got := resp.Answer[0].TTL; got != tt.want {
+			t.Errorf("%s: TTL %d, want %d", resp.Answer[0].Name, got, tt.want)
+		}
+	}
+
+	if _, err := newConfig([]string{"-local-ttl", "4294967296", "8.8.8.8:53"}); err == nil {
+		t.Error("accepted a local TTL that does not fit in 32 bits")
+	}
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	for _, zone := range []string{
+		"10.0.0.1\n",
+		"10.0.0.1 a.*.example\n",
+		"10.0.0.1 *a.example\n",
+		"not-an-ip example.com\n",
+		"10.0.0.1 " + strings.Repeat("a", 64) + ".example\n",
+		"10.0.0.1 ttl=60\n",
+		"10.0.0.1 a.example ttl=4294967296\n",
+		"10.0.0.1 a.example ttl=-1\n",
+		"10.0.0.1 a.example ttl=1h\n",
+	} {
+		if _, err := parseZone(strings.NewReader(zone), defaultLocalTTL); err == nil {
+			t.Errorf("parseZone(%q) succeeded, want error", zone)
+		}
+	}
+}
+
+func TestZoneHitAndMiss(t *testing.T) {
+	upstream := newMockUpstream(t, answerA)
+	cfg := testConfig(upstream)
+	zone, err := parseZone(strings.NewReader(testZone), defaultLocalTTL)
+	if err != nil {
+		t.Fatalf("parseZone: %v", err)
+	}
+	cfg.Zone = zone
+	s := newServer(cfg)
+
+	resp, err := parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 1, "intranet.example", TypeA)))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Header.AuthorativeAnswer != 1 || len(resp.Answer) != 2 {
+		t.Fatalf("local answer: AA=%d with %d answers", resp.Header.AuthorativeAnswer, len(resp.Answer))
+	}
+	if n := len(upstream.seen()); n != 0 {
+		t.Fatalf("local name was forwarded %d times", n)
+	}
+
+	resp, err = parseRequest(s.answerRequest(context.Background(), clientAddr, newQuery(t, 2, "example.com", TypeA)))
+	if err != nil {
+		t.Fatalf("parseRequest: %v", err)
+	}
+	if resp.Header.AuthorativeAnswer != 0 || len(resp.Answer) != 1 || !bytes.Equal(resp.Answer[0].RData, []byte{192, 0, 2, 1}) {
+		t.Fatalf("forwarded answer: AA=%d answers %+v", resp.Header.AuthorativeAnswer, resp.Answer)
+	}
+	if n := len(upstream.seen()); n != 1 {
+		t.Fatalf("upstream saw %d queries, want 1", n)
+	}
+}